@@ -21,6 +21,7 @@ import (
 
 	"github.com/Huang-Wei/shared-loadbalancer/pkg/apis"
 	"github.com/Huang-Wei/shared-loadbalancer/pkg/controller"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/metrics"
 	"github.com/Huang-Wei/shared-loadbalancer/pkg/webhook"
 
 	// _ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
@@ -73,6 +74,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	log.Info("setting up metrics server")
+	if err := metrics.AddToManager(mgr); err != nil {
+		log.Error(err, "unable to register metrics server to the manager")
+		os.Exit(1)
+	}
+
 	// Start the Cmd
 	log.Info("Starting the Cmd.")
 	if err := mgr.Start(signals.SetupSignalHandler()); err != nil {
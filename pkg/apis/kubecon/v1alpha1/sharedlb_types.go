@@ -26,12 +26,129 @@ type SharedLBSpec struct {
 	Ports          []corev1.ServicePort `json:"ports,omitempty"`
 	Selector       map[string]string    `json:"selector,omitempty"`
 	LoadBalancerIP string               `json:"loadBalancerIP,omitempty"`
+	// Strategy overrides the controller's placement strategy for this SharedLB,
+	// one of "random", "pack", "spread" and "hash"
+	// +kubebuilder:validation:Enum=random,pack,spread,hash
+	Strategy string `json:"strategy,omitempty"`
+	// PoolName is the name of SharedLBPool this SharedLB is placed in;
+	// LoadBalancers which don't belong to any pool are used if it's empty
+	PoolName string `json:"poolName,omitempty"`
+	// PortMode tells how ports are exposed when they're taken by others, one of
+	// "Strict" and "Flexible"; defaults to "Strict"
+	// +kubebuilder:validation:Enum=Strict,Flexible
+	PortMode SharedLBPortMode `json:"portMode,omitempty"`
 }
 
+// SharedLBPortMode tells how ports of a SharedLB are exposed
+type SharedLBPortMode string
+
+const (
+	// SharedLBPortModeStrict exposes ports exactly as requested; the SharedLB is not placed
+	// while its ports are taken on every LoadBalancer which has a free slot
+	SharedLBPortModeStrict SharedLBPortMode = "Strict"
+	// SharedLBPortModeFlexible replaces requested ports which are taken, with free ones in
+	// the port range of the SharedLBPool (or the default range)
+	SharedLBPortModeFlexible SharedLBPortMode = "Flexible"
+)
+
 // SharedLBStatus defines the observed state of SharedLB
 type SharedLBStatus struct {
 	Ref          string                    `json:"ref,omitempty"`
 	LoadBalancer corev1.LoadBalancerStatus `json:"loadBalancer,omitempty"`
+	// Phase is a high-level summary of where the SharedLB is in its lifecycle
+	Phase SharedLBPhase `json:"phase,omitempty"`
+	// ObservedGeneration is the most recent generation observed by the controller
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Endpoints are the external endpoints the SharedLB is finally exposed on
+	Endpoints []SharedLBEndpoint `json:"endpoints,omitempty"`
+	// ReassignedPorts are ports requested in spec which are taken on the LoadBalancer,
+	// and exposed on other ports instead in flexible mode
+	ReassignedPorts []SharedLBPortReassignment `json:"reassignedPorts,omitempty"`
+	// Migration describes the latest move of the SharedLB from one LoadBalancer to another
+	Migration  *SharedLBMigration  `json:"migration,omitempty"`
+	Conditions []SharedLBCondition `json:"conditions,omitempty"`
+}
+
+// SharedLBPhase is a label for the lifecycle phase of a SharedLB
+type SharedLBPhase string
+
+const (
+	// SharedLBPending means the SharedLB is accepted, but not placed onto a LoadBalancer yet
+	SharedLBPending SharedLBPhase = "Pending"
+	// SharedLBProvisioning means the SharedLB is waiting for a LoadBalancer to be provisioned
+	SharedLBProvisioning SharedLBPhase = "Provisioning"
+	// SharedLBBound means the SharedLB is placed onto a LoadBalancer, and its ports are being configured
+	SharedLBBound SharedLBPhase = "Bound"
+	// SharedLBReady means the SharedLB is exposed on all its endpoints
+	SharedLBReady SharedLBPhase = "Ready"
+	// SharedLBFailed means the SharedLB can't be placed without user intervention,
+	// e.g. it refers to an invalid pool, or its ports conflict with others
+	SharedLBFailed SharedLBPhase = "Failed"
+	// SharedLBTerminating means the SharedLB is being removed from its LoadBalancer
+	SharedLBTerminating SharedLBPhase = "Terminating"
+)
+
+// SharedLBEndpoint is an external address and port a SharedLB is exposed on
+type SharedLBEndpoint struct {
+	IP       string          `json:"ip,omitempty"`
+	Hostname string          `json:"hostname,omitempty"`
+	Port     int32           `json:"port"`
+	Protocol corev1.Protocol `json:"protocol,omitempty"`
+}
+
+// SharedLBPortReassignment is a port requested in spec, which is exposed on another port
+type SharedLBPortReassignment struct {
+	Protocol corev1.Protocol `json:"protocol,omitempty"`
+	// Port is the port requested in spec
+	Port int32 `json:"port"`
+	// AssignedPort is the port exposed on the LoadBalancer instead
+	AssignedPort int32 `json:"assignedPort"`
+}
+
+// SharedLBMigration describes a move of a SharedLB from one LoadBalancer to another.
+// The SharedLB is exposed on both LoadBalancers from SwitchTime to CompletionTime,
+// clients still using endpoints of the source lose connectivity after CompletionTime.
+type SharedLBMigration struct {
+	// From is the LoadBalancer the SharedLB is moved from, in format of "namespace/name"
+	From string `json:"from"`
+	// To is the LoadBalancer the SharedLB is moved to, in format of "namespace/name"
+	To string `json:"to"`
+	// StartTime is when a slot on the target LoadBalancer was reserved
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// SwitchTime is when the SharedLB got exposed on the target LoadBalancer
+	SwitchTime *metav1.Time `json:"switchTime,omitempty"`
+	// CompletionTime is when the SharedLB was removed from the source LoadBalancer
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// SharedLBConditionType is a valid value for SharedLBCondition.Type
+type SharedLBConditionType string
+
+const (
+	// SharedLBReadyCondition means the SharedLB is exposed on all its endpoints
+	SharedLBReadyCondition SharedLBConditionType = "Ready"
+	// SharedLBProvisioned means the SharedLB is placed onto a provisioned LoadBalancer
+	SharedLBProvisioned SharedLBConditionType = "LBProvisioned"
+	// SharedLBListenersConfigured means ports of the SharedLB are forwarded by the LoadBalancer
+	SharedLBListenersConfigured SharedLBConditionType = "ListenersConfigured"
+	// SharedLBFirewallConfigured means traffic to ports of the SharedLB is allowed by the firewall
+	SharedLBFirewallConfigured SharedLBConditionType = "FirewallConfigured"
+	// SharedLBMigrating means the SharedLB is being moved to another LoadBalancer
+	SharedLBMigrating SharedLBConditionType = "Migrating"
+	// SharedLBStalled means the SharedLB has been retried many times without making progress
+	SharedLBStalled SharedLBConditionType = "Stalled"
+)
+
+// SharedLBCondition describes the state of a SharedLB at a certain point
+type SharedLBCondition struct {
+	Type   SharedLBConditionType  `json:"type"`
+	Status corev1.ConditionStatus `json:"status"`
+	// LastTransitionTime is the last time the condition transitioned from one status to another
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// Reason is a one-word CamelCase reason for the condition's last transition
+	Reason string `json:"reason,omitempty"`
+	// Message is a human readable message indicating details about the transition
+	Message string `json:"message,omitempty"`
 }
 
 // +genclient
@@ -39,6 +156,7 @@ type SharedLBStatus struct {
 
 // SharedLB is the Schema for the sharedlbs API
 // +k8s:openapi-gen=true
+// +kubebuilder:subresource:status
 type SharedLB struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
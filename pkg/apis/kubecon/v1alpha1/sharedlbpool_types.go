@@ -0,0 +1,90 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SharedLBPoolSpec defines the desired state of SharedLBPool
+type SharedLBPoolSpec struct {
+	// Capacity is the number of SharedLBs a LoadBalancer in this pool can hold,
+	// the controller's default capacity is used if it's not set
+	// +kubebuilder:validation:Minimum=1
+	Capacity int `json:"capacity,omitempty"`
+	// MinFreeSlots is the number of free slots kept ahead of demand; LoadBalancers
+	// are provisioned in advance once free slots of this pool drop below it
+	// +kubebuilder:validation:Minimum=0
+	MinFreeSlots int `json:"minFreeSlots,omitempty"`
+	// PortRange is the range ports are assigned from, for SharedLBs in this pool
+	PortRange *PortRange `json:"portRange,omitempty"`
+	// Template is applied to LoadBalancer Services created for this pool
+	Template LBServiceTemplate `json:"template,omitempty"`
+}
+
+// PortRange is a range of ports, both ends inclusive
+type PortRange struct {
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Min int32 `json:"min"`
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Max int32 `json:"max"`
+}
+
+// LBServiceTemplate describes the LoadBalancer Services created for a pool
+type LBServiceTemplate struct {
+	// Labels are added to LoadBalancer Services
+	Labels map[string]string `json:"labels,omitempty"`
+	// Annotations are added to LoadBalancer Services; that's where provider
+	// specific settings go, e.g. "service.beta.kubernetes.io/aws-load-balancer-internal"
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// LoadBalancerSourceRanges restricts traffic through the LoadBalancers
+	LoadBalancerSourceRanges []string `json:"loadBalancerSourceRanges,omitempty"`
+	// ExternalTrafficPolicy of the LoadBalancer Services
+	ExternalTrafficPolicy corev1.ServiceExternalTrafficPolicyType `json:"externalTrafficPolicy,omitempty"`
+}
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// SharedLBPool is the Schema for the sharedlbpools API.
+// A SharedLB refers to a pool by name, and is only placed on LoadBalancers of that pool.
+// +k8s:openapi-gen=true
+// +kubebuilder:resource:path=sharedlbpools,shortName=slbpool
+type SharedLBPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec SharedLBPoolSpec `json:"spec,omitempty"`
+}
+
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// SharedLBPoolList contains a list of SharedLBPool
+type SharedLBPoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []SharedLBPool `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&SharedLBPool{}, &SharedLBPoolList{})
+}
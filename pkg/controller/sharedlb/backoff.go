@@ -0,0 +1,112 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// backoffPolicy computes requeue delays of each object which keeps being retried,
+// e.g. failing to create a LB, or failing in other cloud API calls.
+// The n-th retry is delayed for min(base * 2^(n-1), max), plus a random jitter.
+type backoffPolicy struct {
+	base time.Duration
+	max  time.Duration
+	// jitter is the max fraction of delay added randomly, so that objects
+	// failing at the same time don't retry at the same time
+	jitter float64
+	// stallAfter is the number of retries after which the object is reported as stalled
+	stallAfter int
+
+	lock sync.Mutex
+	// retries is keyed with ns/name of an object, and valued with number of retries
+	retries map[types.NamespacedName]int
+}
+
+func newBackoffPolicy() *backoffPolicy {
+	return &backoffPolicy{
+		base:       providers.GetEnvValDuration("BACKOFF_BASE", 100*time.Millisecond),
+		max:        providers.GetEnvValDuration("BACKOFF_MAX", 5*time.Minute),
+		jitter:     float64(providers.GetEnvValInt("BACKOFF_JITTER_PERCENT", 10)) / 100,
+		stallAfter: providers.GetEnvValInt("BACKOFF_STALL_AFTER", 12),
+		retries:    make(map[types.NamespacedName]int),
+	}
+}
+
+// next records one more retry of name, and returns the delay before it
+// along with number of retries so far
+func (b *backoffPolicy) next(name types.NamespacedName) (time.Duration, int) {
+	b.lock.Lock()
+	b.retries[name]++
+	n := b.retries[name]
+	b.lock.Unlock()
+
+	delay := b.max
+	// avoid overflow of shifting
+	if n <= 32 {
+		if d := b.base << uint(n-1); d > 0 && d < b.max {
+			delay = d
+		}
+	}
+	if b.jitter > 0 {
+		delay += time.Duration(rand.Float64() * b.jitter * float64(delay))
+	}
+	return delay, n
+}
+
+// stalled tells whether retries reach the threshold of being reported as stalled
+func (b *backoffPolicy) stalled(retries int) bool {
+	return b.stallAfter > 0 && retries >= b.stallAfter
+}
+
+// reset forgets retries of name, i.e. it has made progress
+func (b *backoffPolicy) reset(name types.NamespacedName) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.retries, name)
+}
+
+// retry requeues crObj with backoff, and writes its status changed from orig. Once it's been
+// retried too many times, the SharedLB is marked as stalled, with reason and message telling
+// what it's stuck at.
+func (r *ReconcileSharedLB) retry(crObj *kubeconv1alpha1.SharedLB, orig *kubeconv1alpha1.SharedLBStatus, reason, message string) (reconcile.Result, error) {
+	crName := types.NamespacedName{Name: crObj.Name, Namespace: crObj.Namespace}
+	delay, retries := r.backoff.next(crName)
+	if r.backoff.stalled(retries) {
+		log.Info("SharedLB is stalled", "request", crName, "retries", retries, "reason", reason)
+		if setCondition(&crObj.Status, kubeconv1alpha1.SharedLBStalled, corev1.ConditionTrue, reason, message) {
+			r.recorder.Eventf(crObj, corev1.EventTypeWarning, "Stalled", "Retried %d times without progress: %s", retries, message)
+		}
+	}
+	return reconcile.Result{RequeueAfter: delay}, r.updateStatus(crObj, orig)
+}
+
+// progressed resets backoff of crObj, and clears its stalled condition if any
+func (r *ReconcileSharedLB) progressed(crObj *kubeconv1alpha1.SharedLB) {
+	r.backoff.reset(types.NamespacedName{Name: crObj.Name, Namespace: crObj.Namespace})
+	if getCondition(&crObj.Status, kubeconv1alpha1.SharedLBStalled) != nil {
+		setCondition(&crObj.Status, kubeconv1alpha1.SharedLBStalled, corev1.ConditionFalse, "Progressing", "")
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"testing"
+	"time"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestBackoffPolicy(t *testing.T) {
+	b := &backoffPolicy{
+		base:       100 * time.Millisecond,
+		max:        time.Second,
+		stallAfter: 5,
+		retries:    make(map[types.NamespacedName]int),
+	}
+	foo := types.NamespacedName{Name: "foo", Namespace: "default"}
+	bar := types.NamespacedName{Name: "bar", Namespace: "default"}
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		delay, retries := b.next(foo)
+		if delay != w*time.Millisecond || retries != i+1 {
+			t.Errorf("#%d next() = %v, %d, want %v, %d", i, delay, retries, w*time.Millisecond, i+1)
+		}
+		if got := b.stalled(retries); got != (retries >= 5) {
+			t.Errorf("#%d stalled() = %v", i, got)
+		}
+	}
+	// objects are backed off individually
+	if delay, _ := b.next(bar); delay != 100*time.Millisecond {
+		t.Errorf("next() = %v, want %v", delay, 100*time.Millisecond)
+	}
+	b.reset(foo)
+	if delay, _ := b.next(foo); delay != 100*time.Millisecond {
+		t.Errorf("next() = %v after reset, want %v", delay, 100*time.Millisecond)
+	}
+
+	// jitter is bounded, and never shortens the delay
+	b.jitter = 0.5
+	b.retries[bar] = 10
+	for i := 0; i < 100; i++ {
+		if delay, _ := b.next(bar); delay < time.Second || delay > time.Second*3/2 {
+			t.Fatalf("next() = %v, want one in [1s, 1.5s]", delay)
+		}
+	}
+}
+
+func TestSetCondition(t *testing.T) {
+	status := &kubeconv1alpha1.SharedLBStatus{}
+	if !setCondition(status, kubeconv1alpha1.SharedLBStalled, corev1.ConditionTrue, "LBNotFound", "LoadBalancer default/lb-1 is not found") {
+		t.Errorf("setCondition() = false, want true as the condition is added")
+	}
+	transition := getCondition(status, kubeconv1alpha1.SharedLBStalled).LastTransitionTime
+	if setCondition(status, kubeconv1alpha1.SharedLBStalled, corev1.ConditionTrue, "LBNotFound", "LoadBalancer default/lb-1 is not found") {
+		t.Errorf("setCondition() = true, want false as nothing is changed")
+	}
+	if !setCondition(status, kubeconv1alpha1.SharedLBStalled, corev1.ConditionTrue, "CreateLBFailed", "quota exceeded") {
+		t.Errorf("setCondition() = false, want true as reason is changed")
+	}
+	cond := getCondition(status, kubeconv1alpha1.SharedLBStalled)
+	if len(status.Conditions) != 1 || cond.Reason != "CreateLBFailed" || !cond.LastTransitionTime.Equal(&transition) {
+		t.Errorf("conditions = %v, want one condition updated in place", status.Conditions)
+	}
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// getCondition returns the condition of condType, or nil if it's not there
+func getCondition(status *kubeconv1alpha1.SharedLBStatus, condType kubeconv1alpha1.SharedLBConditionType) *kubeconv1alpha1.SharedLBCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == condType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// setCondition adds or updates the condition of condType, and returns whether
+// anything is changed. LastTransitionTime is only bumped when status changes.
+func setCondition(status *kubeconv1alpha1.SharedLBStatus, condType kubeconv1alpha1.SharedLBConditionType,
+	condStatus corev1.ConditionStatus, reason, message string) bool {
+	cond := getCondition(status, condType)
+	if cond == nil {
+		status.Conditions = append(status.Conditions, kubeconv1alpha1.SharedLBCondition{
+			Type:               condType,
+			Status:             condStatus,
+			LastTransitionTime: metav1.Now(),
+			Reason:             reason,
+			Message:            message,
+		})
+		return true
+	}
+	if cond.Status == condStatus && cond.Reason == reason && cond.Message == message {
+		return false
+	}
+	if cond.Status != condStatus {
+		cond.LastTransitionTime = metav1.Now()
+	}
+	cond.Status, cond.Reason, cond.Message = condStatus, reason, message
+	return true
+}
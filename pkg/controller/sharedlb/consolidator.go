@@ -0,0 +1,382 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/metrics"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// consolidator moves tenants off thinly used LBs onto busier ones in the same pool, so
+// that whole LBs are freed, and then deleted by reclaimer. Tenants are moved by setting
+// TargetLBAnnotation, within a budget of moves per hour and an optional maintenance
+// window. In dry-run mode, moves are only planned and reported.
+type consolidator struct {
+	r               *ReconcileSharedLB
+	interval        time.Duration
+	maxMovesPerHour int
+	window          *maintenanceWindow
+	dryRun          bool
+
+	// moves are times of moves made in the last hour
+	moves []time.Time
+}
+
+var _ manager.Runnable = &consolidator{}
+
+func newConsolidator(r *ReconcileSharedLB) (*consolidator, error) {
+	window, err := parseMaintenanceWindow(providers.GetEnvVal("CONSOLIDATE_WINDOW", ""))
+	if err != nil {
+		return nil, err
+	}
+	return &consolidator{
+		r:               r,
+		interval:        providers.GetEnvValDuration("CONSOLIDATE_INTERVAL", 0),
+		maxMovesPerHour: providers.GetEnvValInt("CONSOLIDATE_MAX_MOVES_PER_HOUR", 10),
+		window:          window,
+		dryRun:          providers.GetEnvValBool("CONSOLIDATE_DRY_RUN", false),
+	}, nil
+}
+
+// Start consolidates LBs periodically until stop is closed.
+// It's disabled unless CONSOLIDATE_INTERVAL is set.
+func (c *consolidator) Start(stop <-chan struct{}) error {
+	if c.interval <= 0 {
+		log.Info("LB consolidator is disabled")
+		<-stop
+		return nil
+	}
+	log.Info("LB consolidator is enabled", "interval", c.interval, "maxMovesPerHour", c.maxMovesPerHour, "window", c.window, "dryRun", c.dryRun)
+	wait.Until(func() {
+		if err := c.consolidate(time.Now()); err != nil {
+			log.Error(err, "fail to consolidate LBs")
+		}
+	}, c.interval, stop)
+	return nil
+}
+
+func (c *consolidator) consolidate(now time.Time) error {
+	if !c.window.contains(now) {
+		return nil
+	}
+	budget := c.budget(now)
+	if budget <= 0 {
+		log.Info("Consolidation is skipped as budget of moves per hour runs out", "max", c.maxMovesPerHour)
+		return nil
+	}
+	// before provider cache is rebuilt, every LB looks empty
+	if err := c.r.warmUp(); err != nil {
+		return err
+	}
+	settings, err := c.r.poolSettings()
+	if err != nil {
+		return err
+	}
+	crObjs := &kubeconv1alpha1.SharedLBList{}
+	if err := c.r.List(context.TODO(), &client.ListOptions{}, crObjs); err != nil {
+		return err
+	}
+
+	moves := planMoves(lbStates(c.r.provider.ListLBs(), crObjs.Items), settings, budget)
+	metrics.ConsolidationMoves.WithLabelValues("planned").Add(float64(len(moves)))
+	c.report(moves)
+	if c.dryRun {
+		return nil
+	}
+	executed := 0
+	for _, m := range moves {
+		if err := c.execute(m); err != nil {
+			log.Error(err, "fail to move tenant", "tenant", m.tenant, "from", m.from, "to", m.to)
+			metrics.ConsolidationMoves.WithLabelValues("failed").Inc()
+			continue
+		}
+		c.moves = append(c.moves, now)
+		executed++
+		metrics.ConsolidationMoves.WithLabelValues("executed").Inc()
+	}
+	log.Info("Consolidation is done", "planned", len(moves), "executed", executed)
+	return nil
+}
+
+// budget drops moves made more than an hour ago, and returns how many moves can be made
+func (c *consolidator) budget(now time.Time) int {
+	i := 0
+	for i < len(c.moves) && now.Sub(c.moves[i]) >= time.Hour {
+		i++
+	}
+	c.moves = c.moves[i:]
+	return c.maxMovesPerHour - len(c.moves)
+}
+
+// report logs moves, and emits an event on each LB to be freed
+func (c *consolidator) report(moves []move) {
+	prefix := ""
+	if c.dryRun {
+		prefix = "[dry-run] "
+	}
+	perLB := make(map[types.NamespacedName][]string)
+	var lbNames []types.NamespacedName
+	for _, m := range moves {
+		if _, ok := perLB[m.from]; !ok {
+			lbNames = append(lbNames, m.from)
+		}
+		perLB[m.from] = append(perLB[m.from], fmt.Sprintf("%s to %s", m.tenant, m.to))
+		log.Info(prefix+"Planned a consolidation move", "tenant", m.tenant, "from", m.from, "to", m.to)
+	}
+	for _, lbName := range lbNames {
+		lbSvc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: lbName.Name, Namespace: lbName.Namespace}}
+		c.r.recorder.Eventf(lbSvc, corev1.EventTypeNormal, "ConsolidationPlanned", "%sPlanned to free the LoadBalancer by moving %v", prefix, perLB[lbName])
+	}
+}
+
+// execute asks the tenant of m to be moved, if it's still where it was planned
+func (c *consolidator) execute(m move) error {
+	crObj := &kubeconv1alpha1.SharedLB{}
+	if err := c.r.Get(context.TODO(), m.tenant, crObj); err != nil {
+		return err
+	}
+	if crObj.Status.Ref != m.from.String() || migrating(&crObj.Status) || pinned(crObj) {
+		return fmt.Errorf("tenant %s is changed after planning", m.tenant)
+	}
+	if crObj.Annotations == nil {
+		crObj.Annotations = make(map[string]string)
+	}
+	crObj.Annotations[providers.TargetLBAnnotation] = m.to.String()
+	crObj.Annotations[providers.ConsolidatedAnnotation] = m.to.String()
+	if err := c.r.Update(context.TODO(), crObj); err != nil {
+		return err
+	}
+	c.r.recorder.Eventf(crObj, corev1.EventTypeNormal, "Consolidating", "Moving from LoadBalancer %s to %s to free it", m.from, m.to)
+	return nil
+}
+
+// move is a planned move of a tenant from one LB to another
+type move struct {
+	tenant   types.NamespacedName
+	from, to types.NamespacedName
+}
+
+// tenant is a SharedLB on a LB, as seen by consolidator
+type tenant struct {
+	name  types.NamespacedName
+	ports []providers.PortKey
+	// pinned tenants can't be moved
+	pinned bool
+}
+
+// lbState is a ready LB along with its tenants
+type lbState struct {
+	name    types.NamespacedName
+	pool    string
+	tenants []tenant
+	// busy tells whether a tenant is being moved onto or off the LB
+	busy bool
+}
+
+// lbStates puts crObjs onto ready LBs in usages
+func lbStates(usages []providers.LBUsage, crObjs []kubeconv1alpha1.SharedLB) []*lbState {
+	states := make(map[string]*lbState, len(usages))
+	var lbs []*lbState
+	for _, usage := range usages {
+		if !usage.Ready {
+			continue
+		}
+		lb := &lbState{name: usage.Name, pool: usage.Pool}
+		states[usage.Name.String()] = lb
+		lbs = append(lbs, lb)
+	}
+	for i := range crObjs {
+		crObj := &crObjs[i]
+		lb, ok := states[crObj.Status.Ref]
+		if !ok {
+			continue
+		}
+		if migrating(&crObj.Status) {
+			lb.busy = true
+			if from, ok := states[crObj.Status.Migration.From]; ok {
+				from.busy = true
+			}
+			continue
+		}
+		lb.tenants = append(lb.tenants, tenant{
+			name:   types.NamespacedName{Name: crObj.Name, Namespace: crObj.Namespace},
+			ports:  portKeysOf(providers.ExposedPorts(crObj)),
+			pinned: pinned(crObj),
+		})
+	}
+	return lbs
+}
+
+// planMoves plans at most budget moves, which free whole LBs in each pool without
+// moving pinned tenants or breaking port uniqueness. The least used LBs are drained
+// first, onto the most used ones which still have free slots.
+func planMoves(lbs []*lbState, settings map[string]poolSetting, budget int) []move {
+	pools := make(map[string][]*lbState)
+	var poolNames []string
+	for _, lb := range lbs {
+		if _, ok := pools[lb.pool]; !ok {
+			poolNames = append(poolNames, lb.pool)
+		}
+		pools[lb.pool] = append(pools[lb.pool], lb)
+	}
+	sort.Strings(poolNames)
+
+	var moves []move
+	for _, poolName := range poolNames {
+		capacity := settingOf(settings, poolName).capacity
+		poolLBs := pools[poolName]
+		tenants := make(map[types.NamespacedName]int, len(poolLBs))
+		ports := make(map[types.NamespacedName]map[providers.PortKey]struct{}, len(poolLBs))
+		for _, lb := range poolLBs {
+			tenants[lb.name] = len(lb.tenants)
+			ports[lb.name] = make(map[providers.PortKey]struct{})
+			for _, t := range lb.tenants {
+				for _, port := range t.ports {
+					ports[lb.name][port] = struct{}{}
+				}
+			}
+		}
+		sort.Slice(poolLBs, func(i, j int) bool {
+			if len(poolLBs[i].tenants) == len(poolLBs[j].tenants) {
+				return poolLBs[i].name.String() < poolLBs[j].name.String()
+			}
+			return len(poolLBs[i].tenants) < len(poolLBs[j].tenants)
+		})
+
+		// freed LBs are not moved onto, and LBs moved onto are not drained
+		freed := make(map[types.NamespacedName]bool)
+		received := make(map[types.NamespacedName]bool)
+		for _, src := range poolLBs {
+			if len(src.tenants) == 0 || len(src.tenants) > budget || src.busy || received[src.name] || hasPinned(src) {
+				continue
+			}
+			var planned []move
+			for _, t := range src.tenants {
+				dst, ok := pickDestination(poolLBs, src, t, capacity, tenants, ports, freed)
+				if !ok {
+					break
+				}
+				planned = append(planned, move{tenant: t.name, from: src.name, to: dst})
+				tenants[dst]++
+				for _, port := range t.ports {
+					ports[dst][port] = struct{}{}
+				}
+			}
+			if len(planned) < len(src.tenants) {
+				// it can't be freed, roll back
+				for i, m := range planned {
+					tenants[m.to]--
+					for _, port := range src.tenants[i].ports {
+						delete(ports[m.to], port)
+					}
+				}
+				continue
+			}
+			freed[src.name] = true
+			for _, m := range planned {
+				received[m.to] = true
+			}
+			moves = append(moves, planned...)
+			budget -= len(planned)
+		}
+	}
+	return moves
+}
+
+// pickDestination returns the most used LB other than src which can take t
+func pickDestination(lbs []*lbState, src *lbState, t tenant, capacity int, tenants map[types.NamespacedName]int,
+	ports map[types.NamespacedName]map[providers.PortKey]struct{}, freed map[types.NamespacedName]bool) (types.NamespacedName, bool) {
+	var dst types.NamespacedName
+	found := false
+OUTERLOOP:
+	for _, lb := range lbs {
+		if lb == src || lb.busy || freed[lb.name] || tenants[lb.name] >= capacity {
+			continue
+		}
+		for _, port := range t.ports {
+			if _, ok := ports[lb.name][port]; ok {
+				continue OUTERLOOP
+			}
+		}
+		if !found || tenants[lb.name] > tenants[dst] {
+			dst, found = lb.name, true
+		}
+	}
+	return dst, found
+}
+
+func hasPinned(lb *lbState) bool {
+	for _, t := range lb.tenants {
+		if t.pinned {
+			return true
+		}
+	}
+	return false
+}
+
+// maintenanceWindow is a daily time range in UTC, e.g. "01:00-05:00"; it may span midnight
+type maintenanceWindow struct {
+	start, end time.Duration
+}
+
+// parseMaintenanceWindow parses s in format of "HH:MM-HH:MM", an empty s means any time
+func parseMaintenanceWindow(s string) (*maintenanceWindow, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var startH, startM, endH, endM int
+	if n, err := fmt.Sscanf(s, "%d:%d-%d:%d", &startH, &startM, &endH, &endM); n != 4 || err != nil ||
+		startH > 23 || endH > 23 || startM > 59 || endM > 59 || startH < 0 || endH < 0 || startM < 0 || endM < 0 {
+		return nil, fmt.Errorf("invalid maintenance window %q, expected format is HH:MM-HH:MM", s)
+	}
+	return &maintenanceWindow{
+		start: time.Duration(startH)*time.Hour + time.Duration(startM)*time.Minute,
+		end:   time.Duration(endH)*time.Hour + time.Duration(endM)*time.Minute,
+	}, nil
+}
+
+// contains tells whether t is in w; a nil w contains any time
+func (w *maintenanceWindow) contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	t = t.UTC()
+	sinceMidnight := t.Sub(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC))
+	if w.start <= w.end {
+		return sinceMidnight >= w.start && sinceMidnight < w.end
+	}
+	return sinceMidnight >= w.start || sinceMidnight < w.end
+}
+
+func (w *maintenanceWindow) String() string {
+	if w == nil {
+		return "any time"
+	}
+	return fmt.Sprintf("%02d:%02d-%02d:%02d UTC", int(w.start.Hours()), int(w.start.Minutes())%60, int(w.end.Hours()), int(w.end.Minutes())%60)
+}
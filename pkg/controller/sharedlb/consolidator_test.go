@@ -0,0 +1,214 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestPlanMoves(t *testing.T) {
+	lb := func(name string) types.NamespacedName {
+		return types.NamespacedName{Name: name, Namespace: "default"}
+	}
+	crWith := func(name string, protocol corev1.Protocol, ports ...int32) tenant {
+		t := tenant{name: types.NamespacedName{Name: name, Namespace: "ns"}}
+		for _, port := range ports {
+			t.ports = append(t.ports, providers.PortKey{Protocol: protocol, Port: port})
+		}
+		return t
+	}
+	cr := func(name string, ports ...int32) tenant {
+		return crWith(name, corev1.ProtocolTCP, ports...)
+	}
+	mv := func(name, from, to string) move {
+		return move{tenant: types.NamespacedName{Name: name, Namespace: "ns"}, from: lb(from), to: lb(to)}
+	}
+	settings := map[string]poolSetting{"": {capacity: 3}, "gold": {capacity: 2}, "big": {capacity: 4}}
+	tests := []struct {
+		name   string
+		lbs    []*lbState
+		budget int
+		want   []move
+	}{
+		{
+			name: "the least used LB is drained onto the most used one",
+			lbs: []*lbState{
+				{name: lb("lb-1"), tenants: []tenant{cr("a", 80)}},
+				{name: lb("lb-2"), tenants: []tenant{cr("b", 81), cr("c", 82)}},
+				{name: lb("lb-3"), tenants: []tenant{cr("d", 83)}},
+			},
+			budget: 10,
+			want:   []move{mv("a", "lb-1", "lb-2")},
+		},
+		{
+			name: "ports are kept unique",
+			lbs: []*lbState{
+				{name: lb("lb-1"), tenants: []tenant{cr("a", 80)}},
+				{name: lb("lb-2"), tenants: []tenant{cr("b", 80), cr("c", 82)}},
+				{name: lb("lb-3"), tenants: []tenant{cr("d", 84), cr("e", 85)}},
+			},
+			budget: 10,
+			want:   []move{mv("a", "lb-1", "lb-3")},
+		},
+		{
+			name: "TCP and UDP ports of the same number don't conflict",
+			lbs: []*lbState{
+				{name: lb("lb-1"), tenants: []tenant{crWith("a", corev1.ProtocolUDP, 53)}},
+				{name: lb("lb-2"), tenants: []tenant{cr("b", 53), cr("c", 82)}},
+			},
+			budget: 10,
+			want:   []move{mv("a", "lb-1", "lb-2")},
+		},
+		{
+			name: "pinned tenants are not moved",
+			lbs: []*lbState{
+				{name: lb("lb-1"), tenants: []tenant{{name: types.NamespacedName{Name: "a", Namespace: "ns"}, pinned: true}}},
+				{name: lb("lb-2"), tenants: []tenant{cr("b", 81)}},
+			},
+			budget: 10,
+			want:   []move{mv("b", "lb-2", "lb-1")},
+		},
+		{
+			name: "a LB is not drained beyond budget",
+			lbs: []*lbState{
+				{name: lb("lb-1"), pool: "big", tenants: []tenant{cr("a", 80), cr("b", 81)}},
+				{name: lb("lb-2"), pool: "big", tenants: []tenant{cr("c", 82), cr("d", 83)}},
+			},
+			budget: 1,
+		},
+		{
+			name: "pools are consolidated separately",
+			lbs: []*lbState{
+				{name: lb("lb-1"), tenants: []tenant{cr("a", 80)}},
+				{name: lb("lb-2"), pool: "gold", tenants: []tenant{cr("b", 81)}},
+				{name: lb("lb-3"), pool: "gold", tenants: []tenant{cr("c", 82)}},
+			},
+			budget: 10,
+			want:   []move{mv("b", "lb-2", "lb-3")},
+		},
+		{
+			name: "busy LBs are left alone",
+			lbs: []*lbState{
+				{name: lb("lb-1"), tenants: []tenant{cr("a", 80)}, busy: true},
+				{name: lb("lb-2"), tenants: []tenant{cr("b", 81)}},
+			},
+			budget: 10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := planMoves(tt.lbs, settings, tt.budget); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planMoves() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLBStates(t *testing.T) {
+	usages := []providers.LBUsage{
+		{Name: types.NamespacedName{Name: "lb-1", Namespace: "default"}, Ready: true},
+		{Name: types.NamespacedName{Name: "lb-2", Namespace: "default"}, Ready: true},
+		{Name: types.NamespacedName{Name: "lb-3", Namespace: "default"}, Ready: false},
+	}
+	newCR := func(name, ref string) kubeconv1alpha1.SharedLB {
+		return kubeconv1alpha1.SharedLB{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ns"},
+			Spec:       kubeconv1alpha1.SharedLBSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+			Status:     kubeconv1alpha1.SharedLBStatus{Ref: ref},
+		}
+	}
+	pinnedCR := newCR("pinned", "default/lb-1")
+	pinnedCR.Annotations = map[string]string{providers.TargetLBAnnotation: "lb-1"}
+	consolidatedCR := newCR("consolidated", "default/lb-1")
+	consolidatedCR.Annotations = map[string]string{providers.TargetLBAnnotation: "default/lb-1", providers.ConsolidatedAnnotation: "default/lb-1"}
+	movingCR := newCR("moving", "default/lb-2")
+	movingCR.Status.Migration = &kubeconv1alpha1.SharedLBMigration{From: "default/lb-1", To: "default/lb-2"}
+
+	lbs := lbStates(usages, []kubeconv1alpha1.SharedLB{
+		pinnedCR, consolidatedCR, movingCR, newCR("pending", ""), newCR("provisioning", "default/lb-3"),
+	})
+	if len(lbs) != 2 {
+		t.Fatalf("lbStates() returns %d LBs, want 2 ready ones", len(lbs))
+	}
+	want := []tenant{
+		{name: types.NamespacedName{Name: "pinned", Namespace: "ns"}, ports: []providers.PortKey{{Protocol: corev1.ProtocolTCP, Port: 80}}, pinned: true},
+		{name: types.NamespacedName{Name: "consolidated", Namespace: "ns"}, ports: []providers.PortKey{{Protocol: corev1.ProtocolTCP, Port: 80}}},
+	}
+	if !reflect.DeepEqual(lbs[0].tenants, want) || !lbs[0].busy {
+		t.Errorf("lb-1 = %+v, want busy with tenants %v", lbs[0], want)
+	}
+	if len(lbs[1].tenants) != 0 || !lbs[1].busy {
+		t.Errorf("lb-2 = %+v, want busy without tenants to move", lbs[1])
+	}
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2018, 12, 1, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		window  string
+		in      []time.Time
+		out     []time.Time
+		wantErr bool
+	}{
+		{window: "", in: []time.Time{at(0, 0), at(12, 30)}},
+		{window: "01:00-05:00", in: []time.Time{at(1, 0), at(4, 59)}, out: []time.Time{at(0, 59), at(5, 0), at(13, 0)}},
+		{window: "22:30-02:00", in: []time.Time{at(23, 0), at(1, 0)}, out: []time.Time{at(2, 0), at(22, 0)}},
+		{window: "1-5", wantErr: true},
+		{window: "25:00-05:00", wantErr: true},
+	}
+	for _, tt := range tests {
+		w, err := parseMaintenanceWindow(tt.window)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMaintenanceWindow(%q) error = %v, wantErr %v", tt.window, err, tt.wantErr)
+			continue
+		}
+		for _, now := range tt.in {
+			if !w.contains(now) {
+				t.Errorf("window %v doesn't contain %v", w, now.Format("15:04"))
+			}
+		}
+		for _, now := range tt.out {
+			if w.contains(now) {
+				t.Errorf("window %v contains %v", w, now.Format("15:04"))
+			}
+		}
+	}
+}
+
+func TestConsolidatorBudget(t *testing.T) {
+	now := time.Now()
+	c := &consolidator{
+		maxMovesPerHour: 3,
+		moves:           []time.Time{now.Add(-2 * time.Hour), now.Add(-30 * time.Minute), now.Add(-time.Minute)},
+	}
+	if got := c.budget(now); got != 1 {
+		t.Errorf("budget() = %d, want 1 as 2 moves are made in the last hour", got)
+	}
+	if got := c.budget(now.Add(time.Hour)); got != 3 {
+		t.Errorf("budget() = %d, want 3 an hour later", got)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/metrics"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	lbsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "loadbalancers"),
+		"Number of LoadBalancers in inventory.",
+		[]string{"provider", "pool", "ready"}, nil)
+	tenantsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "loadbalancer", "tenants"),
+		"Number of SharedLBs placed on a LoadBalancer.",
+		[]string{"provider", "pool", "lb"}, nil)
+	portsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "loadbalancer", "ports_in_use"),
+		"Number of ports occupied on a LoadBalancer.",
+		[]string{"provider", "pool", "lb"}, nil)
+	freeSlotsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "free_slots"),
+		"Number of free slots on LoadBalancers of a pool.",
+		[]string{"provider", "pool"}, nil)
+	savedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "loadbalancers_saved"),
+		"Estimated number of LoadBalancers saved by sharing, i.e. SharedLBs placed minus LoadBalancers in inventory.",
+		[]string{"provider", "pool"}, nil)
+	pendingDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "pending_sharedlbs"),
+		"Number of SharedLBs waiting for a LoadBalancer to be provisioned.",
+		[]string{"provider"}, nil)
+)
+
+// poolStat sums up usage of LBs in a pool
+type poolStat struct {
+	readyLBs    int
+	notReadyLBs int
+	tenants     int
+	freeSlots   int
+}
+
+// poolStats returns usage of LBs keyed with pool name; every pool in settings
+// is reported, even if it doesn't have any LB yet
+func poolStats(usages []providers.LBUsage, settings map[string]poolSetting) map[string]*poolStat {
+	stats := make(map[string]*poolStat, len(settings))
+	for pool := range settings {
+		stats[pool] = &poolStat{}
+	}
+	for _, usage := range usages {
+		stat, ok := stats[usage.Pool]
+		if !ok {
+			stat = &poolStat{}
+			stats[usage.Pool] = stat
+		}
+		if usage.Ready {
+			stat.readyLBs++
+		} else {
+			stat.notReadyLBs++
+		}
+		stat.tenants += usage.Tenants
+	}
+	for pool, stat := range stats {
+		stat.freeSlots = freeSlots(usages, pool, settingOf(settings, pool).capacity)
+	}
+	return stats
+}
+
+// inventoryCollector reports usage of LBs in the provider's inventory upon each scrape,
+// so that it's always consistent with the inventory
+type inventoryCollector struct {
+	r *ReconcileSharedLB
+}
+
+var _ prometheus.Collector = &inventoryCollector{}
+
+// Describe implements prometheus.Collector
+func (c *inventoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{lbsDesc, tenantsDesc, portsDesc, freeSlotsDesc, savedDesc, pendingDesc} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *inventoryCollector) Collect(ch chan<- prometheus.Metric) {
+	provider := c.r.providerName
+	usages := c.r.provider.ListLBs()
+	for _, usage := range usages {
+		lb := usage.Name.String()
+		ch <- prometheus.MustNewConstMetric(tenantsDesc, prometheus.GaugeValue, float64(usage.Tenants), provider, usage.Pool, lb)
+		ch <- prometheus.MustNewConstMetric(portsDesc, prometheus.GaugeValue, float64(usage.Ports), provider, usage.Pool, lb)
+	}
+
+	settings, err := c.r.poolSettings()
+	if err != nil {
+		log.Error(err, "fail to list SharedLBPools, free slots are counted with the default capacity")
+		settings = map[string]poolSetting{"": {capacity: c.r.provider.GetCapacityPerLB()}}
+	}
+	for pool, stat := range poolStats(usages, settings) {
+		ch <- prometheus.MustNewConstMetric(lbsDesc, prometheus.GaugeValue, float64(stat.readyLBs), provider, pool, "true")
+		ch <- prometheus.MustNewConstMetric(lbsDesc, prometheus.GaugeValue, float64(stat.notReadyLBs), provider, pool, "false")
+		ch <- prometheus.MustNewConstMetric(freeSlotsDesc, prometheus.GaugeValue, float64(stat.freeSlots), provider, pool)
+		saved := stat.tenants - stat.readyLBs - stat.notReadyLBs
+		ch <- prometheus.MustNewConstMetric(savedDesc, prometheus.GaugeValue, float64(saved), provider, pool)
+	}
+	ch <- prometheus.MustNewConstMetric(pendingDesc, prometheus.GaugeValue, float64(c.r.tracker.waiting()), provider)
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestPoolStats(t *testing.T) {
+	usages := []providers.LBUsage{
+		{Name: types.NamespacedName{Name: "lb-1", Namespace: "default"}, Tenants: 2, Ports: 3, Ready: true},
+		{Name: types.NamespacedName{Name: "lb-2", Namespace: "default"}, Tenants: 1, Ports: 1, Ready: true},
+		{Name: types.NamespacedName{Name: "lb-3", Namespace: "default"}, Pool: "gold", Ready: false},
+		// pool "silver" is gone, its LBs are counted with the default capacity
+		{Name: types.NamespacedName{Name: "lb-4", Namespace: "default"}, Pool: "silver", Tenants: 1, Ready: true},
+	}
+	settings := map[string]poolSetting{
+		"":       {capacity: 2},
+		"gold":   {capacity: 5},
+		"bronze": {capacity: 3},
+	}
+	want := map[string]*poolStat{
+		"":       {readyLBs: 2, tenants: 3, freeSlots: 1},
+		"gold":   {notReadyLBs: 1, freeSlots: 5},
+		"bronze": {},
+		"silver": {readyLBs: 1, tenants: 1, freeSlots: 1},
+	}
+	if got := poolStats(usages, settings); !reflect.DeepEqual(got, want) {
+		for pool, stat := range got {
+			t.Logf("pool %q: %+v", pool, *stat)
+		}
+		t.Errorf("poolStats() doesn't match %v", want)
+	}
+}
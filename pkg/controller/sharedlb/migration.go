@@ -0,0 +1,164 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// migrating tells whether crObj is being moved to another LB
+func migrating(status *kubeconv1alpha1.SharedLBStatus) bool {
+	return status.Migration != nil && status.Migration.CompletionTime == nil
+}
+
+// pinned tells whether crObj asks for a specific LB, so that it's never moved by the controller
+func pinned(crObj *kubeconv1alpha1.SharedLB) bool {
+	_, ok := providers.PinnedLB(crObj)
+	return ok || crObj.Spec.LoadBalancerIP != ""
+}
+
+// startMigration moves crObj onto the LB named by its TargetLBAnnotation (or exposed on its
+// LoadBalancerIP), if it's not there yet. A slot on the target is reserved and recorded in
+// Status.Ref, while crObj is still exposed on the source LB until it's associated with the
+// target, see completeMigration.
+// It returns false along with the result of Reconcile if crObj can't be moved right now.
+func (r *ReconcileSharedLB) startMigration(crObj *kubeconv1alpha1.SharedLB, orig *kubeconv1alpha1.SharedLBStatus) (bool, reconcile.Result, error) {
+	ref, annotated := crObj.Annotations[providers.TargetLBAnnotation]
+	if (!annotated && crObj.Spec.LoadBalancerIP == "") || migrating(&crObj.Status) {
+		return true, reconcile.Result{}, nil
+	}
+	pool, err := r.getPool(crObj)
+	if err != nil && !errors.IsNotFound(err) {
+		return false, reconcile.Result{}, err
+	}
+	placement, err := providers.NewPlacement(crObj, pool)
+	if err == nil && annotated {
+		placement.LB, err = providers.ParseLBName(ref)
+	}
+	if err != nil {
+		// it's kept on its current LB until the annotation is corrected
+		r.recorder.Event(crObj, corev1.EventTypeWarning, "InvalidMigrationTarget", err.Error())
+		setCondition(&crObj.Status, kubeconv1alpha1.SharedLBMigrating, corev1.ConditionFalse, "InvalidMigrationTarget", err.Error())
+		return true, reconcile.Result{}, nil
+	}
+	// ports are moved as they are, so that clients can switch over to the target
+	placement.Flexible = false
+	target, found := r.provider.LookupLB(placement)
+	if target.String() == crObj.Status.Ref {
+		return true, reconcile.Result{}, nil
+	}
+
+	request := types.NamespacedName{Name: crObj.Name, Namespace: crObj.Namespace}
+	// ports configured on the source LB are the ones of cluster Service
+	clusterSvc := &corev1.Service{}
+	err = r.Get(context.TODO(), types.NamespacedName{Name: crObj.Name + providers.SvcPostfix, Namespace: crObj.Namespace}, clusterSvc)
+	if errors.IsNotFound(err) {
+		clusterSvc = r.provider.NewService(crObj)
+	} else if err != nil {
+		return false, reconcile.Result{}, err
+	}
+	if !found {
+		err = lbNotFound(placement)
+	} else {
+		err = r.provider.MigrateLB(request, target, clusterSvc, placement)
+	}
+	if err != nil {
+		// the target may get a free slot (or be created) later on
+		message := fmt.Sprintf("Failed to move to the LoadBalancer asked for: %v", err)
+		r.recorder.Event(crObj, corev1.EventTypeWarning, "MigrationFailed", message)
+		setCondition(&crObj.Status, kubeconv1alpha1.SharedLBMigrating, corev1.ConditionFalse, "MigrationFailed", message)
+		result, err := r.retry(crObj, orig, "MigrationFailed", message)
+		return false, result, err
+	}
+
+	now := metav1.Now()
+	message := fmt.Sprintf("moving from LoadBalancer %s to %s", crObj.Status.Ref, target)
+	crObj.Status.Migration = &kubeconv1alpha1.SharedLBMigration{
+		From:      crObj.Status.Ref,
+		To:        target.String(),
+		StartTime: &now,
+	}
+	crObj.Status.Ref = target.String()
+	setCondition(&crObj.Status, kubeconv1alpha1.SharedLBMigrating, corev1.ConditionTrue, "Migrating", message)
+	setNotReady(&crObj.Status, kubeconv1alpha1.SharedLBBound, "Migrating", message)
+	if err := r.updateStatus(crObj, orig); err != nil {
+		r.provider.CancelMigration(request)
+		return false, reconcile.Result{}, err
+	}
+	r.recorder.Eventf(crObj, corev1.EventTypeNormal, "Migrating", "Moving from LoadBalancer %s to %s", crObj.Status.Migration.From, target)
+	return true, reconcile.Result{}, nil
+}
+
+// clearConsolidation removes annotations set by consolidator to move crObj onto to, once
+// it's there; a TargetLBAnnotation changed by users since then is kept. It returns whether
+// any annotation is removed.
+func clearConsolidation(crObj *kubeconv1alpha1.SharedLB, to string) bool {
+	if consolidated, ok := crObj.Annotations[providers.ConsolidatedAnnotation]; !ok || consolidated != to {
+		return false
+	}
+	if crObj.Annotations[providers.TargetLBAnnotation] == to {
+		delete(crObj.Annotations, providers.TargetLBAnnotation)
+	}
+	delete(crObj.Annotations, providers.ConsolidatedAnnotation)
+	return true
+}
+
+// completeMigration removes crObj from the LB it's moved from, once it's associated with
+// the target LB. Times of both steps are recorded, so that the window crObj is exposed on
+// both LBs (and the moment endpoints of the source stop working) is visible.
+// It returns false along with the result of Reconcile if the source can't be cleaned up.
+func (r *ReconcileSharedLB) completeMigration(crObj *kubeconv1alpha1.SharedLB, orig *kubeconv1alpha1.SharedLBStatus) (bool, reconcile.Result, error) {
+	m := crObj.Status.Migration
+	if m.SwitchTime == nil {
+		now := metav1.Now()
+		m.SwitchTime = &now
+	}
+	request := types.NamespacedName{Name: crObj.Name, Namespace: crObj.Namespace}
+	if err := r.provider.CompleteMigration(request); err != nil {
+		log.Error(err, "fail to remove SharedLB from the LB it's moved from", "request", request, "lb", m.From)
+		message := fmt.Sprintf("Failed to remove from LoadBalancer %s: %v", m.From, err)
+		r.recorder.Event(crObj, corev1.EventTypeWarning, "MigrationFailed", message)
+		setCondition(&crObj.Status, kubeconv1alpha1.SharedLBMigrating, corev1.ConditionTrue, "RemovingFromSource", message)
+		result, err := r.retry(crObj, orig, "MigrationFailed", message)
+		return false, result, err
+	}
+	if clearConsolidation(crObj, m.To) {
+		// status is not carried by Update, keep the one being built
+		status := crObj.Status.DeepCopy()
+		if err := r.Update(context.TODO(), crObj); err != nil {
+			log.Error(err, "fail to remove consolidation annotations", "request", request)
+			return false, reconcile.Result{}, err
+		}
+		crObj.Status = *status
+	}
+	now := metav1.Now()
+	m.CompletionTime = &now
+	message := fmt.Sprintf("moved from LoadBalancer %s to %s, exposed on both for %v", m.From, m.To, m.CompletionTime.Sub(m.SwitchTime.Time).Round(time.Millisecond))
+	setCondition(&crObj.Status, kubeconv1alpha1.SharedLBMigrating, corev1.ConditionFalse, "Migrated", message)
+	r.recorder.Eventf(crObj, corev1.EventTypeNormal, "Migrated", "Moved from LoadBalancer %s to %s in %v", m.From, m.To, m.CompletionTime.Sub(m.StartTime.Time).Round(time.Millisecond))
+	return true, reconcile.Result{}, nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestClearConsolidation(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[string]string
+		wantCleared bool
+	}{
+		{
+			name: "moved by consolidator",
+			annotations: map[string]string{
+				providers.TargetLBAnnotation:     "default/lb-2",
+				providers.ConsolidatedAnnotation: "default/lb-2",
+				"foo":                            "bar",
+			},
+			want:        map[string]string{"foo": "bar"},
+			wantCleared: true,
+		},
+		{
+			name: "pinned by users since then",
+			annotations: map[string]string{
+				providers.TargetLBAnnotation:     "default/lb-3",
+				providers.ConsolidatedAnnotation: "default/lb-2",
+			},
+			want:        map[string]string{providers.TargetLBAnnotation: "default/lb-3"},
+			wantCleared: true,
+		},
+		{
+			name:        "pinned by users",
+			annotations: map[string]string{providers.TargetLBAnnotation: "default/lb-2"},
+			want:        map[string]string{providers.TargetLBAnnotation: "default/lb-2"},
+		},
+		{
+			name: "consolidated onto another LB",
+			annotations: map[string]string{
+				providers.TargetLBAnnotation:     "default/lb-3",
+				providers.ConsolidatedAnnotation: "default/lb-3",
+			},
+			want: map[string]string{
+				providers.TargetLBAnnotation:     "default/lb-3",
+				providers.ConsolidatedAnnotation: "default/lb-3",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crObj := &kubeconv1alpha1.SharedLB{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+			if cleared := clearConsolidation(crObj, "default/lb-2"); cleared != tt.wantCleared || !reflect.DeepEqual(crObj.Annotations, tt.want) {
+				t.Errorf("clearConsolidation() = %v, %v, want %v, %v", cleared, crObj.Annotations, tt.wantCleared, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigrationKeepsExternalIPs(t *testing.T) {
+	// cr-a on lb-1 is asked to move to lb-2; for IKS it's exposed by externalIPs
+	crA := newWarmUpSharedLB("cr-a", "default/lb-1", 80)
+	crA.Finalizers = []string{providers.FinalizerName}
+	crA.Annotations = map[string]string{providers.TargetLBAnnotation: "default/lb-2"}
+	clusterSvc := newWarmUpClusterService("cr-a", 80)
+	clusterSvc.Spec.ExternalIPs = []string{"1.1.1.1"}
+	c := newFakeClient(newWarmUpLBService("lb-1", "1.1.1.1"), newWarmUpLBService("lb-2", "2.2.2.2"), crA, clusterSvc)
+	provider, err := providers.GetProvider("iks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheme := runtime.NewScheme()
+	if err := kubeconv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	r := &ReconcileSharedLB{
+		Client:   c,
+		scheme:   scheme,
+		recorder: record.NewFakeRecorder(100),
+		provider: provider,
+		tracker:  newProvisionTracker(time.Minute),
+		backoff:  newBackoffPolicy(),
+	}
+
+	crName := types.NamespacedName{Name: "cr-a", Namespace: "ns"}
+	if _, err := r.Reconcile(reconcile.Request{NamespacedName: crName}); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if m := c.crs[crName].Status.Migration; m == nil || m.CompletionTime == nil {
+		t.Fatalf("migration = %+v, want it to be completed", m)
+	}
+	// externalIPs of lb-1 are kept until cr-a is removed from it
+	var externalIPs [][]string
+	for _, obj := range c.updates {
+		if svc, ok := obj.(*corev1.Service); ok {
+			externalIPs = append(externalIPs, svc.Spec.ExternalIPs)
+		}
+	}
+	want := [][]string{{"1.1.1.1", "2.2.2.2"}, {"2.2.2.2"}}
+	if !reflect.DeepEqual(externalIPs, want) {
+		t.Errorf("externalIPs of cluster Service are updated as %v, want %v", externalIPs, want)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"fmt"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// reservePinnedLB reserves a slot on the LB placement is pinned to; unlike GetAvailabelLB,
+// it tells why the LB can't take request, and no LB is provisioned in that case
+func (r *ReconcileSharedLB) reservePinnedLB(request types.NamespacedName, clusterSvc *corev1.Service, placement providers.Placement) (*corev1.Service, error) {
+	lbName, found := r.provider.LookupLB(placement)
+	if !found {
+		return nil, lbNotFound(placement)
+	}
+	return r.provider.ReserveLB(request, lbName, clusterSvc, placement)
+}
+
+// pinnedLBUnavailable reports why crObj can't be placed onto the LB it's pinned to,
+// and retries with backoff, as the LB may get a free slot later on
+func (r *ReconcileSharedLB) pinnedLBUnavailable(crObj *kubeconv1alpha1.SharedLB, orig *kubeconv1alpha1.SharedLBStatus, err error) (reconcile.Result, error) {
+	reason := unavailableReason(err)
+	r.recorder.Eventf(crObj, corev1.EventTypeWarning, reason, "Failed to place onto the pinned LoadBalancer: %v", err)
+	if unfixable(err) {
+		setNotReady(&crObj.Status, kubeconv1alpha1.SharedLBFailed, reason, err.Error())
+		return reconcile.Result{}, r.updateStatus(crObj, orig)
+	}
+	setNotReady(&crObj.Status, kubeconv1alpha1.SharedLBPending, reason, err.Error())
+	return r.retry(crObj, orig, reason, err.Error())
+}
+
+// lbNotFound returns the error telling no LB matches a pinned placement
+func lbNotFound(placement providers.Placement) error {
+	message := fmt.Sprintf("no LoadBalancer is exposed on %s", placement.IP)
+	if placement.LB.Name != "" {
+		message = "not in inventory"
+	}
+	return &providers.LBUnavailableError{LB: placement.LB, Reason: "LBNotFound", Message: message}
+}
+
+// unavailableReason returns a one-word CamelCase reason of err returned by ReserveLB,
+// GetAvailabelLB or ReservePorts
+func unavailableReason(err error) string {
+	switch e := err.(type) {
+	case *providers.PortConflictError:
+		return "PortConflict"
+	case *providers.LBUnavailableError:
+		return e.Reason
+	case *providers.PortRangeExhaustedError:
+		return "PortRangeExhausted"
+	case *providers.UnsupportedProtocolError:
+		return "UnsupportedProtocol"
+	}
+	return "PinnedLBUnavailable"
+}
+
+// unfixable tells whether err can't be fixed without changing spec, i.e. a port range too
+// small for the SharedLB even on an empty LB, or a protocol the provider can't carry
+func unfixable(err error) bool {
+	switch e := err.(type) {
+	case *providers.PortRangeExhaustedError:
+		return e.LB.Name == ""
+	case *providers.UnsupportedProtocolError:
+		return true
+	}
+	return false
+}
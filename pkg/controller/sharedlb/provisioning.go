@@ -0,0 +1,219 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"sync"
+	"time"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// releasedBufferSize is the number of released SharedLBs buffered before they're consumed by the controller
+const releasedBufferSize = 1024
+
+// provisionTracker tracks LBs being provisioned, along with SharedLBs waiting on them.
+// Each pending LB promises its slots, along with the ports requested, to SharedLBs of the
+// same pool which don't fit into any existing LB, so that a burst of SharedLBs is spread
+// over as many LBs as needed, instead of being funnelled through one LB at a time.
+type provisionTracker struct {
+	sync.Mutex
+	// timeout is how long a LB is waited for; after that it's not tracked any more,
+	// so that SharedLBs waiting on it can be placed elsewhere
+	timeout time.Duration
+	// lbs is keyed with ns/name of a pending LB
+	lbs map[types.NamespacedName]*pendingLB
+	// crToLB is keyed with ns/name of a waiting SharedLB, and valued with the LB it waits on
+	crToLB map[types.NamespacedName]types.NamespacedName
+	// released emits SharedLBs which stop waiting on a pending LB, so that they're reconciled again
+	released chan event.GenericEvent
+}
+
+type pendingLB struct {
+	pool     string
+	capacity int
+	since    time.Time
+	// waiting holds SharedLBs which have been promised a slot, valued with ports promised
+	waiting map[types.NamespacedName][]providers.PortKey
+}
+
+// clashes tells whether any of ports is promised to another SharedLB; ports left
+// as 0 are assigned once the LB is ready, so they never clash
+func (lb *pendingLB) clashes(ports []providers.PortKey) bool {
+	for _, promised := range lb.waiting {
+		for _, p := range promised {
+			for _, q := range ports {
+				if q.Port != 0 && p == q {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func newProvisionTracker(timeout time.Duration) *provisionTracker {
+	return &provisionTracker{
+		timeout:  timeout,
+		lbs:      make(map[types.NamespacedName]*pendingLB),
+		crToLB:   make(map[types.NamespacedName]types.NamespacedName),
+		released: make(chan event.GenericEvent, releasedBufferSize),
+	}
+}
+
+// promise finds a pending LB in pool which still has a slot to promise and none of ports
+// promised to others, and makes crName wait on it. If there isn't one, newLB is tracked as
+// a pending LB with crName waiting on it, and true is returned, meaning the caller is
+// expected to provision newLB. ports can be nil if they may be replaced on conflicts.
+func (pt *provisionTracker) promise(crName types.NamespacedName, pool string, capacity int, ports []providers.PortKey, newLB types.NamespacedName) (types.NamespacedName, bool) {
+	pt.Lock()
+	defer pt.Unlock()
+	pt.expire()
+	if lbName, ok := pt.crToLB[crName]; ok {
+		return lbName, false
+	}
+	for lbName, lb := range pt.lbs {
+		if lb.pool == pool && len(lb.waiting) < lb.capacity && !lb.clashes(ports) {
+			lb.waiting[crName] = ports
+			pt.crToLB[crName] = lbName
+			return lbName, false
+		}
+	}
+	pt.lbs[newLB] = &pendingLB{
+		pool:     pool,
+		capacity: capacity,
+		since:    time.Now(),
+		waiting:  map[types.NamespacedName][]providers.PortKey{crName: ports},
+	}
+	pt.crToLB[crName] = newLB
+	return newLB, true
+}
+
+// track starts tracking lbName with no SharedLB waiting on it,
+// e.g. it's provisioned ahead of demand
+func (pt *provisionTracker) track(lbName types.NamespacedName, pool string, capacity int) {
+	pt.Lock()
+	defer pt.Unlock()
+	pt.lbs[lbName] = &pendingLB{
+		pool:     pool,
+		capacity: capacity,
+		since:    time.Now(),
+		waiting:  make(map[types.NamespacedName][]providers.PortKey),
+	}
+}
+
+// done stops tracking lbName, i.e. it's ready or failed to be provisioned;
+// SharedLBs waiting on it are released, and emitted to be reconciled again
+func (pt *provisionTracker) done(lbName types.NamespacedName) {
+	pt.Lock()
+	defer pt.Unlock()
+	pt.remove(lbName)
+}
+
+// release stops crName waiting on a pending LB, e.g. it's deleted,
+// so that the slot promised to it can be promised to others
+func (pt *provisionTracker) release(crName types.NamespacedName) {
+	pt.Lock()
+	defer pt.Unlock()
+	lbName, ok := pt.crToLB[crName]
+	if !ok {
+		return
+	}
+	if lb, ok := pt.lbs[lbName]; ok {
+		delete(lb.waiting, crName)
+	}
+	delete(pt.crToLB, crName)
+}
+
+// isWaiting tells whether crName is waiting on a pending LB
+func (pt *provisionTracker) isWaiting(crName types.NamespacedName) bool {
+	pt.Lock()
+	defer pt.Unlock()
+	pt.expire()
+	_, ok := pt.crToLB[crName]
+	return ok
+}
+
+// isPending tells whether lbName is being provisioned
+func (pt *provisionTracker) isPending(lbName types.NamespacedName) bool {
+	pt.Lock()
+	defer pt.Unlock()
+	_, ok := pt.lbs[lbName]
+	return ok
+}
+
+// waiting returns the number of SharedLBs waiting on pending LBs
+func (pt *provisionTracker) waiting() int {
+	pt.Lock()
+	defer pt.Unlock()
+	pt.expire()
+	return len(pt.crToLB)
+}
+
+// promised returns the number of slots promised on pending LBs of pool
+func (pt *provisionTracker) promised(pool string) int {
+	pt.Lock()
+	defer pt.Unlock()
+	n := 0
+	for _, lb := range pt.lbs {
+		if lb.pool == pool {
+			n += len(lb.waiting)
+		}
+	}
+	return n
+}
+
+// expire stops tracking LBs pending longer than timeout; it must be called with lock held
+func (pt *provisionTracker) expire() {
+	if pt.timeout <= 0 {
+		return
+	}
+	for lbName, lb := range pt.lbs {
+		if time.Since(lb.since) > pt.timeout {
+			log.Info("LB is not ready in time, stop waiting for it", "name", lbName, "timeout", pt.timeout)
+			pt.remove(lbName)
+		}
+	}
+}
+
+// remove must be called with lock held
+func (pt *provisionTracker) remove(lbName types.NamespacedName) {
+	lb, ok := pt.lbs[lbName]
+	if !ok {
+		return
+	}
+	for crName := range lb.waiting {
+		delete(pt.crToLB, crName)
+		pt.emit(crName)
+	}
+	delete(pt.lbs, lbName)
+}
+
+// emit sends crName to released without blocking, as it's called with lock held;
+// if the buffer is full, crName is left to its own requeue
+func (pt *provisionTracker) emit(crName types.NamespacedName) {
+	obj := &kubeconv1alpha1.SharedLB{ObjectMeta: metav1.ObjectMeta{Name: crName.Name, Namespace: crName.Namespace}}
+	select {
+	case pt.released <- event.GenericEvent{Meta: obj, Object: obj}:
+	default:
+		log.Info("Too many SharedLBs are released at once, leave it to its own requeue", "request", crName)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestProvisionTrackerBurst(t *testing.T) {
+	pt := newProvisionTracker(time.Minute)
+	var provisioned []types.NamespacedName
+	for i := 0; i < 50; i++ {
+		cr := types.NamespacedName{Name: fmt.Sprintf("cr%d", i), Namespace: "default"}
+		newLB := types.NamespacedName{Name: fmt.Sprintf("lb-%d", i), Namespace: "default"}
+		if lbName, isNew := pt.promise(cr, "", 2, nil, newLB); isNew {
+			provisioned = append(provisioned, lbName)
+		}
+	}
+	// 50 SharedLBs are spread over 25 LBs provisioned at the same time
+	if len(provisioned) != 25 {
+		t.Fatalf("%d LBs are provisioned, want 25", len(provisioned))
+	}
+	if got := pt.promised(""); got != 50 {
+		t.Errorf("promised() = %d, want 50", got)
+	}
+
+	// a SharedLB keeps waiting on the same LB
+	cr0 := types.NamespacedName{Name: "cr0", Namespace: "default"}
+	if lbName, isNew := pt.promise(cr0, "", 2, nil, types.NamespacedName{Name: "lb-x", Namespace: "default"}); isNew || lbName != provisioned[0] {
+		t.Errorf("promise() = %v, %v, want %v, false", lbName, isNew, provisioned[0])
+	}
+
+	// SharedLBs are released once the LB is ready
+	pt.done(provisioned[0])
+	if pt.isWaiting(cr0) || pt.isPending(provisioned[0]) {
+		t.Errorf("%v is expected to be released along with %v", cr0, provisioned[0])
+	}
+	if got := pt.promised(""); got != 48 {
+		t.Errorf("promised() = %d, want 48", got)
+	}
+	// and emitted to be reconciled again
+	released := map[string]bool{}
+	for len(pt.released) > 0 {
+		released[(<-pt.released).Meta.GetName()] = true
+	}
+	if !released["cr0"] || !released["cr1"] || len(released) != 2 {
+		t.Errorf("released SharedLBs = %v, want cr0 and cr1", released)
+	}
+}
+
+func TestProvisionTrackerPool(t *testing.T) {
+	pt := newProvisionTracker(time.Minute)
+	warmLB := types.NamespacedName{Name: "lb-warm", Namespace: "default"}
+	pt.track(warmLB, "gold", 1)
+
+	cr1 := types.NamespacedName{Name: "cr1", Namespace: "default"}
+	cr2 := types.NamespacedName{Name: "cr2", Namespace: "default"}
+	newLB := types.NamespacedName{Name: "lb-new", Namespace: "default"}
+	// a SharedLB of another pool doesn't wait on the warm LB
+	if lbName, isNew := pt.promise(cr1, "", 1, nil, newLB); !isNew || lbName != newLB {
+		t.Errorf("promise() = %v, %v, want %v, true", lbName, isNew, newLB)
+	}
+	if lbName, isNew := pt.promise(cr2, "gold", 1, nil, newLB); isNew || lbName != warmLB {
+		t.Errorf("promise() = %v, %v, want %v, false", lbName, isNew, warmLB)
+	}
+}
+
+func TestProvisionTrackerPorts(t *testing.T) {
+	pt := newProvisionTracker(time.Minute)
+	tcp80 := providers.PortKey{Protocol: corev1.ProtocolTCP, Port: 80}
+	udp80 := providers.PortKey{Protocol: corev1.ProtocolUDP, Port: 80}
+	unassigned := providers.PortKey{Protocol: corev1.ProtocolTCP}
+	lb1 := types.NamespacedName{Name: "lb-1", Namespace: "default"}
+	lb2 := types.NamespacedName{Name: "lb-2", Namespace: "default"}
+	pt.promise(types.NamespacedName{Name: "cr1", Namespace: "default"}, "", 4, []providers.PortKey{tcp80, unassigned}, lb1)
+
+	tests := []struct {
+		name   string
+		ports  []providers.PortKey
+		wantLB types.NamespacedName
+	}{
+		{name: "same port of another protocol", ports: []providers.PortKey{udp80}, wantLB: lb1},
+		{name: "ports to be assigned", ports: []providers.PortKey{unassigned}, wantLB: lb1},
+		{name: "port promised to another", ports: []providers.PortKey{tcp80}, wantLB: lb2},
+		{name: "ports may be replaced", ports: nil, wantLB: lb1},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := types.NamespacedName{Name: fmt.Sprintf("cr-%d", i), Namespace: "default"}
+			if lbName, _ := pt.promise(cr, "", 4, tt.ports, lb2); lbName != tt.wantLB {
+				t.Errorf("promise() = %v, want %v", lbName, tt.wantLB)
+			}
+			// leave lb-2 untracked for the next one
+			pt.done(lb2)
+		})
+	}
+}
+
+func TestProvisionTrackerTimeout(t *testing.T) {
+	pt := newProvisionTracker(time.Minute)
+	cr := types.NamespacedName{Name: "cr", Namespace: "default"}
+	lbName := types.NamespacedName{Name: "lb-1", Namespace: "default"}
+	pt.promise(cr, "", 2, nil, lbName)
+	pt.lbs[lbName].since = time.Now().Add(-time.Hour)
+	if pt.isWaiting(cr) || pt.isPending(lbName) {
+		t.Errorf("%v is expected to be released as %v is not ready in time", cr, lbName)
+	}
+	if len(pt.released) != 1 {
+		t.Errorf("%d SharedLBs are emitted, want 1", len(pt.released))
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// reclaimer deletes LB Services which have held no tenant for gracePeriod, except
+// minSpares of them in each pool, which are kept warm for upcoming SharedLBs.
+// LBs needed to keep free slots above the watermark of a pool are kept as well,
+// otherwise warmer would provision them again.
+type reclaimer struct {
+	r           *ReconcileSharedLB
+	interval    time.Duration
+	gracePeriod time.Duration
+	minSpares   int
+
+	// emptySince is keyed with ns/name of a LB, and valued with the time it's found empty
+	emptySince map[types.NamespacedName]time.Time
+}
+
+var _ manager.Runnable = &reclaimer{}
+
+func newReclaimer(r *ReconcileSharedLB) *reclaimer {
+	return &reclaimer{
+		r:           r,
+		interval:    providers.GetEnvValDuration("LB_RECLAIM_INTERVAL", time.Minute),
+		gracePeriod: providers.GetEnvValDuration("LB_RECLAIM_GRACE_PERIOD", 10*time.Minute),
+		minSpares:   providers.GetEnvValInt("LB_MIN_SPARES", 0),
+		emptySince:  make(map[types.NamespacedName]time.Time),
+	}
+}
+
+// Start reclaims empty LBs periodically until stop is closed.
+// Setting LB_RECLAIM_GRACE_PERIOD to 0 disables it.
+func (rc *reclaimer) Start(stop <-chan struct{}) error {
+	if rc.gracePeriod <= 0 {
+		log.Info("LB reclaimer is disabled")
+		<-stop
+		return nil
+	}
+	wait.Until(func() {
+		if err := rc.reclaim(time.Now()); err != nil {
+			log.Error(err, "fail to reclaim empty LBs")
+		}
+	}, rc.interval, stop)
+	return nil
+}
+
+func (rc *reclaimer) reclaim(now time.Time) error {
+	// before provider cache is rebuilt, every LB looks empty
+	if err := rc.r.warmUp(); err != nil {
+		return err
+	}
+	settings, err := rc.r.poolSettings()
+	if err != nil {
+		return err
+	}
+	for _, lbName := range rc.expiredLBs(rc.r.provider.ListLBs(), settings, now) {
+		if rc.r.tracker.isPending(lbName) {
+			continue
+		}
+		// it's taken out of inventory atomically, so it fails if a placement
+		// onto it is in progress; and no placement can be made after that
+		if !rc.r.provider.ReclaimLB(lbName) {
+			continue
+		}
+		lbSvc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: lbName.Name, Namespace: lbName.Namespace}}
+		if err := rc.r.Delete(context.TODO(), lbSvc); err != nil && !errors.IsNotFound(err) {
+			log.Error(err, "fail to delete empty LB", "name", lbName)
+			// put it back to inventory, and retry in next round
+			if err := rc.r.Get(context.TODO(), lbName, lbSvc); err == nil {
+				rc.r.provider.UpdateCache(lbName, lbSvc)
+			}
+			continue
+		}
+		delete(rc.emptySince, lbName)
+		log.Info("Empty LB is reclaimed", "name", lbName)
+		rc.r.recorder.Eventf(lbSvc, corev1.EventTypeNormal, "Reclaimed", "Deleted after being empty for %v", rc.gracePeriod)
+	}
+	return nil
+}
+
+// expiredLBs refreshes emptySince with usages, and returns LBs which have been empty
+// for gracePeriod, leaving at least minSpares empty LBs and enough free slots in each pool
+func (rc *reclaimer) expiredLBs(usages []providers.LBUsage, settings map[string]poolSetting, now time.Time) []types.NamespacedName {
+	// key is pool name, val is empty LBs in the pool
+	empties := make(map[string][]types.NamespacedName)
+	seen := make(map[types.NamespacedName]struct{})
+	for _, usage := range usages {
+		// a LB without ingress info is being provisioned, leave it alone
+		if usage.Tenants > 0 || !usage.Ready {
+			continue
+		}
+		if _, ok := rc.emptySince[usage.Name]; !ok {
+			rc.emptySince[usage.Name] = now
+		}
+		empties[usage.Pool] = append(empties[usage.Pool], usage.Name)
+		seen[usage.Name] = struct{}{}
+	}
+	// forget LBs which are not empty, or gone
+	for lbName := range rc.emptySince {
+		if _, ok := seen[lbName]; !ok {
+			delete(rc.emptySince, lbName)
+		}
+	}
+
+	var expired []types.NamespacedName
+	for pool, lbNames := range empties {
+		setting := settingOf(settings, pool)
+		free := freeSlots(usages, pool, setting.capacity)
+		// the ones empty for the longest time go first
+		sort.Slice(lbNames, func(i, j int) bool {
+			ti, tj := rc.emptySince[lbNames[i]], rc.emptySince[lbNames[j]]
+			if ti.Equal(tj) {
+				return lbNames[i].String() < lbNames[j].String()
+			}
+			return ti.Before(tj)
+		})
+		for i := 0; i < len(lbNames)-rc.minSpares; i++ {
+			if now.Sub(rc.emptySince[lbNames[i]]) >= rc.gracePeriod && free-setting.capacity >= setting.minFreeSlots {
+				expired = append(expired, lbNames[i])
+				free -= setting.capacity
+			}
+		}
+	}
+	return expired
+}
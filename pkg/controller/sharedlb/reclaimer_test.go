@@ -0,0 +1,102 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestExpiredLBs(t *testing.T) {
+	lb := func(name string) types.NamespacedName {
+		return types.NamespacedName{Name: name, Namespace: "default"}
+	}
+	now := time.Now()
+	usages := []providers.LBUsage{
+		{Name: lb("lb-busy"), Tenants: 1, Ready: true},
+		{Name: lb("lb-pending"), Ready: false},
+		{Name: lb("lb-old"), Ready: true},
+		{Name: lb("lb-new"), Ready: true},
+		{Name: lb("lb-gold"), Pool: "gold", Ready: true},
+	}
+	tests := []struct {
+		name      string
+		minSpares int
+		// minFreeSlots is the watermark of the default pool
+		minFreeSlots int
+		// emptySince is how long ago each LB was found empty
+		emptySince map[string]time.Duration
+		want       []types.NamespacedName
+	}{
+		{
+			name: "LBs just found empty are kept",
+		},
+		{
+			name:       "LBs empty for grace period are reclaimed",
+			emptySince: map[string]time.Duration{"lb-old": time.Hour, "lb-new": time.Minute, "lb-gold": time.Hour},
+			want:       []types.NamespacedName{lb("lb-gold"), lb("lb-old")},
+		},
+		{
+			name:       "spares are kept in each pool",
+			minSpares:  1,
+			emptySince: map[string]time.Duration{"lb-old": time.Hour, "lb-new": time.Hour, "lb-gold": time.Hour},
+			want:       []types.NamespacedName{lb("lb-new")},
+		},
+		{
+			name:         "LBs needed by watermark of free slots are kept",
+			minFreeSlots: 5,
+			emptySince:   map[string]time.Duration{"lb-old": time.Hour, "lb-new": time.Hour},
+			want:         []types.NamespacedName{lb("lb-new")},
+		},
+		{
+			name:       "a LB which is not empty any more is forgotten",
+			emptySince: map[string]time.Duration{"lb-busy": time.Hour},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := &reclaimer{
+				gracePeriod: 10 * time.Minute,
+				minSpares:   tt.minSpares,
+				emptySince:  make(map[types.NamespacedName]time.Time),
+			}
+			for name, d := range tt.emptySince {
+				rc.emptySince[lb(name)] = now.Add(-d)
+			}
+			settings := map[string]poolSetting{"": {capacity: 2, minFreeSlots: tt.minFreeSlots}}
+			got := rc.expiredLBs(usages, settings, now)
+			sortNames(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expiredLBs() = %v, want %v", got, tt.want)
+			}
+			if _, ok := rc.emptySince[lb("lb-busy")]; ok {
+				t.Errorf("lb-busy is expected to be forgotten")
+			}
+		})
+	}
+}
+
+func sortNames(names []types.NamespacedName) {
+	sort.Slice(names, func(i, j int) bool {
+		return names[i].String() < names[j].String()
+	})
+}
@@ -18,19 +18,24 @@ package sharedlb
 
 import (
 	"context"
+	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/metrics"
 	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
@@ -47,26 +52,58 @@ func init() {
 // Add creates a new SharedLB Controller and adds it to the Manager with default RBAC. The Manager will set fields on the Controller
 // and Start it when the Manager is Started.
 func Add(mgr manager.Manager) error {
-	return add(mgr, newReconciler(mgr))
+	r, err := newReconciler(mgr)
+	if err != nil {
+		return err
+	}
+	if err := add(mgr, r, r.tracker.released); err != nil {
+		return err
+	}
+	if err := metrics.Registry.Register(&inventoryCollector{r: r}); err != nil {
+		return err
+	}
+	if err := mgr.Add(newWarmer(r)); err != nil {
+		return err
+	}
+	if err := mgr.Add(newReclaimer(r)); err != nil {
+		return err
+	}
+	consolidator, err := newConsolidator(r)
+	if err != nil {
+		return err
+	}
+	return mgr.Add(consolidator)
 }
 
 // newReconciler returns a new reconcile.Reconciler
-func newReconciler(mgr manager.Manager) reconcile.Reconciler {
-	return &ReconcileSharedLB{
-		Client:   mgr.GetClient(),
-		scheme:   mgr.GetScheme(),
-		provider: providers.NewProvider(),
-		pendingQ: &pendingQ{
-			pendingLB:  nil,
-			pendingCRs: make(map[types.NamespacedName]struct{}),
-		},
+func newReconciler(mgr manager.Manager) (*ReconcileSharedLB, error) {
+	provider, err := providers.NewProvider()
+	if err != nil {
+		return nil, err
 	}
+	recorder := mgr.GetRecorder("sharedlb-controller")
+	if injector, ok := provider.(providers.RecorderInjector); ok {
+		injector.InjectRecorder(recorder)
+	}
+	return &ReconcileSharedLB{
+		Client:       mgr.GetClient(),
+		scheme:       mgr.GetScheme(),
+		recorder:     recorder,
+		provider:     provider,
+		providerName: providers.ProviderName(),
+		backoff:      newBackoffPolicy(),
+		tracker:      newProvisionTracker(providers.GetEnvValDuration("LB_PROVISION_TIMEOUT", 10*time.Minute)),
+	}, nil
 }
 
-// add adds a new Controller to mgr with r as the reconcile.Reconciler
-func add(mgr manager.Manager, r reconcile.Reconciler) error {
+// add adds a new Controller to mgr with r as the reconcile.Reconciler, and released
+// emitting SharedLBs which stop waiting on a pending LB
+func add(mgr manager.Manager, r reconcile.Reconciler, released <-chan event.GenericEvent) error {
 	// Create a new controller
-	c, err := controller.New("sharedlb-controller", mgr, controller.Options{Reconciler: r})
+	c, err := controller.New("sharedlb-controller", mgr, controller.Options{
+		Reconciler:              r,
+		MaxConcurrentReconciles: providers.GetEnvValInt("MAX_CONCURRENT_RECONCILES", 1),
+	})
 	if err != nil {
 		return err
 	}
@@ -104,6 +141,15 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
+	// Watch SharedLBs released from a pending LB, as nothing changes on them
+	err = c.Watch(
+		&source.Channel{Source: released},
+		&handler.EnqueueRequestForObject{},
+	)
+	if err != nil {
+		return err
+	}
+
 	// Watch a Service created by SharedLB
 	err = c.Watch(
 		&source.Kind{Type: &corev1.Service{}},
@@ -125,13 +171,16 @@ var _ reconcile.Reconciler = &ReconcileSharedLB{}
 type ReconcileSharedLB struct {
 	client.Client
 	scheme   *runtime.Scheme
+	recorder record.EventRecorder
 	provider providers.LBProvider
-	pendingQ *pendingQ
-}
-
-type pendingQ struct {
-	pendingLB  *types.NamespacedName
-	pendingCRs map[types.NamespacedName]struct{}
+	// providerName labels metrics of provider
+	providerName string
+	tracker      *provisionTracker
+	backoff      *backoffPolicy
+
+	// warmedUp tells whether provider cache has been rebuilt from cluster
+	warmedUp   bool
+	warmUpLock sync.Mutex
 }
 
 // Reconcile reads that state of the cluster for a SharedLB object and makes changes based on the state read
@@ -139,35 +188,39 @@ type pendingQ struct {
 // The scaffolding writes a Service as an example
 // Automatically generate RBAC rules to allow the Controller to read and write Services
 // +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 // +kubebuilder:rbac:groups=kubecon.k8s.io,resources=sharedlbs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=kubecon.k8s.io,resources=sharedlbs/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=kubecon.k8s.io,resources=sharedlbpools,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
 func (r *ReconcileSharedLB) Reconcile(request reconcile.Request) (reconcile.Result, error) {
+	// 0) make sure provider cache is rebuilt before handing out any placement
+	if err := r.warmUp(); err != nil {
+		log.Error(err, "fail to rebuild provider cache from cluster")
+		return reconcile.Result{}, err
+	}
+
 	// 1) fetch and deal with the LoadBalancer Service object
 	lbSvc := &corev1.Service{}
 	err := r.Get(context.TODO(), request.NamespacedName, lbSvc)
 	if err == nil {
 		log.Info("LB is created/updated. Updating LB cache.", "name", request.Name)
 		r.provider.UpdateCache(request.NamespacedName, lbSvc)
-		if r.pendingQ.hasLB(request.NamespacedName) && len(lbSvc.Status.LoadBalancer.Ingress) > 0 {
-			log.Info("LB has completed setup. Removing lb entry in pendingQ.")
-			r.pendingQ.remove(request.NamespacedName)
+		if r.tracker.isPending(request.NamespacedName) && len(lbSvc.Status.LoadBalancer.Ingress) > 0 {
+			log.Info("LB has completed setup. Releasing SharedLBs waiting on it.")
+			metrics.ProvisioningDuration.WithLabelValues(r.providerName, lbSvc.Labels[providers.PoolLabel]).
+				Observe(time.Since(lbSvc.CreationTimestamp.Time).Seconds())
+			r.tracker.done(request.NamespacedName)
 		}
 		return reconcile.Result{}, nil
 	} else if errors.IsNotFound(err) && strings.Index(request.Name, "lb-") == 0 {
 		// TODO(Huang-Wei): improve logic here to check if it's a LB svc deletion
 		log.Info("LB is deleted. Updating lb cache.", "name", request.Name)
 		r.provider.UpdateCache(request.NamespacedName, nil)
+		r.tracker.done(request.NamespacedName)
 		return reconcile.Result{}, nil
 	}
 
-	// in some cases, esp. when CR obj is created but LoadBalancer service is pending
-	// we rely on an internal struct "pendingQ" to tell whether incoming CR obj should
-	// a) be put back to queue or b) be processed instantly
-	if r.pendingQ.hasCR(request.NamespacedName) {
-		log.Info("It's likely a dependent IaaS LoadBalancer is pending. Requeue to wait for its completion and retry.", "request", request.NamespacedName)
-		// TODO(Huang-Wei): implement exponential backoff
-		return reconcile.Result{Requeue: true, RequeueAfter: time.Second * 2}, nil
-	}
-
 	// 2) fetch and deal with the SharedLB CR object
 	crObj := &kubeconv1alpha1.SharedLB{}
 	err = r.Get(context.TODO(), request.NamespacedName, crObj)
@@ -176,6 +229,7 @@ func (r *ReconcileSharedLB) Reconcile(request reconcile.Request) (reconcile.Resu
 			// if cr obj is not found, means it's been deleted. we can simply return b/c:
 			// (1) dependent objects will be automatically garbage collected, and
 			// (2) additional cleanup logic are handled by finalizers.
+			r.backoff.reset(request.NamespacedName)
 			return reconcile.Result{}, nil
 		}
 		// Error reading the object - requeue the request.
@@ -195,17 +249,31 @@ func (r *ReconcileSharedLB) Reconcile(request reconcile.Request) (reconcile.Resu
 		}
 	} else {
 		if containsString(crObj.ObjectMeta.Finalizers, providers.FinalizerName) {
-			// clusterSvc := r.provider.NewService(crObj)
 			clusterSvc := &corev1.Service{}
 			clusterSvcNsName := types.NamespacedName{Name: crObj.Name + providers.SvcPostfix, Namespace: crObj.Namespace}
-			if err = r.Get(context.TODO(), clusterSvcNsName, clusterSvc); err != nil {
+			if err = r.Get(context.TODO(), clusterSvcNsName, clusterSvc); errors.IsNotFound(err) {
+				// it may never be created, e.g. the CR obj can't be placed or is waiting
+				// for a LB, while a slot may be reserved for it all the same
+				clusterSvc = r.provider.NewService(crObj)
+			} else if err != nil {
 				log.Error(err, "fail to get clusterSvc when trying DeassociateLB")
 				return reconcile.Result{}, err
 			}
+			// the slot promised on a pending LB is not needed any more
+			r.tracker.release(request.NamespacedName)
+			// it may be halfway moved to another LB
+			if err := r.provider.CompleteMigration(request.NamespacedName); err != nil {
+				log.Error(err, "fail to remove SharedLB from the LB it's moved from")
+				return reconcile.Result{}, err
+			}
 			if err := r.provider.DeassociateLB(request.NamespacedName, clusterSvc); err != nil {
 				// fail to delete external dependencies here, return with error
 				// so that it can be retried
 				log.Error(err, "fail to delete external dependencies when trying DeassociateLB")
+				r.recorder.Eventf(crObj, corev1.EventTypeWarning, "DeassociateLBFailed", "Failed to deassociate from LoadBalancer %s: %v", crObj.Status.Ref, err)
+				orig := crObj.Status.DeepCopy()
+				setNotReady(&crObj.Status, kubeconv1alpha1.SharedLBTerminating, "DeassociateLBFailed", err.Error())
+				r.updateStatus(crObj, orig)
 				return reconcile.Result{}, err
 			}
 			// remove our finalizer from the list and update it.
@@ -217,112 +285,290 @@ func (r *ReconcileSharedLB) Reconcile(request reconcile.Request) (reconcile.Resu
 		}
 	}
 
-	// 3) deal with the Cluster Service object
-	// Define the desired cluster Service object
-	clusterSvc := r.provider.NewService(crObj)
-	if err := controllerutil.SetControllerReference(crObj, clusterSvc, r.scheme); err != nil {
-		return reconcile.Result{}, err
+	origStatus := crObj.Status.DeepCopy()
+	if crObj.Status.Phase == "" {
+		crObj.Status.Phase = kubeconv1alpha1.SharedLBPending
 	}
 
-	// Check if the cluster Service already exists
-	found := &corev1.Service{}
-	err = r.Get(context.TODO(), types.NamespacedName{Name: clusterSvc.Name, Namespace: clusterSvc.Namespace}, found)
-
-	if err == nil && crObj.Status.Ref != "" {
-		strs := strings.Split(crObj.Status.Ref, "/")
-		if err := r.provider.AssociateLB(request.NamespacedName, types.NamespacedName{Namespace: strs[0], Name: strs[1]}, clusterSvc); err != nil {
-			// this err means corresponding IaaS Obj not exist yet
-			// so we requeue with a bit backoff
-			// this is possible in 2 cases:
-			// i)  program start phase: CR obj Add event comes before LB obj Add event
-			// ii) LB/IaaS obj created too slow
-			log.Info(err.Error())
-			return reconcile.Result{Requeue: true, RequeueAfter: time.Millisecond * 100}, nil
+	// 3) place the CR obj onto a LoadBalancer, if it's not placed yet
+	if crObj.Status.Ref == "" {
+		placed, result, err := r.place(crObj, origStatus)
+		if !placed {
+			return result, err
 		}
+		// status carrying Ref has been written
+		origStatus = crObj.Status.DeepCopy()
 	}
 
-	if err != nil && errors.IsNotFound(err) {
-		// fetch an available LoadBalancer Service that can be reused
-		availableLB := r.provider.GetAvailabelLB(clusterSvc)
-		if availableLB == nil {
-			if !r.pendingQ.isEmpty() {
-				r.pendingQ.add(request.NamespacedName, types.NamespacedName{})
-				return reconcile.Result{Requeue: true, RequeueAfter: time.Second * 2}, nil
-			}
-			log.Info("Creating a real LoadBalancer Service")
-			availableLB = r.provider.NewLBService()
-			err = r.Create(context.TODO(), availableLB)
-			if err != nil {
-				log.Error(err, "Creating LoadBalancer Service Failed", "name", availableLB.Name)
-				// backoff a bit
-				return reconcile.Result{RequeueAfter: time.Second * 1}, err
-			}
-			log.Info("A real LB is created", "name", availableLB.Name, "lbinfo", availableLB.Status.LoadBalancer)
-			// NOTE: here we directly return to start a new reconcile
-			r.pendingQ.add(request.NamespacedName, types.NamespacedName{Name: availableLB.Name, Namespace: availableLB.Namespace})
-			return reconcile.Result{Requeue: true, RequeueAfter: time.Millisecond * 500}, nil
-		}
+	// 4) move the CR obj onto the LoadBalancer it asks for, if it's not there yet
+	wasMigrating := migrating(&crObj.Status)
+	if started, result, err := r.startMigration(crObj, origStatus); !started {
+		return result, err
+	}
+	if !wasMigrating && migrating(&crObj.Status) {
+		// status carrying Migration has been written
+		origStatus = crObj.Status.DeepCopy()
+	}
 
-		log.Info("Reusing a LoadBalancer Service", "name", availableLB.Name)
-		lbNamespacedName := types.NamespacedName{Name: availableLB.Name, Namespace: availableLB.Namespace}
-		// at this point, we can reuse a LoadBalancer
-		// i.e. availableLB is expected to carry loadbalancer info
-		// check if this cr carries a port; if not, assign a random port
-		portUpdated, _ := r.provider.UpdateService(clusterSvc, availableLB)
-		err = r.Create(context.TODO(), clusterSvc)
-		if err != nil {
-			return reconcile.Result{}, err
-		}
+	// 5) deal with the Cluster Service object, and associate it with the LoadBalancer
+	return r.associate(crObj, origStatus)
+}
 
-		// for EKS/GKE, need to get the NodePort from clusterSvc
-		// then it's able to proceed to add listener and handle firewall rules, etc.
-		if err = r.provider.AssociateLB(request.NamespacedName, lbNamespacedName, clusterSvc); err != nil {
-			// backoff a bit
-			return reconcile.Result{RequeueAfter: time.Second * 1}, err
+// place reserves a slot on a LoadBalancer for crObj, and records it in Status.Ref, so that
+// it's associated with the LoadBalancer from then on even if association fails halfway.
+// It returns false along with the result of Reconcile if crObj can't be placed right now.
+func (r *ReconcileSharedLB) place(crObj *kubeconv1alpha1.SharedLB, orig *kubeconv1alpha1.SharedLBStatus) (bool, reconcile.Result, error) {
+	request := types.NamespacedName{Name: crObj.Name, Namespace: crObj.Namespace}
+	pool, err := r.getPool(crObj)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			message := fmt.Sprintf("SharedLBPool %q is not found", crObj.Spec.PoolName)
+			r.recorder.Event(crObj, corev1.EventTypeWarning, "PoolNotFound", message)
+			setNotReady(&crObj.Status, kubeconv1alpha1.SharedLBPending, "PoolNotFound", message)
+			result, err := r.retry(crObj, orig, "PoolNotFound", message)
+			return false, result, err
 		}
+		log.Error(err, "fail to get SharedLBPool", "pool", crObj.Spec.PoolName)
+		return false, reconcile.Result{}, err
+	}
+	placement, err := providers.NewPlacement(crObj, pool)
+	if err != nil {
+		// it can't be placed until spec is corrected, which triggers a new reconcile
+		log.Error(err, "fail to place SharedLB", "request", request)
+		r.recorder.Eventf(crObj, corev1.EventTypeWarning, "InvalidPlacement", "Failed to place SharedLB: %v", err)
+		setNotReady(&crObj.Status, kubeconv1alpha1.SharedLBFailed, "InvalidPlacement", err.Error())
+		return false, reconcile.Result{}, r.updateStatus(crObj, orig)
+	}
+
+	// in some cases, esp. when CR obj is created but LoadBalancer service is pending
+	// we rely on an internal struct "tracker" to tell whether incoming CR obj should
+	// a) be put back to queue or b) be processed instantly
+	if r.tracker.isWaiting(request) {
+		log.Info("It's likely a dependent IaaS LoadBalancer is pending. Requeue to wait for its completion and retry.", "request", request)
+		return r.waitForLB(crObj, orig)
+	}
 
-		// it's reusing a LB, so availableLB is expected to carry loadbalancer info
-		crObj.Status.Ref = lbNamespacedName.String()
-		crObj.Status.LoadBalancer = availableLB.Status.LoadBalancer
-		if portUpdated {
-			// seems don't need a DeepCopy
-			crObj.Spec.Ports = clusterSvc.Spec.Ports
+	// ports reassigned on a LB it was placed onto before don't apply any more
+	crObj.Status.ReassignedPorts = nil
+	clusterSvc := r.provider.NewService(crObj)
+	// fetch an available LoadBalancer Service that can be reused, a slot
+	// (and ports) on it is reserved so that concurrent reconciles won't race
+	var availableLB *corev1.Service
+	if placement.Pinned() {
+		// a pinned SharedLB waits for its LB instead of getting a new one
+		if availableLB, err = r.reservePinnedLB(request, clusterSvc, placement); err != nil {
+			log.Info("Pinned LB is unavailable", "request", request, "reason", err.Error())
+			result, err := r.pinnedLBUnavailable(crObj, orig, err)
+			return false, result, err
+		}
+	} else if availableLB, err = r.provider.GetAvailabelLB(request, clusterSvc, placement); err != nil {
+		// a new LB won't help
+		log.Info("Ports are unavailable", "request", request, "reason", err.Error())
+		result, err := r.portsUnavailable(crObj, orig, err)
+		return false, result, err
+	}
+	if availableLB == nil {
+		// wait on a pending LB which still has a slot to promise,
+		// or provision a new one if there isn't
+		newLB := r.provider.NewLBService()
+		providers.ApplyPool(newLB, pool)
+		capacity := placement.Capacity
+		if capacity <= 0 {
+			capacity = r.provider.GetCapacityPerLB()
+		}
+		// in flexible mode, ports which clash are replaced once the LB is ready
+		var ports []providers.PortKey
+		if !placement.Flexible {
+			ports = portKeysOf(clusterSvc.Spec.Ports)
 		}
-		err = r.Update(context.TODO(), crObj)
+		lbNamespacedName, isNew := r.tracker.promise(request, placement.Pool, capacity, ports, providers.GetNamespacedName(newLB))
+		if !isNew {
+			log.Info("Waiting on a pending LB", "request", request, "lb", lbNamespacedName)
+			return r.waitForLB(crObj, orig)
+		}
+		log.Info("Creating a real LoadBalancer Service")
+		err = r.Create(context.TODO(), newLB)
 		if err != nil {
-			return reconcile.Result{}, err
+			log.Error(err, "Creating LoadBalancer Service Failed", "name", newLB.Name)
+			r.recorder.Eventf(crObj, corev1.EventTypeWarning, "CreateLBFailed", "Failed to create LoadBalancer %s: %v", lbNamespacedName, err)
+			r.tracker.done(lbNamespacedName)
+			setProvisioning(&crObj.Status, "CreateLBFailed", err.Error())
+			result, err := r.retry(crObj, orig, "CreateLBFailed", err.Error())
+			return false, result, err
 		}
+		log.Info("A real LB is created", "name", newLB.Name, "lbinfo", newLB.Status.LoadBalancer)
+		r.recorder.Eventf(crObj, corev1.EventTypeNormal, "CreatingLB", "Creating LoadBalancer %s", lbNamespacedName)
+		r.recorder.Eventf(newLB, corev1.EventTypeNormal, "Provisioning", "Provisioning for SharedLB %s", request)
+		// NOTE: here we directly return to start a new reconcile
+		return r.waitForLB(crObj, orig)
+	}
+
+	log.Info("Reusing a LoadBalancer Service", "name", availableLB.Name)
+	// at this point, we can reuse a LoadBalancer
+	// i.e. availableLB is expected to carry loadbalancer info
+	// check if this cr carries a port; if not, assign a random port
+	r.provider.UpdateService(clusterSvc, availableLB)
+	filled, err := r.fillPorts(crObj, clusterSvc)
+	if err != nil {
+		// give the slot back so that it's not leaked; next reconcile reserves again
+		r.provider.CancelReservation(request, clusterSvc)
+		return false, reconcile.Result{}, err
+	}
+	reassigned := reassignmentsOf(crObj.Spec.Ports, clusterSvc.Spec.Ports)
+	crObj.Status.ReassignedPorts = reassigned
+	setBound(&crObj.Status, availableLB)
+	if err := r.updateStatus(crObj, orig); err != nil {
+		r.provider.CancelReservation(request, clusterSvc)
+		return false, reconcile.Result{}, err
+	}
+	r.recorder.Eventf(crObj, corev1.EventTypeNormal, "Assigned", "Assigned to LoadBalancer %s", crObj.Status.Ref)
+	r.recorder.Eventf(availableLB, corev1.EventTypeNormal, "TenantAssigned", "Assigned SharedLB %s", request)
+	if filled {
+		r.recorder.Eventf(crObj, corev1.EventTypeNormal, "PortsAllocated", "Allocated ports %v", portsOf(crObj.Spec.Ports))
+	}
+	if len(reassigned) > 0 {
+		r.recorder.Eventf(crObj, corev1.EventTypeNormal, "PortsReassigned", "Ports taken on LoadBalancer %s are replaced: %s", crObj.Status.Ref, formatReassignments(reassigned))
+	}
+	return true, reconcile.Result{}, nil
+}
+
+// waitForLB marks crObj as waiting for a LB to be provisioned. It's not retried with backoff,
+// nor reported as stalled, as it's enqueued once released from the LB; it's only requeued
+// in case the LB is not ready in time.
+func (r *ReconcileSharedLB) waitForLB(crObj *kubeconv1alpha1.SharedLB, orig *kubeconv1alpha1.SharedLBStatus) (bool, reconcile.Result, error) {
+	setProvisioning(&crObj.Status, "WaitingForLB", "waiting for a LoadBalancer to be provisioned")
+	return false, reconcile.Result{RequeueAfter: r.tracker.timeout}, r.updateStatus(crObj, orig)
+}
+
+// associate makes sure the cluster Service of crObj exists, and associates it with
+// the LoadBalancer crObj is placed onto
+func (r *ReconcileSharedLB) associate(crObj *kubeconv1alpha1.SharedLB, orig *kubeconv1alpha1.SharedLBStatus) (reconcile.Result, error) {
+	request := types.NamespacedName{Name: crObj.Name, Namespace: crObj.Namespace}
+	lbName, err := parseRef(crObj.Status.Ref)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	lbSvc := &corev1.Service{}
+	if err := r.Get(context.TODO(), lbName, lbSvc); err != nil {
+		if errors.IsNotFound(err) {
+			message := fmt.Sprintf("LoadBalancer %s is not found", lbName)
+			r.recorder.Event(crObj, corev1.EventTypeWarning, "LBNotFound", message)
+			setCondition(&crObj.Status, kubeconv1alpha1.SharedLBProvisioned, corev1.ConditionFalse, "LBNotFound", message)
+			setNotReady(&crObj.Status, kubeconv1alpha1.SharedLBBound, "LBNotFound", message)
+			return r.retry(crObj, orig, "LBNotFound", message)
+		}
+		return reconcile.Result{}, err
+	}
+
+	// Define the desired cluster Service object
+	desired := r.provider.NewService(crObj)
+	if err := controllerutil.SetControllerReference(crObj, desired, r.scheme); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	// Check if the cluster Service already exists
+	clusterSvc := &corev1.Service{}
+	err = r.Get(context.TODO(), types.NamespacedName{Name: desired.Name, Namespace: desired.Namespace}, clusterSvc)
+	if errors.IsNotFound(err) {
+		clusterSvc = nil
 	} else if err != nil {
 		return reconcile.Result{}, err
 	}
 
-	// We don't care about update of cluster Service, so do nothing here
-	return reconcile.Result{}, nil
-}
+	// ports are changed (or left as 0) after placement
+	if hasZeroPort(desired) || (clusterSvc != nil && portsChanged(clusterSvc, desired)) {
+		if updated, result, err := r.updatePorts(crObj, orig, clusterSvc, desired); !updated {
+			return result, err
+		}
+	}
+	// ports have been assigned, it's only to set externalIP if needed
+	r.provider.UpdateService(desired, lbSvc)
+	externalIPs := desired.Spec.ExternalIPs
+	// for IKS/GKE, externalIPs of the source LB are kept until the migration is completed,
+	// so that it's exposed on both LBs in the meantime
+	if clusterSvc != nil && migrating(&crObj.Status) {
+		desired.Spec.ExternalIPs = mergeExternalIPs(clusterSvc.Spec.ExternalIPs, externalIPs)
+	}
+	if clusterSvc == nil {
+		clusterSvc = desired
+		if err := r.Create(context.TODO(), clusterSvc); err != nil {
+			return reconcile.Result{}, err
+		}
+	} else if syncClusterService(clusterSvc, desired) {
+		if err := r.Update(context.TODO(), clusterSvc); err != nil {
+			return reconcile.Result{}, err
+		}
+		r.recorder.Eventf(crObj, corev1.EventTypeNormal, "ServiceUpdated", "Updated Service %s with ports %v", desired.Name, portsOf(clusterSvc.Spec.Ports))
+	}
 
-func (pq *pendingQ) add(crName, lbName types.NamespacedName) {
-	if pq.pendingLB == nil {
-		pq.pendingLB = &lbName
+	// for EKS/AKS, need to get the NodePort from clusterSvc, and for GKE the
+	// ports, then it's able to proceed to add listener and handle firewall rules, etc.
+	err = r.provider.AssociateLB(request, lbName, clusterSvc)
+	crObj.Status.LoadBalancer = lbSvc.Status.LoadBalancer
+	setCondition(&crObj.Status, kubeconv1alpha1.SharedLBProvisioned, corev1.ConditionTrue, "LBProvisioned", "")
+	setAssociated(crObj, err)
+	if err != nil {
+		// this is possible when LB/IaaS obj is not ready yet, or cloud API calls fail
+		log.Error(err, "fail to associate LB", "request", request, "lb", lbName)
+		r.recorder.Eventf(crObj, corev1.EventTypeWarning, "AssociateLBFailed", "Failed to associate with LoadBalancer %s: %v", lbName, err)
+		return r.retry(crObj, orig, "AssociateLBFailed", err.Error())
 	}
-	pq.pendingCRs[crName] = struct{}{}
+	if orig.Phase != kubeconv1alpha1.SharedLBReady {
+		r.recorder.Eventf(crObj, corev1.EventTypeNormal, "Ready", "Exposed on LoadBalancer %s", lbName)
+	}
+	// it's exposed on the target LB now, so the source can be cleaned up
+	if migrating(&crObj.Status) {
+		if completed, result, err := r.completeMigration(crObj, orig); !completed {
+			return result, err
+		}
+		desired.Spec.ExternalIPs = externalIPs
+		if syncClusterService(clusterSvc, desired) {
+			if err := r.Update(context.TODO(), clusterSvc); err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+	}
+	r.progressed(crObj)
+	return reconcile.Result{}, r.updateStatus(crObj, orig)
 }
 
-func (pq *pendingQ) remove(lbName types.NamespacedName) {
-	pq.pendingLB = nil
-	pq.pendingCRs = make(map[types.NamespacedName]struct{})
+// getPool returns the SharedLBPool crObj refers to, or nil if it doesn't refer to any
+func (r *ReconcileSharedLB) getPool(crObj *kubeconv1alpha1.SharedLB) (*kubeconv1alpha1.SharedLBPool, error) {
+	if crObj.Spec.PoolName == "" {
+		return nil, nil
+	}
+	pool := &kubeconv1alpha1.SharedLBPool{}
+	if err := r.Get(context.TODO(), types.NamespacedName{Name: crObj.Spec.PoolName}, pool); err != nil {
+		return nil, err
+	}
+	return pool, nil
 }
 
-func (pq *pendingQ) hasCR(crName types.NamespacedName) bool {
-	_, ok := pq.pendingCRs[crName]
-	return ok
+func hasZeroPort(svc *corev1.Service) bool {
+	for _, port := range svc.Spec.Ports {
+		if port.Port == 0 {
+			return true
+		}
+	}
+	return false
 }
 
-func (pq *pendingQ) hasLB(lbName types.NamespacedName) bool {
-	return pq.pendingLB != nil && *pq.pendingLB == lbName
+// portsOf returns port numbers of ports
+func portsOf(ports []corev1.ServicePort) []int32 {
+	result := make([]int32, len(ports))
+	for i, port := range ports {
+		result[i] = port.Port
+	}
+	return result
 }
 
-func (pq *pendingQ) isEmpty() bool {
-	return pq.pendingLB == nil
+// portKeysOf returns keys of ports, so that TCP and UDP ports of the same number differ
+func portKeysOf(ports []corev1.ServicePort) []providers.PortKey {
+	keys := make([]providers.PortKey, len(ports))
+	for i, p := range ports {
+		keys[i] = providers.PortKeyOf(p)
+	}
+	return keys
 }
 
 func containsString(slice []string, s string) bool {
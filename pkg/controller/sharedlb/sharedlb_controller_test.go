@@ -21,6 +21,7 @@ import (
 	"time"
 
 	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
 	"github.com/onsi/gomega"
 	"golang.org/x/net/context"
 	corev1 "k8s.io/api/core/v1"
@@ -60,8 +61,10 @@ func TestReconcile(t *testing.T) {
 	g.Expect(err).NotTo(gomega.HaveOccurred())
 	c = mgr.GetClient()
 
-	recFn, requests := SetupTestReconcile(newReconciler(mgr))
-	g.Expect(add(mgr, recFn)).NotTo(gomega.HaveOccurred())
+	r, err := newReconciler(mgr)
+	g.Expect(err).NotTo(gomega.HaveOccurred())
+	recFn, requests := SetupTestReconcile(r)
+	g.Expect(add(mgr, recFn, r.tracker.released)).NotTo(gomega.HaveOccurred())
 
 	stopMgr, mgrStopped := StartTestManager(mgr, g)
 
@@ -96,3 +99,73 @@ func TestReconcile(t *testing.T) {
 	g.Expect(c.Delete(context.TODO(), service)).To(gomega.Succeed())
 
 }
+
+func TestFinalizeWithoutClusterService(t *testing.T) {
+	deleting := func(cr *kubeconv1alpha1.SharedLB) *kubeconv1alpha1.SharedLB {
+		now := metav1.Now()
+		cr.DeletionTimestamp = &now
+		cr.Finalizers = []string{providers.FinalizerName}
+		return cr
+	}
+	// cr-a is placed onto lb-1 before its cluster Service is created,
+	// and cr-b is waiting on a pending LB
+	fake := newFakeClient(
+		newWarmUpLBService("lb-1", "1.1.1.1"),
+		deleting(newWarmUpSharedLB("cr-a", "default/lb-1", 80)),
+		deleting(newWarmUpSharedLB("cr-b", "", 80)),
+	)
+	provider, err := providers.GetProvider("local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &ReconcileSharedLB{Client: fake, provider: provider, tracker: newProvisionTracker(time.Minute)}
+	crA := types.NamespacedName{Name: "cr-a", Namespace: "ns"}
+	crB := types.NamespacedName{Name: "cr-b", Namespace: "ns"}
+	r.tracker.promise(crB, "", 2, nil, types.NamespacedName{Name: "lb-2", Namespace: "default"})
+
+	for _, crName := range []types.NamespacedName{crA, crB} {
+		if _, err := r.Reconcile(reconcile.Request{NamespacedName: crName}); err != nil {
+			t.Fatalf("Reconcile(%v) error = %v", crName, err)
+		}
+		if finalizers := fake.crs[crName].Finalizers; len(finalizers) != 0 {
+			t.Errorf("%v has finalizers %v, want none", crName, finalizers)
+		}
+	}
+	if usages := provider.ListLBs(); len(usages) != 1 || usages[0].Tenants != 0 || usages[0].Ports != 0 {
+		t.Errorf("ListLBs() = %+v, want the slot and port reserved on lb-1 to be released", usages)
+	}
+	if r.tracker.isWaiting(crB) || r.tracker.promised("") != 0 {
+		t.Errorf("%v is expected to be released from the pending LB", crB)
+	}
+}
+
+func TestWaitForLB(t *testing.T) {
+	crB := newWarmUpSharedLB("cr-b", "", 80)
+	crB.Finalizers = []string{providers.FinalizerName}
+	fake := newFakeClient(crB)
+	provider, err := providers.GetProvider("local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &ReconcileSharedLB{Client: fake, provider: provider, tracker: newProvisionTracker(time.Minute), backoff: newBackoffPolicy()}
+	crName := types.NamespacedName{Name: "cr-b", Namespace: "ns"}
+	r.tracker.promise(crName, "", 2, nil, types.NamespacedName{Name: "lb-2", Namespace: "default"})
+
+	// waits on a pending LB are neither backed off nor reported as stalled
+	for i := 0; i < 2*r.backoff.stallAfter; i++ {
+		result, err := r.Reconcile(reconcile.Request{NamespacedName: crName})
+		if err != nil {
+			t.Fatalf("Reconcile() error = %v", err)
+		}
+		if result.RequeueAfter != time.Minute {
+			t.Fatalf("Reconcile() = %+v, want to be requeued after the LB times out", result)
+		}
+	}
+	status := &fake.crs[crName].Status
+	if cond := getCondition(status, kubeconv1alpha1.SharedLBStalled); cond != nil {
+		t.Errorf("%v is reported as stalled: %+v", crName, cond)
+	}
+	if cond := getCondition(status, kubeconv1alpha1.SharedLBProvisioned); cond == nil || cond.Reason != "WaitingForLB" {
+		t.Errorf("provisioned condition = %+v, want one waiting for LB", cond)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"context"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+)
+
+// updateStatus writes status of crObj through the status subresource, if it's changed from orig
+func (r *ReconcileSharedLB) updateStatus(crObj *kubeconv1alpha1.SharedLB, orig *kubeconv1alpha1.SharedLBStatus) error {
+	crObj.Status.ObservedGeneration = crObj.Generation
+	if apiequality.Semantic.DeepEqual(orig, &crObj.Status) {
+		return nil
+	}
+	if err := r.Status().Update(context.TODO(), crObj); err != nil {
+		log.Error(err, "fail to update status of SharedLB", "name", crObj.Name, "namespace", crObj.Namespace)
+		return err
+	}
+	return nil
+}
+
+// setNotReady sets phase of status, and marks it as not ready for reason
+func setNotReady(status *kubeconv1alpha1.SharedLBStatus, phase kubeconv1alpha1.SharedLBPhase, reason, message string) {
+	status.Phase = phase
+	setCondition(status, kubeconv1alpha1.SharedLBReadyCondition, corev1.ConditionFalse, reason, message)
+}
+
+// setProvisioning marks status as waiting for a LB to be provisioned
+func setProvisioning(status *kubeconv1alpha1.SharedLBStatus, reason, message string) {
+	setNotReady(status, kubeconv1alpha1.SharedLBProvisioning, reason, message)
+	setCondition(status, kubeconv1alpha1.SharedLBProvisioned, corev1.ConditionFalse, reason, message)
+}
+
+// setBound records lb as the one status is placed onto
+func setBound(status *kubeconv1alpha1.SharedLBStatus, lb *corev1.Service) {
+	status.Ref = providers.GetNamespacedName(lb).String()
+	status.LoadBalancer = lb.Status.LoadBalancer
+	setCondition(status, kubeconv1alpha1.SharedLBProvisioned, corev1.ConditionTrue, "LBProvisioned", "")
+	setNotReady(status, kubeconv1alpha1.SharedLBBound, "ConfiguringLB", "configuring listeners and firewall of the LoadBalancer")
+}
+
+// setAssociated records result of associating crObj with its LB, err is the one returned by AssociateLB
+func setAssociated(crObj *kubeconv1alpha1.SharedLB, err error) {
+	status := &crObj.Status
+	if err == nil {
+		setCondition(status, kubeconv1alpha1.SharedLBListenersConfigured, corev1.ConditionTrue, "ListenersConfigured", "")
+		setCondition(status, kubeconv1alpha1.SharedLBFirewallConfigured, corev1.ConditionTrue, "FirewallConfigured", "")
+		setCondition(status, kubeconv1alpha1.SharedLBReadyCondition, corev1.ConditionTrue, "Ready", "")
+		status.Phase = kubeconv1alpha1.SharedLBReady
+		status.Endpoints = endpointsOf(providers.ExposedPorts(crObj), status.LoadBalancer)
+		return
+	}
+
+	reason, message := "AssociateLBFailed", err.Error()
+	switch providers.FailedStep(err) {
+	case providers.StepListeners:
+		reason = "ConfigureListenersFailed"
+		setCondition(status, kubeconv1alpha1.SharedLBListenersConfigured, corev1.ConditionFalse, reason, message)
+		setCondition(status, kubeconv1alpha1.SharedLBFirewallConfigured, corev1.ConditionUnknown, reason, "")
+	case providers.StepFirewall:
+		reason = "ConfigureFirewallFailed"
+		setCondition(status, kubeconv1alpha1.SharedLBListenersConfigured, corev1.ConditionTrue, "ListenersConfigured", "")
+		setCondition(status, kubeconv1alpha1.SharedLBFirewallConfigured, corev1.ConditionFalse, reason, message)
+	default:
+		setCondition(status, kubeconv1alpha1.SharedLBListenersConfigured, corev1.ConditionUnknown, reason, "")
+		setCondition(status, kubeconv1alpha1.SharedLBFirewallConfigured, corev1.ConditionUnknown, reason, "")
+	}
+	setNotReady(status, kubeconv1alpha1.SharedLBBound, reason, message)
+}
+
+// endpointsOf returns an endpoint for each of ports on each ingress of lbStatus
+func endpointsOf(ports []corev1.ServicePort, lbStatus corev1.LoadBalancerStatus) []kubeconv1alpha1.SharedLBEndpoint {
+	var endpoints []kubeconv1alpha1.SharedLBEndpoint
+	for _, ingress := range lbStatus.Ingress {
+		for _, port := range ports {
+			endpoints = append(endpoints, kubeconv1alpha1.SharedLBEndpoint{
+				IP:       ingress.IP,
+				Hostname: ingress.Hostname,
+				Port:     port.Port,
+				Protocol: port.Protocol,
+			})
+		}
+	}
+	return endpoints
+}
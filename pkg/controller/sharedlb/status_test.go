@@ -0,0 +1,120 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestSetAssociated(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		phase     kubeconv1alpha1.SharedLBPhase
+		listeners corev1.ConditionStatus
+		firewall  corev1.ConditionStatus
+		ready     corev1.ConditionStatus
+	}{
+		{
+			name:      "associated",
+			phase:     kubeconv1alpha1.SharedLBReady,
+			listeners: corev1.ConditionTrue,
+			firewall:  corev1.ConditionTrue,
+			ready:     corev1.ConditionTrue,
+		},
+		{
+			name:      "listeners failed",
+			err:       &providers.AssociationError{Step: providers.StepListeners, Err: errors.New("throttled")},
+			phase:     kubeconv1alpha1.SharedLBBound,
+			listeners: corev1.ConditionFalse,
+			firewall:  corev1.ConditionUnknown,
+			ready:     corev1.ConditionFalse,
+		},
+		{
+			name:      "firewall failed",
+			err:       &providers.AssociationError{Step: providers.StepFirewall, Err: errors.New("rule limit exceeded")},
+			phase:     kubeconv1alpha1.SharedLBBound,
+			listeners: corev1.ConditionTrue,
+			firewall:  corev1.ConditionFalse,
+			ready:     corev1.ConditionFalse,
+		},
+		{
+			name:      "unknown step failed",
+			err:       errors.New("boom"),
+			phase:     kubeconv1alpha1.SharedLBBound,
+			listeners: corev1.ConditionUnknown,
+			firewall:  corev1.ConditionUnknown,
+			ready:     corev1.ConditionFalse,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crObj := &kubeconv1alpha1.SharedLB{
+				Spec: kubeconv1alpha1.SharedLBSpec{Ports: []corev1.ServicePort{{Port: 80, Protocol: corev1.ProtocolTCP}}},
+				Status: kubeconv1alpha1.SharedLBStatus{
+					LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{IP: "1.2.3.4"}}},
+				},
+			}
+			setAssociated(crObj, tt.err)
+			status := &crObj.Status
+			if status.Phase != tt.phase {
+				t.Errorf("phase = %v, want %v", status.Phase, tt.phase)
+			}
+			for condType, want := range map[kubeconv1alpha1.SharedLBConditionType]corev1.ConditionStatus{
+				kubeconv1alpha1.SharedLBListenersConfigured: tt.listeners,
+				kubeconv1alpha1.SharedLBFirewallConfigured:  tt.firewall,
+				kubeconv1alpha1.SharedLBReadyCondition:      tt.ready,
+			} {
+				if cond := getCondition(status, condType); cond == nil || cond.Status != want {
+					t.Errorf("condition %v = %v, want status %v", condType, cond, want)
+				}
+			}
+			if gotEndpoints := len(status.Endpoints) > 0; gotEndpoints != (tt.err == nil) {
+				t.Errorf("endpoints = %v", status.Endpoints)
+			}
+		})
+	}
+}
+
+func TestEndpointsOf(t *testing.T) {
+	ports := []corev1.ServicePort{
+		{Port: 80, Protocol: corev1.ProtocolTCP},
+		{Port: 53, Protocol: corev1.ProtocolUDP},
+	}
+	lbStatus := corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{
+		{IP: "1.2.3.4"},
+		{Hostname: "lb.example.com"},
+	}}
+	want := []kubeconv1alpha1.SharedLBEndpoint{
+		{IP: "1.2.3.4", Port: 80, Protocol: corev1.ProtocolTCP},
+		{IP: "1.2.3.4", Port: 53, Protocol: corev1.ProtocolUDP},
+		{Hostname: "lb.example.com", Port: 80, Protocol: corev1.ProtocolTCP},
+		{Hostname: "lb.example.com", Port: 53, Protocol: corev1.ProtocolUDP},
+	}
+	if got := endpointsOf(ports, lbStatus); !reflect.DeepEqual(got, want) {
+		t.Errorf("endpointsOf() = %v, want %v", got, want)
+	}
+	if got := endpointsOf(ports, corev1.LoadBalancerStatus{}); got != nil {
+		t.Errorf("endpointsOf() = %v, want nil when LB has no ingress", got)
+	}
+}
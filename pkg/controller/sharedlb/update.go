@@ -0,0 +1,255 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// updatePorts makes ports of desired take effect on the LB crObj is placed onto: listeners
+// and firewall rules of ports removed from clusterSvc (nil if it doesn't exist) are deleted,
+// and ports of desired are reserved, with the ones left as 0 assigned and persisted in spec,
+// and the ones replaced recorded in status.
+// It returns false along with the result of Reconcile if it can't proceed.
+func (r *ReconcileSharedLB) updatePorts(crObj *kubeconv1alpha1.SharedLB, orig *kubeconv1alpha1.SharedLBStatus,
+	clusterSvc, desired *corev1.Service) (bool, reconcile.Result, error) {
+	request := types.NamespacedName{Name: crObj.Name, Namespace: crObj.Namespace}
+	if clusterSvc != nil {
+		if err := r.provider.DeassociatePorts(request, clusterSvc, desired); err != nil {
+			log.Error(err, "fail to remove ports from LB", "request", request)
+			r.recorder.Eventf(crObj, corev1.EventTypeWarning, "DeassociatePortsFailed", "Failed to remove ports from LoadBalancer %s: %v", crObj.Status.Ref, err)
+			setAssociated(crObj, err)
+			result, err := r.retry(crObj, orig, "DeassociatePortsFailed", err.Error())
+			return false, result, err
+		}
+	}
+
+	pool, err := r.getPool(crObj)
+	if err != nil && !errors.IsNotFound(err) {
+		return false, reconcile.Result{}, err
+	}
+	// the pool may be gone, then ports are assigned in the default range
+	placement, err := providers.NewPlacement(crObj, pool)
+	if err != nil {
+		return false, reconcile.Result{}, err
+	}
+	if err := r.provider.ReservePorts(request, desired, placement); err != nil {
+		switch err.(type) {
+		case *providers.PortConflictError, *providers.PortRangeExhaustedError:
+			result, err := r.resolveConflict(crObj, orig, clusterSvc, err)
+			return false, result, err
+		case *providers.UnsupportedProtocolError:
+			// no other LB can take it either, it's retried upon spec update
+			result, err := r.portsUnavailable(crObj, orig, err)
+			return false, result, err
+		}
+		r.recorder.Eventf(crObj, corev1.EventTypeWarning, "ReservePortsFailed", "Failed to reserve ports on LoadBalancer %s: %v", crObj.Status.Ref, err)
+		setNotReady(&crObj.Status, kubeconv1alpha1.SharedLBBound, "ReservePortsFailed", err.Error())
+		result, err := r.retry(crObj, orig, "ReservePortsFailed", err.Error())
+		return false, result, err
+	}
+	filled, err := r.fillPorts(crObj, desired)
+	if err != nil {
+		return false, reconcile.Result{}, err
+	}
+	if filled {
+		r.recorder.Eventf(crObj, corev1.EventTypeNormal, "PortsAllocated", "Allocated ports %v", portsOf(crObj.Spec.Ports))
+	}
+	reassigned := reassignmentsOf(crObj.Spec.Ports, desired.Spec.Ports)
+	if !apiequality.Semantic.DeepEqual(reassigned, crObj.Status.ReassignedPorts) {
+		crObj.Status.ReassignedPorts = reassigned
+		if len(reassigned) > 0 {
+			r.recorder.Eventf(crObj, corev1.EventTypeNormal, "PortsReassigned", "Ports taken on LoadBalancer %s are replaced: %s", crObj.Status.Ref, formatReassignments(reassigned))
+		}
+	}
+	return true, reconcile.Result{}, nil
+}
+
+// resolveConflict moves crObj off its LB, on which other tenants hold ports crObj wants,
+// or no port is left in the port range, so that it's placed onto another LB. If crObj is
+// pinned to the LB, it can't be moved, and the conflict is reported instead.
+func (r *ReconcileSharedLB) resolveConflict(crObj *kubeconv1alpha1.SharedLB, orig *kubeconv1alpha1.SharedLBStatus,
+	clusterSvc *corev1.Service, conflict error) (reconcile.Result, error) {
+	reason, message := unavailableReason(conflict), conflict.Error()
+	r.recorder.Event(crObj, corev1.EventTypeWarning, reason, message)
+	if pinned(crObj) {
+		// it's retried upon spec update
+		setNotReady(&crObj.Status, kubeconv1alpha1.SharedLBFailed, reason, message)
+		return reconcile.Result{}, r.updateStatus(crObj, orig)
+	}
+	return r.evict(crObj, orig, clusterSvc, reason, message)
+}
+
+// portsUnavailable reports why no LB can take ports of crObj. A port range too small for
+// crObj or an unsupported protocol can't be fixed without changing spec, whereas ports in
+// use may be freed later on.
+func (r *ReconcileSharedLB) portsUnavailable(crObj *kubeconv1alpha1.SharedLB, orig *kubeconv1alpha1.SharedLBStatus, err error) (reconcile.Result, error) {
+	reason := unavailableReason(err)
+	r.recorder.Event(crObj, corev1.EventTypeWarning, reason, err.Error())
+	if unfixable(err) {
+		setNotReady(&crObj.Status, kubeconv1alpha1.SharedLBFailed, reason, err.Error())
+		return reconcile.Result{}, r.updateStatus(crObj, orig)
+	}
+	setNotReady(&crObj.Status, kubeconv1alpha1.SharedLBPending, reason, err.Error())
+	return r.retry(crObj, orig, reason, err.Error())
+}
+
+// fillPorts copies ports assigned in svc to the ones left as 0 in spec of crObj, and persists
+// them; ports requested in spec are never rewritten. svc carries the same ports as crObj in
+// the same order. It returns whether any port is filled in.
+func (r *ReconcileSharedLB) fillPorts(crObj *kubeconv1alpha1.SharedLB, svc *corev1.Service) (bool, error) {
+	filled := false
+	for i := range crObj.Spec.Ports {
+		if crObj.Spec.Ports[i].Port == 0 && svc.Spec.Ports[i].Port != 0 {
+			crObj.Spec.Ports[i].Port = svc.Spec.Ports[i].Port
+			filled = true
+		}
+	}
+	if !filled {
+		return false, nil
+	}
+	// status is not carried by Update, keep the one being built
+	status := crObj.Status.DeepCopy()
+	if err := r.Update(context.TODO(), crObj); err != nil {
+		return false, err
+	}
+	crObj.Status = *status
+	return true, nil
+}
+
+// reassignmentsOf returns ports requested in specPorts, which are replaced in ports as
+// they're taken, i.e. in flexible mode; ports carries the same ports in the same order
+func reassignmentsOf(specPorts, ports []corev1.ServicePort) []kubeconv1alpha1.SharedLBPortReassignment {
+	var reassigned []kubeconv1alpha1.SharedLBPortReassignment
+	for i, port := range specPorts {
+		if port.Port != 0 && port.Port != ports[i].Port {
+			key := providers.PortKeyOf(port)
+			reassigned = append(reassigned, kubeconv1alpha1.SharedLBPortReassignment{
+				Protocol:     key.Protocol,
+				Port:         key.Port,
+				AssignedPort: ports[i].Port,
+			})
+		}
+	}
+	return reassigned
+}
+
+// formatReassignments returns "requested->assigned" of each port in reassigned
+func formatReassignments(reassigned []kubeconv1alpha1.SharedLBPortReassignment) string {
+	strs := make([]string, len(reassigned))
+	for i, port := range reassigned {
+		strs[i] = fmt.Sprintf("%d->%d", port.Port, port.AssignedPort)
+	}
+	return strings.Join(strs, ", ")
+}
+
+// evict takes crObj off the LB it's placed onto, so that it's placed again in next reconcile;
+// clusterSvc is nil if it doesn't exist
+func (r *ReconcileSharedLB) evict(crObj *kubeconv1alpha1.SharedLB, orig *kubeconv1alpha1.SharedLBStatus,
+	clusterSvc *corev1.Service, reason, message string) (reconcile.Result, error) {
+	request := types.NamespacedName{Name: crObj.Name, Namespace: crObj.Namespace}
+	if clusterSvc != nil {
+		if err := r.provider.DeassociateLB(request, clusterSvc); err != nil {
+			log.Error(err, "fail to take SharedLB off its LB", "request", request)
+			r.recorder.Eventf(crObj, corev1.EventTypeWarning, "DeassociateLBFailed", "Failed to deassociate from LoadBalancer %s: %v", crObj.Status.Ref, err)
+			return r.retry(crObj, orig, "DeassociateLBFailed", err.Error())
+		}
+	} else {
+		r.provider.CancelReservation(request, nil)
+	}
+	r.recorder.Eventf(crObj, corev1.EventTypeNormal, "Evicted", "Taken off LoadBalancer %s: %s", crObj.Status.Ref, message)
+	crObj.Status.Ref = ""
+	crObj.Status.LoadBalancer = corev1.LoadBalancerStatus{}
+	crObj.Status.Endpoints = nil
+	crObj.Status.ReassignedPorts = nil
+	setCondition(&crObj.Status, kubeconv1alpha1.SharedLBProvisioned, corev1.ConditionFalse, reason, message)
+	setNotReady(&crObj.Status, kubeconv1alpha1.SharedLBPending, reason, message)
+	return reconcile.Result{Requeue: true}, r.updateStatus(crObj, orig)
+}
+
+// normalizePorts returns a copy of ports with defaults applied by API server, and NodePorts
+// cleared; so that ports in SharedLB spec can be compared with the ones of cluster Service
+func normalizePorts(ports []corev1.ServicePort) []corev1.ServicePort {
+	result := make([]corev1.ServicePort, len(ports))
+	for i, port := range ports {
+		if port.Protocol == "" {
+			port.Protocol = corev1.ProtocolTCP
+		}
+		if port.TargetPort == (intstr.IntOrString{}) {
+			port.TargetPort = intstr.FromInt(int(port.Port))
+		}
+		port.NodePort = 0
+		result[i] = port
+	}
+	return result
+}
+
+// portsChanged tells whether ports of desired differ from the ones of clusterSvc
+func portsChanged(clusterSvc, desired *corev1.Service) bool {
+	return !apiequality.Semantic.DeepEqual(normalizePorts(clusterSvc.Spec.Ports), normalizePorts(desired.Spec.Ports))
+}
+
+// mergeExternalIPs returns externalIPs in current, followed by the ones in desired which
+// are not there yet
+func mergeExternalIPs(current, desired []string) []string {
+	merged := append([]string{}, current...)
+	for _, ip := range desired {
+		if !containsString(merged, ip) {
+			merged = append(merged, ip)
+		}
+	}
+	return merged
+}
+
+// syncClusterService makes ports, selector and externalIPs of clusterSvc match desired,
+// and returns whether clusterSvc is changed. NodePorts allocated to ports kept are carried
+// over, so that they're not re-allocated.
+func syncClusterService(clusterSvc, desired *corev1.Service) bool {
+	ports := normalizePorts(desired.Spec.Ports)
+	for i := range ports {
+		for _, port := range clusterSvc.Spec.Ports {
+			if port.Port == ports[i].Port && port.Protocol == ports[i].Protocol {
+				ports[i].NodePort = port.NodePort
+			}
+		}
+	}
+	changed := false
+	if !apiequality.Semantic.DeepEqual(clusterSvc.Spec.Ports, ports) {
+		clusterSvc.Spec.Ports = ports
+		changed = true
+	}
+	if !apiequality.Semantic.DeepEqual(clusterSvc.Spec.Selector, desired.Spec.Selector) {
+		clusterSvc.Spec.Selector = desired.Spec.Selector
+		changed = true
+	}
+	if !apiequality.Semantic.DeepEqual(clusterSvc.Spec.ExternalIPs, desired.Spec.ExternalIPs) {
+		clusterSvc.Spec.ExternalIPs = desired.Spec.ExternalIPs
+		changed = true
+	}
+	return changed
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"reflect"
+	"testing"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestPortsChanged(t *testing.T) {
+	// as persisted by API server
+	clusterSvc := &corev1.Service{Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+		{Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt(80), NodePort: 30080},
+	}}}
+	tests := []struct {
+		name  string
+		ports []corev1.ServicePort
+		want  bool
+	}{
+		{
+			name:  "defaults are not a change",
+			ports: []corev1.ServicePort{{Port: 80}},
+			want:  false,
+		},
+		{
+			name:  "port is changed",
+			ports: []corev1.ServicePort{{Port: 81}},
+			want:  true,
+		},
+		{
+			name:  "protocol is changed",
+			ports: []corev1.ServicePort{{Port: 80, Protocol: corev1.ProtocolUDP}},
+			want:  true,
+		},
+		{
+			name:  "targetPort is changed",
+			ports: []corev1.ServicePort{{Port: 80, TargetPort: intstr.FromInt(8080)}},
+			want:  true,
+		},
+		{
+			name:  "port is added",
+			ports: []corev1.ServicePort{{Port: 80}, {Port: 81}},
+			want:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			desired := &corev1.Service{Spec: corev1.ServiceSpec{Ports: tt.ports}}
+			if got := portsChanged(clusterSvc, desired); got != tt.want {
+				t.Errorf("portsChanged() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncClusterService(t *testing.T) {
+	clusterSvc := &corev1.Service{Spec: corev1.ServiceSpec{
+		Selector: map[string]string{"app": "foo"},
+		Ports: []corev1.ServicePort{
+			{Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt(80), NodePort: 30080},
+			{Protocol: corev1.ProtocolTCP, Port: 81, TargetPort: intstr.FromInt(81), NodePort: 30081},
+		},
+	}}
+	desired := &corev1.Service{Spec: corev1.ServiceSpec{
+		Selector: map[string]string{"app": "foo"},
+		Ports:    []corev1.ServicePort{{Port: 80}, {Port: 82}},
+	}}
+	if !syncClusterService(clusterSvc, desired) {
+		t.Fatalf("syncClusterService() = false, want true as ports are changed")
+	}
+	// NodePort of the port kept is carried over
+	want := []corev1.ServicePort{
+		{Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt(80), NodePort: 30080},
+		{Protocol: corev1.ProtocolTCP, Port: 82, TargetPort: intstr.FromInt(82)},
+	}
+	if !reflect.DeepEqual(clusterSvc.Spec.Ports, want) {
+		t.Errorf("ports = %v, want %v", clusterSvc.Spec.Ports, want)
+	}
+	if syncClusterService(clusterSvc, desired) {
+		t.Errorf("syncClusterService() = true, want false as nothing is changed")
+	}
+
+	desired.Spec.Selector = map[string]string{"app": "bar"}
+	if !syncClusterService(clusterSvc, desired) || clusterSvc.Spec.Selector["app"] != "bar" {
+		t.Errorf("syncClusterService() didn't update selector, got %v", clusterSvc.Spec.Selector)
+	}
+}
+
+func TestPortReassignments(t *testing.T) {
+	specPorts := []corev1.ServicePort{{Port: 80}, {Port: 0}, {Port: 53, Protocol: corev1.ProtocolUDP}}
+	// 80 is kept, 0 is filled in, and 53/UDP is replaced
+	ports := []corev1.ServicePort{{Port: 80}, {Port: 1000}, {Port: 1001, Protocol: corev1.ProtocolUDP}}
+	got := reassignmentsOf(specPorts, ports)
+	want := []kubeconv1alpha1.SharedLBPortReassignment{{Protocol: corev1.ProtocolUDP, Port: 53, AssignedPort: 1001}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reassignmentsOf() = %v, want %v", got, want)
+	}
+	if got, want := formatReassignments(got), "53->1001"; got != want {
+		t.Errorf("formatReassignments() = %q, want %q", got, want)
+	}
+	if got := reassignmentsOf(ports, ports); got != nil {
+		t.Errorf("reassignmentsOf() = %v, want none", got)
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"context"
+	"time"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// poolSetting holds settings of LBs in a pool
+type poolSetting struct {
+	// pool is nil for LBs not belonging to any pool
+	pool         *kubeconv1alpha1.SharedLBPool
+	capacity     int
+	minFreeSlots int
+}
+
+// poolSettings returns settings of all pools keyed with pool name;
+// LBs not belonging to any pool are keyed with ""
+func (r *ReconcileSharedLB) poolSettings() (map[string]poolSetting, error) {
+	settings := map[string]poolSetting{
+		"": {
+			capacity:     r.provider.GetCapacityPerLB(),
+			minFreeSlots: providers.GetEnvValInt("MIN_FREE_SLOTS", 0),
+		},
+	}
+	pools := &kubeconv1alpha1.SharedLBPoolList{}
+	if err := r.List(context.TODO(), &client.ListOptions{}, pools); err != nil {
+		return nil, err
+	}
+	for i := range pools.Items {
+		pool := &pools.Items[i]
+		setting := poolSetting{
+			pool:         pool,
+			capacity:     pool.Spec.Capacity,
+			minFreeSlots: pool.Spec.MinFreeSlots,
+		}
+		if setting.capacity <= 0 {
+			setting.capacity = r.provider.GetCapacityPerLB()
+		}
+		settings[pool.Name] = setting
+	}
+	return settings, nil
+}
+
+// settingOf returns setting of pool; the default one is returned if pool
+// is gone, so that its LBs can still be reclaimed
+func settingOf(settings map[string]poolSetting, pool string) poolSetting {
+	if setting, ok := settings[pool]; ok {
+		return setting
+	}
+	return poolSetting{capacity: settings[""].capacity}
+}
+
+// freeSlots returns the number of free slots of LBs in pool,
+// including the ones being provisioned
+func freeSlots(usages []providers.LBUsage, pool string, capacity int) int {
+	free := 0
+	for _, usage := range usages {
+		if usage.Pool == pool && usage.Tenants < capacity {
+			free += capacity - usage.Tenants
+		}
+	}
+	return free
+}
+
+// lbsToProvision returns the number of LBs needed to bring free slots of pool
+// up to its watermark; promised is the number of slots promised on pending LBs
+func lbsToProvision(usages []providers.LBUsage, pool string, setting poolSetting, promised int) int {
+	if setting.minFreeSlots <= 0 || setting.capacity <= 0 {
+		return 0
+	}
+	lack := setting.minFreeSlots - freeSlots(usages, pool, setting.capacity) + promised
+	if lack <= 0 {
+		return 0
+	}
+	return (lack + setting.capacity - 1) / setting.capacity
+}
+
+// warmer provisions LBs ahead of demand, so that free slots of each pool are kept
+// above its watermark, i.e. env variable MIN_FREE_SLOTS for LBs not belonging to
+// any pool, or Spec.MinFreeSlots of a SharedLBPool. Then a new SharedLB gets its
+// endpoint right away, instead of waiting for a LB to be provisioned.
+type warmer struct {
+	r        *ReconcileSharedLB
+	interval time.Duration
+}
+
+var _ manager.Runnable = &warmer{}
+
+func newWarmer(r *ReconcileSharedLB) *warmer {
+	return &warmer{
+		r:        r,
+		interval: providers.GetEnvValDuration("LB_WARM_INTERVAL", 30*time.Second),
+	}
+}
+
+// Start keeps LBs warm periodically until stop is closed
+func (w *warmer) Start(stop <-chan struct{}) error {
+	wait.Until(func() {
+		if err := w.warm(); err != nil {
+			log.Error(err, "fail to provision warm LBs")
+		}
+	}, w.interval, stop)
+	return nil
+}
+
+func (w *warmer) warm() error {
+	// before provider cache is rebuilt, we don't know how many slots are free
+	if err := w.r.warmUp(); err != nil {
+		return err
+	}
+	settings, err := w.r.poolSettings()
+	if err != nil {
+		return err
+	}
+	usages := w.r.provider.ListLBs()
+	for poolName, setting := range settings {
+		for i := lbsToProvision(usages, poolName, setting, w.r.tracker.promised(poolName)); i > 0; i-- {
+			lbSvc := w.r.provider.NewLBService()
+			providers.ApplyPool(lbSvc, setting.pool)
+			// so that SharedLBs which don't fit can wait on it
+			lbName := providers.GetNamespacedName(lbSvc)
+			w.r.tracker.track(lbName, poolName, setting.capacity)
+			if err := w.r.Create(context.TODO(), lbSvc); err != nil {
+				w.r.tracker.done(lbName)
+				return err
+			}
+			log.Info("A warm LB is created", "name", lbSvc.Name, "pool", poolName)
+			w.r.recorder.Eventf(lbSvc, corev1.EventTypeNormal, "Provisioning", "Provisioning to keep %d free slots in pool %q", setting.minFreeSlots, poolName)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"testing"
+
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestLBsToProvision(t *testing.T) {
+	lb := func(name string) types.NamespacedName {
+		return types.NamespacedName{Name: name, Namespace: "default"}
+	}
+	usages := []providers.LBUsage{
+		{Name: lb("lb-1"), Tenants: 3, Ready: true},
+		{Name: lb("lb-2"), Tenants: 1, Ready: true},
+		// a LB being provisioned counts as well
+		{Name: lb("lb-3"), Ready: false},
+		{Name: lb("lb-gold"), Pool: "gold", Tenants: 4, Ready: true},
+	}
+	tests := []struct {
+		name    string
+		pool    string
+		setting poolSetting
+		// promised is the number of slots promised on pending LBs
+		promised int
+		want     int
+	}{
+		{
+			name:    "watermark is not set",
+			setting: poolSetting{capacity: 3},
+			want:    0,
+		},
+		{
+			name:    "enough free slots",
+			setting: poolSetting{capacity: 3, minFreeSlots: 5},
+			want:    0,
+		},
+		{
+			name:    "one more LB",
+			setting: poolSetting{capacity: 3, minFreeSlots: 6},
+			want:    1,
+		},
+		{
+			name:     "promised slots are not free",
+			setting:  poolSetting{capacity: 3, minFreeSlots: 5},
+			promised: 2,
+			want:     1,
+		},
+		{
+			name:    "several LBs for an exhausted pool",
+			pool:    "gold",
+			setting: poolSetting{capacity: 4, minFreeSlots: 9},
+			want:    3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lbsToProvision(usages, tt.pool, tt.setting, tt.promised); got != tt.want {
+				t.Errorf("lbsToProvision() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
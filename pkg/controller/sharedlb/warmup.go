@@ -0,0 +1,104 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// warmUp rebuilds the provider's internal cache from the cluster: every LB Service
+// (carrying label "lb-template") is loaded into the cache, and every SharedLB which
+// has been placed (i.e. carrying Status.Ref) is associated with its LB again.
+// It's done once upon program starts, and no placement is made before it's completed,
+// otherwise GetAvailabelLB may hand out a port that is already in use.
+func (r *ReconcileSharedLB) warmUp() error {
+	r.warmUpLock.Lock()
+	defer r.warmUpLock.Unlock()
+	if r.warmedUp {
+		return nil
+	}
+
+	lbSvcs := &corev1.ServiceList{}
+	opts := &client.ListOptions{}
+	if err := opts.SetLabelSelector("lb-template"); err != nil {
+		return err
+	}
+	if err := r.List(context.TODO(), opts, lbSvcs); err != nil {
+		return err
+	}
+	for i := range lbSvcs.Items {
+		lbSvc := &lbSvcs.Items[i]
+		r.provider.UpdateCache(providers.GetNamespacedName(lbSvc), lbSvc)
+	}
+
+	crObjs := &kubeconv1alpha1.SharedLBList{}
+	if err := r.List(context.TODO(), &client.ListOptions{}, crObjs); err != nil {
+		return err
+	}
+	restored := 0
+	for i := range crObjs.Items {
+		crObj := &crObjs.Items[i]
+		if crObj.Status.Ref == "" {
+			continue
+		}
+		crName := types.NamespacedName{Name: crObj.Name, Namespace: crObj.Namespace}
+		lbName, err := parseRef(crObj.Status.Ref)
+		if err != nil {
+			log.Error(err, "skip restoring SharedLB", "cr", crName)
+			continue
+		}
+		// the ports of cluster Service are the source of truth (e.g. NodePort is
+		// only available there); fall back to the ones in CR spec if it's missing
+		clusterSvc := &corev1.Service{}
+		err = r.Get(context.TODO(), types.NamespacedName{Name: crObj.Name + providers.SvcPostfix, Namespace: crObj.Namespace}, clusterSvc)
+		if errors.IsNotFound(err) {
+			clusterSvc = r.provider.NewService(crObj)
+		} else if err != nil {
+			return err
+		}
+		r.provider.RestoreAssociation(crName, lbName, clusterSvc)
+		if migrating(&crObj.Status) {
+			// it's still exposed on the source LB
+			if source, err := parseRef(crObj.Status.Migration.From); err == nil {
+				r.provider.RestoreMigration(crName, source, clusterSvc)
+			}
+		}
+		restored++
+	}
+
+	r.warmedUp = true
+	log.Info("Provider cache is rebuilt from cluster", "lbs", len(lbSvcs.Items), "sharedlbs", restored)
+	return nil
+}
+
+// parseRef converts Status.Ref (in format of "namespace/name") to a NamespacedName
+func parseRef(ref string) (types.NamespacedName, error) {
+	strs := strings.Split(ref, "/")
+	if len(strs) != 2 || strs[0] == "" || strs[1] == "" {
+		return types.NamespacedName{}, fmt.Errorf("invalid ref %q", ref)
+	}
+	return types.NamespacedName{Namespace: strs[0], Name: strs[1]}, nil
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharedlb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// fakeClient serves Services and SharedLBs from memory; any call other than Get, List
+// and Update panics, as nothing else is expected to be written
+type fakeClient struct {
+	client.Client
+	svcs    map[types.NamespacedName]*corev1.Service
+	crs     map[types.NamespacedName]*kubeconv1alpha1.SharedLB
+	listErr error
+	lists   int
+	// updates holds copies of objects updated, in order
+	updates []runtime.Object
+}
+
+func newFakeClient(objs ...runtime.Object) *fakeClient {
+	c := &fakeClient{
+		svcs: make(map[types.NamespacedName]*corev1.Service),
+		crs:  make(map[types.NamespacedName]*kubeconv1alpha1.SharedLB),
+	}
+	for _, obj := range objs {
+		switch o := obj.(type) {
+		case *corev1.Service:
+			c.svcs[types.NamespacedName{Name: o.Name, Namespace: o.Namespace}] = o
+		case *kubeconv1alpha1.SharedLB:
+			c.crs[types.NamespacedName{Name: o.Name, Namespace: o.Namespace}] = o
+		}
+	}
+	return c
+}
+
+func (c *fakeClient) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	switch o := obj.(type) {
+	case *corev1.Service:
+		if svc, ok := c.svcs[key]; ok {
+			*o = *svc.DeepCopy()
+			return nil
+		}
+		return apierrors.NewNotFound(schema.GroupResource{Resource: "services"}, key.Name)
+	case *kubeconv1alpha1.SharedLB:
+		if cr, ok := c.crs[key]; ok {
+			*o = *cr.DeepCopy()
+			return nil
+		}
+		return apierrors.NewNotFound(schema.GroupResource{Group: "kubecon.k8s.io", Resource: "sharedlbs"}, key.Name)
+	}
+	return apierrors.NewNotFound(schema.GroupResource{}, key.Name)
+}
+
+func (c *fakeClient) List(ctx context.Context, opts *client.ListOptions, list runtime.Object) error {
+	c.lists++
+	if c.listErr != nil {
+		return c.listErr
+	}
+	switch l := list.(type) {
+	case *corev1.ServiceList:
+		for _, svc := range c.svcs {
+			if opts.LabelSelector == nil || opts.LabelSelector.Matches(labels.Set(svc.Labels)) {
+				l.Items = append(l.Items, *svc.DeepCopy())
+			}
+		}
+	case *kubeconv1alpha1.SharedLBList:
+		for _, cr := range c.crs {
+			l.Items = append(l.Items, *cr.DeepCopy())
+		}
+	}
+	return nil
+}
+
+func (c *fakeClient) Update(ctx context.Context, obj runtime.Object) error {
+	switch o := obj.(type) {
+	case *corev1.Service:
+		c.svcs[types.NamespacedName{Name: o.Name, Namespace: o.Namespace}] = o.DeepCopy()
+	case *kubeconv1alpha1.SharedLB:
+		c.crs[types.NamespacedName{Name: o.Name, Namespace: o.Namespace}] = o.DeepCopy()
+	}
+	c.updates = append(c.updates, obj.DeepCopyObject())
+	return nil
+}
+
+// Status writes status through Update, as the whole object is kept anyway
+func (c *fakeClient) Status() client.StatusWriter {
+	return c
+}
+
+func newWarmUpLBService(name, ip string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"lb-template": ""}},
+		Status: corev1.ServiceStatus{
+			LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{IP: ip}}},
+		},
+	}
+}
+
+func newWarmUpSharedLB(name, ref string, port int32) *kubeconv1alpha1.SharedLB {
+	return &kubeconv1alpha1.SharedLB{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ns"},
+		Spec: kubeconv1alpha1.SharedLBSpec{
+			Ports: []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: port}},
+		},
+		Status: kubeconv1alpha1.SharedLBStatus{Ref: ref},
+	}
+}
+
+func newWarmUpClusterService(name string, port int32) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name + providers.SvcPostfix, Namespace: "ns"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: port}},
+		},
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	// cr-a and cr-c are on lb-1, cr-b is on lb-2 without a cluster Service; cr-d is
+	// not placed yet, and cr-e has a bad ref
+	c := newFakeClient(
+		newWarmUpLBService("lb-1", "1.1.1.1"),
+		newWarmUpLBService("lb-2", "2.2.2.2"),
+		newWarmUpSharedLB("cr-a", "default/lb-1", 80),
+		newWarmUpClusterService("cr-a", 80),
+		newWarmUpSharedLB("cr-b", "default/lb-2", 443),
+		newWarmUpSharedLB("cr-c", "default/lb-1", 8080),
+		newWarmUpClusterService("cr-c", 8080),
+		newWarmUpSharedLB("cr-d", "", 80),
+		newWarmUpSharedLB("cr-e", "bogus", 80),
+	)
+	provider, err := providers.GetProvider("local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &ReconcileSharedLB{Client: c, provider: provider}
+
+	// nothing is marked as done until the cache is rebuilt
+	c.listErr = errors.New("apiserver is unavailable")
+	if err := r.warmUp(); err == nil || r.warmedUp {
+		t.Fatalf("warmUp() error = %v, want the error of listing objects", err)
+	}
+
+	c.listErr = nil
+	if err := r.warmUp(); err != nil || !r.warmedUp {
+		t.Fatalf("warmUp() error = %v", err)
+	}
+	// lb-1 is full, and port 443 is held by cr-b on lb-2 though its cluster Service
+	// doesn't exist
+	crF := types.NamespacedName{Name: "cr-f", Namespace: "ns"}
+	if lb, err := provider.GetAvailabelLB(crF, newWarmUpClusterService("cr-f", 443), providers.Placement{}); lb != nil || err == nil {
+		t.Errorf("GetAvailabelLB() = %v, %v, want port 443 to be taken", lb, err)
+	}
+	// cr-d goes to lb-2 where port 80 is free
+	crD := types.NamespacedName{Name: "cr-d", Namespace: "ns"}
+	lb, err := provider.GetAvailabelLB(crD, newWarmUpClusterService("cr-d", 80), providers.Placement{})
+	if err != nil || lb == nil || lb.Name != "lb-2" {
+		t.Errorf("GetAvailabelLB() = %v, %v, want lb-2", lb, err)
+	}
+
+	// it's only done once
+	lists := c.lists
+	if err := r.warmUp(); err != nil || c.lists != lists {
+		t.Errorf("warmUp() lists objects again, error = %v", err)
+	}
+}
+
+func TestWarmUpMigration(t *testing.T) {
+	// cr-a is being moved from lb-1 to lb-2
+	crA := newWarmUpSharedLB("cr-a", "default/lb-2", 80)
+	crA.Status.Migration = &kubeconv1alpha1.SharedLBMigration{From: "default/lb-1", To: "default/lb-2"}
+	c := newFakeClient(
+		newWarmUpLBService("lb-1", "1.1.1.1"),
+		newWarmUpLBService("lb-2", "2.2.2.2"),
+		crA,
+		newWarmUpClusterService("cr-a", 80),
+	)
+	provider, err := providers.GetProvider("local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &ReconcileSharedLB{Client: c, provider: provider}
+	if err := r.warmUp(); err != nil {
+		t.Fatalf("warmUp() error = %v", err)
+	}
+	tenants := func() map[string]int {
+		got := map[string]int{}
+		for _, usage := range provider.ListLBs() {
+			got[usage.Name.Name] = usage.Tenants
+		}
+		return got
+	}
+	// it's held on both LBs until the migration is completed
+	if got := tenants(); got["lb-1"] != 1 || got["lb-2"] != 1 {
+		t.Errorf("tenants = %v, want cr-a on both lb-1 and lb-2", got)
+	}
+	if err := provider.CompleteMigration(types.NamespacedName{Name: "cr-a", Namespace: "ns"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := tenants(); got["lb-1"] != 0 || got["lb-2"] != 1 {
+		t.Errorf("tenants = %v, want cr-a on lb-2 only", got)
+	}
+}
+
+func TestParseRef(t *testing.T) {
+	tests := []struct {
+		ref     string
+		want    types.NamespacedName
+		wantErr bool
+	}{
+		{ref: "default/lb-1", want: types.NamespacedName{Name: "lb-1", Namespace: "default"}},
+		{ref: "lb-1", wantErr: true},
+		{ref: "/lb-1", wantErr: true},
+		{ref: "default/", wantErr: true},
+		{ref: "a/b/c", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := parseRef(tt.ref)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("parseRef() = %v, %v, want %v, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics holds Prometheus metrics of the shared LoadBalancer controller,
+// and serves them over HTTP along with the manager.
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+)
+
+// Namespace is the prefix of all metric names
+const Namespace = "sharedlb"
+
+var log = logf.Log.WithName("metrics")
+
+var (
+	// Registry is where all metrics of the controller are registered
+	Registry = prometheus.NewRegistry()
+
+	// ProvisioningDuration observes how long it takes from creating a LB Service
+	// to getting its ingress info
+	ProvisioningDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "lb_provisioning_duration_seconds",
+		Help:      "Time from creating a LoadBalancer Service to getting its ingress ready.",
+		Buckets:   []float64{5, 10, 20, 30, 60, 120, 300, 600, 1200},
+	}, []string{"provider", "pool"})
+
+	// CloudAPICalls counts calls to cloud APIs, per operation
+	CloudAPICalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "cloud_api_calls_total",
+		Help:      "Number of calls to cloud APIs.",
+	}, []string{"provider", "operation"})
+
+	// CloudAPIErrors counts failed calls to cloud APIs, per operation
+	CloudAPIErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "cloud_api_errors_total",
+		Help:      "Number of failed calls to cloud APIs.",
+	}, []string{"provider", "operation"})
+
+	// ConsolidationMoves counts tenant moves of consolidator, per result, i.e.
+	// "planned", "executed" or "failed"
+	ConsolidationMoves = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "consolidation_moves_total",
+		Help:      "Number of tenant moves planned or made by the consolidator.",
+	}, []string{"result"})
+)
+
+func init() {
+	Registry.MustRegister(ProvisioningDuration, CloudAPICalls, CloudAPIErrors, ConsolidationMoves)
+}
+
+// ObserveCloudCall records a call to operation of provider's cloud API, err is what the call returns
+func ObserveCloudCall(provider, operation string, err error) {
+	CloudAPICalls.WithLabelValues(provider, operation).Inc()
+	if err != nil {
+		CloudAPIErrors.WithLabelValues(provider, operation).Inc()
+	}
+}
+
+// AddToManager adds a Runnable serving metrics in Registry to mgr. The address is
+// specified by env variable METRICS_ADDR (":8080" by default), and "0" disables it.
+func AddToManager(mgr manager.Manager) error {
+	addr, ok := os.LookupEnv("METRICS_ADDR")
+	if !ok {
+		addr = ":8080"
+	}
+	if addr == "0" {
+		return nil
+	}
+	return mgr.Add(&server{addr: addr})
+}
+
+// server serves metrics over HTTP until the manager stops
+type server struct {
+	addr string
+}
+
+var _ manager.Runnable = &server{}
+
+// Start implements manager.Runnable
+func (s *server) Start(stop <-chan struct{}) error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(listener)
+	}()
+	log.Info("Serving metrics", "addr", s.addr)
+
+	select {
+	case <-stop:
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(ctx)
+	case err := <-errCh:
+		return err
+	}
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveCloudCall(t *testing.T) {
+	// counters are global, so only increments are checked, e.g. with -count=2
+	counts := func(operation string) (float64, float64) {
+		return testutil.ToFloat64(CloudAPICalls.WithLabelValues("fake", operation)),
+			testutil.ToFloat64(CloudAPIErrors.WithLabelValues("fake", operation))
+	}
+	createCalls, createErrors := counts("CreateListeners")
+	deleteCalls, deleteErrors := counts("DeleteListeners")
+	ObserveCloudCall("fake", "CreateListeners", nil)
+	ObserveCloudCall("fake", "CreateListeners", errors.New("throttled"))
+	ObserveCloudCall("fake", "DeleteListeners", nil)
+
+	tests := []struct {
+		operation  string
+		wantCalls  float64
+		wantErrors float64
+	}{
+		{operation: "CreateListeners", wantCalls: createCalls + 2, wantErrors: createErrors + 1},
+		{operation: "DeleteListeners", wantCalls: deleteCalls + 1, wantErrors: deleteErrors},
+	}
+	for _, tt := range tests {
+		if calls, errs := counts(tt.operation); calls != tt.wantCalls || errs != tt.wantErrors {
+			t.Errorf("calls and errors of %s = %v, %v, want %v, %v", tt.operation, calls, errs, tt.wantCalls, tt.wantErrors)
+		}
+	}
+}
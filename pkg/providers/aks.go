@@ -23,11 +23,12 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2017-09-01/network"
-	"github.com/Azure/go-autorest/autorest/azure/auth"
 	"github.com/Azure/go-autorest/autorest/to"
 	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/metrics"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -49,78 +50,109 @@ const (
 )
 
 var (
+	// azureDefaultLBName is the name of Azure LB created by the cloud provider, unless
+	// it's configured otherwise
 	azureDefaultLBName = "kubernetes"
 )
 
 // AKS stands for Azure(Microsoft) Kubernetes Service
 type AKS struct {
+	*Allocator
+
 	subscriptionID string
 	resGrpName     string
 	sgName         string
+	lbName         string
 	lbClient       network.LoadBalancersClient
 	sgClient       network.SecurityGroupsClient
 	pipClient      network.PublicIPAddressesClient
 
-	// key is namespacedName of a LB Serivce, val is the service
-	cacheMap            map[types.NamespacedName]*corev1.Service
+	// key is namespacedName of a LB Serivce, val is the public ip
 	cachePIPMap         map[types.NamespacedName]*network.PublicIPAddress
+	cachePIPLock        sync.RWMutex
 	cacheAzureDefaultLB *network.LoadBalancer
 
-	// cr to LB is 1:1 mapping
-	crToLB map[types.NamespacedName]types.NamespacedName
-	// lb to CRD is 1:N mapping
-	lbToCRs map[types.NamespacedName]nameSet
-	// lbToPorts is keyed with ns/name of a LB, and valued with ports info it holds
-	lbToPorts map[types.NamespacedName]int32Set
-
-	capacityPerLB int
+	// all tenants share one Azure LB and one NSG, which are updated in a
+	// read-modify-write manner, so the updates have to be serialized
+	azureLock sync.Mutex
 }
 
 var _ LBProvider = &AKS{}
 
-func newAKSProvider() *AKS {
-	// TODO(Huang-Wei): auto configure when running inside AKS cluster
-	// for local testing, make sure following env variables are properly set:
-	// AZURE_TENANT_ID, AZURE_CLIENT_ID, AZURE_CLIENT_SECRET, AZURE_SUBSCRIPTION_ID
-	subscriptionID := GetEnvVal("AZURE_SUBSCRIPTION_ID", "58de4ac8-a2d6-499b-b983-6f1c870d398e")
-	authorizer, err := auth.NewAuthorizerFromEnvironment()
+func init() {
+	RegisterProvider("aks", func() (LBProvider, error) {
+		return newAKSProvider()
+	})
+}
+
+func newAKSProvider() (*AKS, error) {
+	// settings are read from the cloud provider config file if it's mounted, then
+	// overridden by env variables, and the rest is discovered from nodes
+	cfg, err := loadAzureConfig(GetEnvVal("AZURE_CLOUD_CONFIG", "/etc/kubernetes/azure.json"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.applyEnv()
+	if cfg.SubscriptionID == "" || cfg.ResourceGroup == "" {
+		nodes, err := listNodes()
+		if err != nil {
+			return nil, fmt.Errorf("cannot list nodes to discover azure settings: %v", err)
+		}
+		cfg.applyNodes(nodes)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.LoadBalancerName == "" {
+		cfg.LoadBalancerName = azureDefaultLBName
+	}
+	authorizer, err := cfg.authorizer()
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("cannot create azure authorizer: %v", err)
 	}
 
 	aks := AKS{
-		subscriptionID: subscriptionID,
-		// TODO(Huang-Wei): get it from node label kubernetes.azure.com/cluster
-		resGrpName: GetEnvVal("RES_GRP_NAME", "MC_res-grp-1_wei-aks_eastus"),
-		// TODO(Huang-Wei): read it from?
-		sgName:        GetEnvVal("SG_NAME", "aks-agentpool-37988249-nsg"),
-		lbClient:      network.NewLoadBalancersClient(subscriptionID),
-		pipClient:     network.NewPublicIPAddressesClient(subscriptionID),
-		sgClient:      network.NewSecurityGroupsClient(subscriptionID),
-		cacheMap:      make(map[types.NamespacedName]*corev1.Service),
-		cachePIPMap:   make(map[types.NamespacedName]*network.PublicIPAddress),
-		crToLB:        make(map[types.NamespacedName]types.NamespacedName),
-		lbToCRs:       make(map[types.NamespacedName]nameSet),
-		lbToPorts:     make(map[types.NamespacedName]int32Set),
-		capacityPerLB: capacity,
+		Allocator:      NewAllocator("aks"),
+		subscriptionID: cfg.SubscriptionID,
+		resGrpName:     cfg.ResourceGroup,
+		sgName:         cfg.SecurityGroupName,
+		lbName:         cfg.LoadBalancerName,
+		lbClient:       network.NewLoadBalancersClient(cfg.SubscriptionID),
+		pipClient:      network.NewPublicIPAddressesClient(cfg.SubscriptionID),
+		sgClient:       network.NewSecurityGroupsClient(cfg.SubscriptionID),
+		cachePIPMap:    make(map[types.NamespacedName]*network.PublicIPAddress),
 	}
 	aks.lbClient.Authorizer = authorizer
 	aks.sgClient.Authorizer = authorizer
 	aks.pipClient.Authorizer = authorizer
 
-	return &aks
-}
+	if aks.sgName == "" {
+		if aks.sgName, err = discoverSGName(aks.sgClient, aks.resGrpName); err != nil {
+			return nil, fmt.Errorf("cannot discover azure network security group: %v", err)
+		}
+	}
+	// fail on start rather than upon the first association
+	if _, err := aks.getDefaultAzureLB(); err != nil {
+		return nil, fmt.Errorf("cannot get azure load balancer %q in resource group %q, set AZURE_LB_NAME or RES_GRP_NAME: %v", aks.lbName, aks.resGrpName, err)
+	}
+	_, err = aks.sgClient.Get(context.TODO(), aks.resGrpName, aks.sgName, "")
+	metrics.ObserveCloudCall("aks", "SecurityGroupsGet", err)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get azure network security group %q in resource group %q, set SG_NAME or RES_GRP_NAME: %v", aks.sgName, aks.resGrpName, err)
+	}
+	log.WithName("aks").Info("New aks provider", "subscription", aks.subscriptionID, "resourceGroup", aks.resGrpName,
+		"securityGroup", aks.sgName, "loadBalancer", aks.lbName)
 
-func (a *AKS) GetCapacityPerLB() int {
-	return a.capacityPerLB
+	return &aks, nil
 }
 
 func (a *AKS) UpdateCache(key types.NamespacedName, lbSvc *corev1.Service) {
+	a.Allocator.UpdateCache(key, lbSvc)
 	if lbSvc == nil {
-		delete(a.cacheMap, key)
+		a.cachePIPLock.Lock()
 		delete(a.cachePIPMap, key)
+		a.cachePIPLock.Unlock()
 	} else {
-		a.cacheMap[key] = lbSvc
 		// handle azure public/frontend ip
 		if len(lbSvc.Status.LoadBalancer.Ingress) == 1 {
 			pip := lbSvc.Status.LoadBalancer.Ingress[0].IP
@@ -128,7 +160,9 @@ func (a *AKS) UpdateCache(key types.NamespacedName, lbSvc *corev1.Service) {
 				log.WithName("aks").Error(err, "cannot query public ip", "pip", pip)
 			} else {
 				log.WithName("aks").Info("pip object is updated in local cache", "key", key, "pip", pip)
+				a.cachePIPLock.Lock()
 				a.cachePIPMap[key] = result
+				a.cachePIPLock.Unlock()
 			}
 		}
 	}
@@ -142,7 +176,7 @@ func (a *AKS) NewService(sharedLB *kubeconv1alpha1.SharedLB) *corev1.Service {
 		},
 		Spec: corev1.ServiceSpec{
 			Type:     corev1.ServiceTypeNodePort,
-			Ports:    sharedLB.Spec.Ports,
+			Ports:    ExposedPorts(sharedLB),
 			Selector: sharedLB.Spec.Selector,
 		},
 	}
@@ -169,63 +203,20 @@ func (a *AKS) NewLBService() *corev1.Service {
 	}
 }
 
-func (a *AKS) GetAvailabelLB(clusterSvc *corev1.Service) *corev1.Service {
-	// we leverage the randomness of golang "for range" when iterating
-OUTERLOOP:
-	for lbKey, lbSvc := range a.cacheMap {
-		if len(a.lbToCRs[lbKey]) >= a.capacityPerLB || len(lbSvc.Status.LoadBalancer.Ingress) == 0 {
-			continue
-		}
-		// must satisfy that all svc ports are not occupied in lbSvc
-		for _, svcPort := range clusterSvc.Spec.Ports {
-			if a.lbToPorts[lbKey] == nil {
-				a.lbToPorts[lbKey] = int32Set{}
-			}
-			if _, ok := a.lbToPorts[lbKey][svcPort.Port]; ok {
-				log.WithName("aks").Info(fmt.Sprintf("incoming service has port conflict with lbSvc %q on port %d", lbKey, svcPort.Port))
-				continue OUTERLOOP
-			}
-		}
-		return lbSvc
-	}
-	return nil
-}
-
 func (a *AKS) AssociateLB(crName, lbName types.NamespacedName, clusterSvc *corev1.Service) error {
 	// a) create Azure LoadBalancer FrontendIP rule (az network lb rule create)
 	// b) create Azure Network Security Group rule (az network nsg rule create)
 	if clusterSvc != nil {
-		pip, lbSvc := a.cachePIPMap[lbName], a.cacheMap[lbName]
+		pip, lbSvc := a.getPIP(lbName), a.GetLB(lbName)
 		if pip != nil && lbSvc != nil {
-			executed, err := a.reconcileLBRules(clusterSvc, lbSvc, true /* create */)
-			if err != nil {
+			if err := a.reconcileRules(clusterSvc, lbSvc, true /* create */); err != nil {
 				return err
 			}
-			if executed {
-				if err := a.reconcileSGRules(clusterSvc, lbSvc, true /* create */); err != nil {
-					return err
-				}
-			}
-		}
-		// upon program starts, a.lbToPorts[lbName] can be nil
-		if a.lbToPorts[lbName] == nil {
-			a.lbToPorts[lbName] = int32Set{}
-		}
-		// update crToPorts
-		for _, svcPort := range clusterSvc.Spec.Ports {
-			a.lbToPorts[lbName][svcPort.Port] = struct{}{}
 		}
 	}
 
 	// c) update internal cache
-	// following code might be called multiple times, but shouldn't impact
-	// performance a lot as all of them are O(1) operation
-	_, ok := a.lbToCRs[lbName]
-	if !ok {
-		a.lbToCRs[lbName] = make(nameSet)
-	}
-	a.lbToCRs[lbName][crName] = struct{}{}
-	a.crToLB[crName] = lbName
+	a.RestoreAssociation(crName, lbName, clusterSvc)
 	log.WithName("aks").Info("AssociateLB", "cr", crName, "lb", lbName)
 	return nil
 }
@@ -233,51 +224,104 @@ func (a *AKS) AssociateLB(crName, lbName types.NamespacedName, clusterSvc *corev
 // DeassociateLB is called by AKS finalizer to clean frontend ip rules
 // and network security group rules
 func (a *AKS) DeassociateLB(crName types.NamespacedName, clusterSvc *corev1.Service) error {
-	lbName, ok := a.crToLB[crName]
+	lbName, ok := a.GetLBName(crName)
 	if !ok {
 		return nil
 	}
 
 	// a) delete Azure LoadBalancer FrontendIP rule (az network lb rule delete)
 	// b) delete Azure Network Security Group rule (az network nsg rule delete)
-	if pip := a.cachePIPMap[lbName]; pip != nil {
-		pip, lbSvc := a.cachePIPMap[lbName], a.cacheMap[lbName]
-		if pip != nil && lbSvc != nil {
-			executed, err := a.reconcileLBRules(clusterSvc, lbSvc, false /* delete */)
-			if err != nil {
-				return err
-			}
-			if executed {
-				if err := a.reconcileSGRules(clusterSvc, lbSvc, false /* delete */); err != nil {
-					return err
-				}
-			}
+	pip, lbSvc := a.getPIP(lbName), a.GetLB(lbName)
+	if pip != nil && lbSvc != nil {
+		if err := a.reconcileRules(clusterSvc, lbSvc, false /* delete */); err != nil {
+			return err
 		}
 	}
 
 	// c) update internal cache
-	delete(a.crToLB, crName)
-	delete(a.lbToCRs[lbName], crName)
-	for _, svcPort := range clusterSvc.Spec.Ports {
-		delete(a.lbToPorts[lbName], svcPort.Port)
-	}
+	a.RemoveAssociation(crName, clusterSvc)
 	log.WithName("aks").Info("DeassociateLB", "cr", crName, "lb", lbName)
 	return nil
 }
 
-func (a *AKS) UpdateService(svc, lb *corev1.Service) (bool, bool) {
-	lbName := types.NamespacedName{Name: lb.Name, Namespace: lb.Namespace}
-	occupiedPorts := a.lbToPorts[lbName]
-	if len(occupiedPorts) == 0 {
-		occupiedPorts = int32Set{}
+// DeassociatePorts removes frontend ip rules and network security group rules
+// of ports which are in oldSvc but not in newSvc
+func (a *AKS) DeassociatePorts(crName types.NamespacedName, oldSvc, newSvc *corev1.Service) error {
+	lbName, ok := a.GetLBName(crName)
+	if !ok {
+		return nil
+	}
+	removed := a.HeldPorts(crName, removedPorts(oldSvc, newSvc))
+	if len(removed.Spec.Ports) == 0 {
+		return nil
+	}
+	pip, lbSvc := a.getPIP(lbName), a.GetLB(lbName)
+	if pip != nil && lbSvc != nil {
+		if err := a.reconcileRules(removed, lbSvc, false /* delete */); err != nil {
+			return err
+		}
+	}
+	log.WithName("aks").Info("DeassociatePorts", "cr", crName, "lb", lbName, "ports", portNumbers(removed))
+	return nil
+}
+
+// CompleteMigration removes frontend ip rules and network security group
+// rules of crName from the LB it's being moved from
+func (a *AKS) CompleteMigration(crName types.NamespacedName) error {
+	lbName, held, ok := a.GetMigration(crName)
+	if !ok {
+		return nil
 	}
-	portUpdated := updatePort(svc, lb, occupiedPorts)
+	pip, lbSvc := a.getPIP(lbName), a.GetLB(lbName)
+	if pip != nil && lbSvc != nil && len(held.Spec.Ports) > 0 {
+		if err := a.reconcileRules(held, lbSvc, false /* delete */); err != nil {
+			return err
+		}
+	}
+	a.EndMigration(crName)
+	return nil
+}
+
+func (a *AKS) UpdateService(svc, lb *corev1.Service) (bool, bool) {
+	portUpdated := a.AssignPorts(svc, lb)
 	// don't need to update externalIP
 	return portUpdated, false
 }
 
+func (a *AKS) getPIP(lbName types.NamespacedName) *network.PublicIPAddress {
+	a.cachePIPLock.RLock()
+	defer a.cachePIPLock.RUnlock()
+	return a.cachePIPMap[lbName]
+}
+
+// reconcileRules reconciles LB rules and then NSG rules of clusterSvc
+func (a *AKS) reconcileRules(clusterSvc, lbSvc *corev1.Service, wantCreate bool) error {
+	a.azureLock.Lock()
+	defer a.azureLock.Unlock()
+	// verb is used to compose event reasons, e.g. "ListenersCreated" and "CreateListenersFailed"
+	verb, svcName := "Create", GetNamespacedName(clusterSvc)
+	if !wantCreate {
+		verb = "Delete"
+	}
+	executed, err := a.reconcileLBRules(clusterSvc, lbSvc, wantCreate)
+	if err != nil {
+		a.Eventf(lbSvc, corev1.EventTypeWarning, verb+"ListenersFailed", "Failed to %s LB rules for %s: %v", strings.ToLower(verb), svcName, err)
+		return &AssociationError{Step: StepListeners, Err: err}
+	}
+	if executed {
+		a.Eventf(lbSvc, corev1.EventTypeNormal, "Listeners"+verb+"d", "%sd LB rules for %s", verb, svcName)
+		if err := a.reconcileSGRules(clusterSvc, lbSvc, wantCreate); err != nil {
+			a.Eventf(lbSvc, corev1.EventTypeWarning, verb+"FirewallRulesFailed", "Failed to %s NSG rules for %s: %v", strings.ToLower(verb), svcName, err)
+			return &AssociationError{Step: StepFirewall, Err: err}
+		}
+		a.Eventf(lbSvc, corev1.EventTypeNormal, "FirewallRules"+verb+"d", "%sd NSG rules for %s", verb, svcName)
+	}
+	return nil
+}
+
 func (a *AKS) getDefaultAzureLB() (*network.LoadBalancer, error) {
-	azureLB, err := a.lbClient.Get(context.TODO(), a.resGrpName, azureDefaultLBName, "")
+	azureLB, err := a.lbClient.Get(context.TODO(), a.resGrpName, a.lbName, "")
+	metrics.ObserveCloudCall("aks", "LoadBalancersGet", err)
 	if err != nil {
 		return nil, err
 	}
@@ -290,7 +334,8 @@ func (a *AKS) queryPublicIP(pipName string, lbSvc *corev1.Service) (*network.Pub
 	}
 
 	lbFrontendIPConfigName := cloudprovider.DefaultLoadBalancerName(lbSvc)
-	publicIP, err := a.pipClient.Get(context.TODO(), a.resGrpName, fmt.Sprintf("%s-%s", azureDefaultLBName, lbFrontendIPConfigName), "")
+	publicIP, err := a.pipClient.Get(context.TODO(), a.resGrpName, fmt.Sprintf("%s-%s", a.lbName, lbFrontendIPConfigName), "")
+	metrics.ObserveCloudCall("aks", "PublicIPAddressesGet", err)
 	return &publicIP, err
 }
 
@@ -305,7 +350,7 @@ func (a *AKS) reconcileLBRules(clusterSvc, lbSvc *corev1.Service, wantCreate boo
 	lbFrontendIPConfigName := cloudprovider.DefaultLoadBalancerName(lbSvc)
 	lbFrontendIPConfigID := a.getFrontendIPConfigID(*azureLB.Name, lbFrontendIPConfigName)
 	// TODO(Huang-Wei): in AKS cloud provider code, it's using `clusterName`
-	lbBackendPoolName := azureDefaultLBName
+	lbBackendPoolName := a.lbName
 	lbBackendPoolID := a.getBackendPoolID(*azureLB.Name, lbBackendPoolName)
 
 	// reconcile loadbalancing rules
@@ -356,11 +401,13 @@ func (a *AKS) reconcileLBRules(clusterSvc, lbSvc *corev1.Service, wantCreate boo
 	// create or update LB
 	azureLB.LoadBalancingRules = &updatedLBRules
 	_, err = a.lbClient.CreateOrUpdate(context.TODO(), a.resGrpName, *azureLB.Name, *azureLB)
+	metrics.ObserveCloudCall("aks", "LoadBalancersCreateOrUpdate", err)
 	return true, err
 }
 
 func (a *AKS) reconcileSGRules(clusterSvc, lbSvc *corev1.Service, wantCreate bool) error {
 	sg, err := a.sgClient.Get(context.TODO(), a.resGrpName, a.sgName, "")
+	metrics.ObserveCloudCall("aks", "SecurityGroupsGet", err)
 	if err != nil {
 		return err
 	}
@@ -421,6 +468,7 @@ func (a *AKS) reconcileSGRules(clusterSvc, lbSvc *corev1.Service, wantCreate boo
 	// create or update SG
 	sg.SecurityRules = &updatedSGRules
 	_, err = a.sgClient.CreateOrUpdate(context.TODO(), a.resGrpName, a.sgName, sg)
+	metrics.ObserveCloudCall("aks", "SecurityGroupsCreateOrUpdate", err)
 	return err
 }
 
@@ -0,0 +1,499 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+// Allocator owns the bookkeeping shared by all providers, i.e. LB inventory,
+// capacity of each LB and ports occupied on it. A provider, in tree or not, is
+// expected to embed an Allocator and only add its IaaS specific hooks, like ELB
+// listeners or Azure LB rules.
+// All methods of Allocator are safe for concurrent use.
+type Allocator struct {
+	// name is the provider name, used for logging
+	name string
+
+	// lock protects all maps below
+	lock sync.RWMutex
+
+	// key is namespacedName of a LB Serivce, val is the service
+	cacheMap map[types.NamespacedName]*corev1.Service
+
+	// cr to LB is 1:1 mapping
+	crToLB map[types.NamespacedName]types.NamespacedName
+	// lb to CRD is 1:N mapping
+	lbToCRs map[types.NamespacedName]nameSet
+	// lbToPorts is keyed with ns/name of a LB, and valued with ports info it holds
+	lbToPorts map[types.NamespacedName]portSet
+	// crToPorts is keyed with ns/name of a cr, and valued with ports it holds on its LB
+	crToPorts map[types.NamespacedName]portSet
+	// migrations is keyed with ns/name of a cr being moved to another LB
+	migrations map[types.NamespacedName]migration
+
+	capacityPerLB int
+	// protocols are the protocols LBs of the provider can carry
+	protocols []corev1.Protocol
+
+	// recorder emits events on LB Services, it's nil until injected
+	recorder record.EventRecorder
+}
+
+// LBUsage describes a LB in inventory
+type LBUsage struct {
+	Name types.NamespacedName
+	// Pool is name of the SharedLBPool the LB belongs to
+	Pool string
+	// Tenants is the number of SharedLBs placed (or reserved) on the LB
+	Tenants int
+	// Ports is the number of ports occupied on the LB
+	Ports int
+	// Ready tells whether the LB has got its ingress info
+	Ready bool
+}
+
+// NewAllocator creates an Allocator for the provider name, whose LBs can carry ports
+// of protocols; they default to TCP and UDP if none is given
+func NewAllocator(name string, protocols ...corev1.Protocol) *Allocator {
+	if len(protocols) == 0 {
+		protocols = []corev1.Protocol{corev1.ProtocolTCP, corev1.ProtocolUDP}
+	}
+	return &Allocator{
+		name:          name,
+		cacheMap:      make(map[types.NamespacedName]*corev1.Service),
+		crToLB:        make(map[types.NamespacedName]types.NamespacedName),
+		lbToCRs:       make(map[types.NamespacedName]nameSet),
+		lbToPorts:     make(map[types.NamespacedName]portSet),
+		crToPorts:     make(map[types.NamespacedName]portSet),
+		migrations:    make(map[types.NamespacedName]migration),
+		capacityPerLB: capacity,
+		protocols:     protocols,
+	}
+}
+
+// InjectRecorder implements RecorderInjector
+func (a *Allocator) InjectRecorder(recorder record.EventRecorder) {
+	a.recorder = recorder
+}
+
+// Eventf emits an event on lb, if a recorder is injected and lb is known
+func (a *Allocator) Eventf(lb *corev1.Service, eventtype, reason, messageFmt string, args ...interface{}) {
+	if a.recorder == nil || lb == nil {
+		return
+	}
+	a.recorder.Eventf(lb, eventtype, reason, messageFmt, args...)
+}
+
+func (a *Allocator) GetCapacityPerLB() int {
+	return a.capacityPerLB
+}
+
+// UpdateCache adds/updates a LB Service in inventory, or removes it if lbSvc is nil
+func (a *Allocator) UpdateCache(key types.NamespacedName, lbSvc *corev1.Service) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if lbSvc == nil {
+		delete(a.cacheMap, key)
+	} else {
+		a.cacheMap[key] = lbSvc
+	}
+}
+
+// GetAvailabelLB picks a LB in the placement's pool which has a free slot and no port
+// conflict with clusterSvc per strategy, and reserves the slot along with ports for crName
+// in one shot, so that concurrent callers won't get the same slot or port. Ports of
+// clusterSvc which are left as 0 are assigned as well. The reservation is confirmed by
+// AssociateLB, or should be released by CancelReservation if it's not going to be used.
+//
+// In flexible mode, a LB on which ports of clusterSvc are taken is picked if there is no
+// LB without conflict, and the ports taken are replaced by free ones. In strict mode, a
+// *PortConflictError is returned if the ports are taken on every LB with a free slot.
+// A *PortRangeExhaustedError is returned if ports left as 0 can't fit into the port range
+// even on an empty LB, or an *UnsupportedProtocolError if the provider can't carry a port
+// of clusterSvc. It returns nil if a new LB is needed.
+func (a *Allocator) GetAvailabelLB(crName types.NamespacedName, clusterSvc *corev1.Service, placement Placement) (*corev1.Service, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// it's been reserved by an earlier call
+	if lbKey, ok := a.crToLB[crName]; ok {
+		if lbSvc, ok := a.cacheMap[lbKey]; ok {
+			return lbSvc, nil
+		}
+	}
+
+	capacity := a.capacityPerLB
+	if placement.Capacity > 0 {
+		capacity = placement.Capacity
+	}
+	if err := checkProtocols(a.name, clusterSvc, a.protocols); err != nil {
+		return nil, err
+	}
+	min, max := placement.portRange()
+	if !hasFreePorts(clusterSvc, nil, min, max) {
+		return nil, &PortRangeExhaustedError{Min: min, Max: max}
+	}
+
+	// candidates take ports of clusterSvc as they are, reassigning ones take them
+	// after the ports taken are replaced
+	var candidates, reassigning []types.NamespacedName
+	fitted := make(map[types.NamespacedName]*corev1.Service)
+	conflicts := make(portSet)
+	for lbKey, lbSvc := range a.cacheMap {
+		if !placement.matches(lbSvc) || !placement.pinnedTo(lbSvc) || len(a.lbToCRs[lbKey]) >= capacity || len(lbSvc.Status.LoadBalancer.Ingress) == 0 {
+			continue
+		}
+		// must satisfy that all svc ports are not occupied in lbSvc
+		svc, lbConflicts := dropConflicts(clusterSvc, a.lbToPorts[lbKey])
+		if len(lbConflicts) > 0 {
+			log.WithName(a.name).Info(fmt.Sprintf("incoming service has port conflict with lbSvc %q on ports %v", lbKey, lbConflicts))
+			for _, key := range lbConflicts {
+				conflicts[key] = struct{}{}
+			}
+			if !placement.Flexible {
+				continue
+			}
+		}
+		if !hasFreePorts(svc, a.lbToPorts[lbKey], min, max) {
+			log.WithName(a.name).Info(fmt.Sprintf("no free port left in range [%d, %d) of lbSvc %q", min, max, lbKey))
+			continue
+		}
+		fitted[lbKey] = svc
+		if len(lbConflicts) == 0 {
+			candidates = append(candidates, lbKey)
+		} else {
+			reassigning = append(reassigning, lbKey)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = reassigning
+	}
+	if len(candidates) == 0 {
+		if len(conflicts) > 0 && !placement.Flexible {
+			ports := make([]PortKey, 0, len(conflicts))
+			for key := range conflicts {
+				ports = append(ports, key)
+			}
+			sort.Slice(ports, func(i, j int) bool {
+				if ports[i].Port == ports[j].Port {
+					return ports[i].Protocol < ports[j].Protocol
+				}
+				return ports[i].Port < ports[j].Port
+			})
+			return nil, &PortConflictError{Ports: ports}
+		}
+		return nil, nil
+	}
+
+	strategy := placement.Strategy
+	if strategy == "" {
+		strategy = Strategy(defaultStrategy)
+	}
+	lbKey := pickLB(strategy, crName, candidates, func(lbName types.NamespacedName) int {
+		return len(a.lbToCRs[lbName])
+	})
+	lbSvc := a.cacheMap[lbKey]
+	if a.lbToPorts[lbKey] == nil {
+		a.lbToPorts[lbKey] = portSet{}
+	}
+	// it won't fail as free ports have been checked
+	updatePort(fitted[lbKey], a.lbToPorts[lbKey], min, max)
+	setPortNumbers(clusterSvc, fitted[lbKey])
+	a.associate(crName, lbKey, clusterSvc)
+	return lbSvc, nil
+}
+
+// LookupLB returns the LB a pinned placement refers to, by name or by ingress IP
+func (a *Allocator) LookupLB(placement Placement) (types.NamespacedName, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if placement.LB.Name != "" {
+		_, ok := a.cacheMap[placement.LB]
+		return placement.LB, ok
+	}
+	for lbKey, lbSvc := range a.cacheMap {
+		if placement.IP != "" && hasIngress(lbSvc, placement.IP) {
+			return lbKey, true
+		}
+	}
+	return types.NamespacedName{}, false
+}
+
+// ReserveLB reserves a slot along with ports of clusterSvc on lbName for crName, like
+// GetAvailabelLB does, but fails with a *PortConflictError or *LBUnavailableError telling
+// why lbName can't take crName; it's used for a SharedLB pinned to lbName
+func (a *Allocator) ReserveLB(crName, lbName types.NamespacedName, clusterSvc *corev1.Service, placement Placement) (*corev1.Service, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	// it's been reserved by an earlier call
+	if lbKey, ok := a.crToLB[crName]; ok {
+		if lbKey != lbName {
+			return nil, fmt.Errorf("%s is placed onto %s", crName, lbKey)
+		}
+		if lbSvc, ok := a.cacheMap[lbKey]; ok {
+			return lbSvc, nil
+		}
+	}
+	svc, err := a.checkLB(crName, lbName, clusterSvc, placement)
+	if err != nil {
+		return nil, err
+	}
+	if a.lbToPorts[lbName] == nil {
+		a.lbToPorts[lbName] = portSet{}
+	}
+	min, max := placement.portRange()
+	// it won't fail as free ports have been checked
+	updatePort(svc, a.lbToPorts[lbName], min, max)
+	setPortNumbers(clusterSvc, svc)
+	a.associate(crName, lbName, clusterSvc)
+	return a.cacheMap[lbName], nil
+}
+
+// hasFreePorts tells whether there are enough ports left in range [min, max)
+// for ports of svc which are left as 0; ports of each protocol are counted apart
+func hasFreePorts(svc *corev1.Service, occupiedPorts portSet, min, max int32) bool {
+	wanted := make(map[corev1.Protocol]int)
+	occupied := make(portSet)
+	for key := range occupiedPorts {
+		if key.Port >= min && key.Port < max {
+			occupied[key] = struct{}{}
+		}
+	}
+	for _, svcPort := range svc.Spec.Ports {
+		key := PortKeyOf(svcPort)
+		if key.Port == 0 {
+			wanted[key.Protocol]++
+		} else if key.Port >= min && key.Port < max {
+			occupied[key] = struct{}{}
+		}
+	}
+	for protocol, n := range wanted {
+		if int(max-min)-len(occupied.numbers(protocol)) < n {
+			return false
+		}
+	}
+	return true
+}
+
+// ListLBs returns usage of all LBs in inventory
+func (a *Allocator) ListLBs() []LBUsage {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	usages := make([]LBUsage, 0, len(a.cacheMap))
+	for lbName, lbSvc := range a.cacheMap {
+		usages = append(usages, LBUsage{
+			Name:    lbName,
+			Pool:    lbSvc.Labels[PoolLabel],
+			Tenants: len(a.lbToCRs[lbName]),
+			Ports:   len(a.lbToPorts[lbName]),
+			Ready:   len(lbSvc.Status.LoadBalancer.Ingress) > 0,
+		})
+	}
+	return usages
+}
+
+// ReclaimLB removes lbName from inventory if it holds no tenant, so that it won't be
+// picked by GetAvailabelLB any more. It returns false if lbName is not empty, or not
+// in inventory.
+func (a *Allocator) ReclaimLB(lbName types.NamespacedName) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.cacheMap[lbName]; !ok || len(a.lbToCRs[lbName]) > 0 {
+		return false
+	}
+	delete(a.cacheMap, lbName)
+	delete(a.lbToCRs, lbName)
+	delete(a.lbToPorts, lbName)
+	return true
+}
+
+// CancelReservation releases the slot and ports reserved by GetAvailabelLB
+func (a *Allocator) CancelReservation(crName types.NamespacedName, clusterSvc *corev1.Service) {
+	if lbName, ok := a.RemoveAssociation(crName, clusterSvc); ok {
+		log.WithName(a.name).Info("CancelReservation", "cr", crName, "lb", lbName)
+	}
+}
+
+// RestoreAssociation only updates internal cache, it's called by AssociateLB of
+// each provider after IaaS things are done
+func (a *Allocator) RestoreAssociation(crName, lbName types.NamespacedName, clusterSvc *corev1.Service) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.associate(crName, lbName, clusterSvc)
+}
+
+// associate must be called with a.lock held
+func (a *Allocator) associate(crName, lbName types.NamespacedName, clusterSvc *corev1.Service) {
+	// a reservation may be moved to another LB, or ports of crName may be changed;
+	// either way ports held by crName before are released
+	if oldLB, ok := a.crToLB[crName]; ok && (oldLB != lbName || clusterSvc != nil) {
+		delete(a.lbToCRs[oldLB], crName)
+		for key := range a.crToPorts[crName] {
+			delete(a.lbToPorts[oldLB], key)
+		}
+		delete(a.crToPorts, crName)
+	}
+	if clusterSvc != nil {
+		// upon program starts, a.lbToPorts[lbName] can be nil
+		if a.lbToPorts[lbName] == nil {
+			a.lbToPorts[lbName] = portSet{}
+		}
+		ports := make(portSet, len(clusterSvc.Spec.Ports))
+		for _, svcPort := range clusterSvc.Spec.Ports {
+			a.lbToPorts[lbName][PortKeyOf(svcPort)] = struct{}{}
+			ports[PortKeyOf(svcPort)] = struct{}{}
+		}
+		a.crToPorts[crName] = ports
+	}
+
+	// following code might be called multiple times, but shouldn't impact
+	// performance a lot as all of them are O(1) operation
+	_, ok := a.lbToCRs[lbName]
+	if !ok {
+		a.lbToCRs[lbName] = make(nameSet)
+	}
+	a.lbToCRs[lbName][crName] = struct{}{}
+	a.crToLB[crName] = lbName
+}
+
+// RemoveAssociation releases the slot and ports taken by crName,
+// it returns the LB crName was associated with
+func (a *Allocator) RemoveAssociation(crName types.NamespacedName, clusterSvc *corev1.Service) (types.NamespacedName, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	lbName, ok := a.crToLB[crName]
+	if !ok {
+		return lbName, false
+	}
+	delete(a.crToLB, crName)
+	delete(a.lbToCRs[lbName], crName)
+	if ports, ok := a.crToPorts[crName]; ok {
+		for key := range ports {
+			delete(a.lbToPorts[lbName], key)
+		}
+		delete(a.crToPorts, crName)
+	} else if clusterSvc != nil {
+		for _, svcPort := range clusterSvc.Spec.Ports {
+			delete(a.lbToPorts[lbName], PortKeyOf(svcPort))
+		}
+	}
+	return lbName, true
+}
+
+// ReservePorts swaps ports held by crName on its LB with the ones of clusterSvc, in one
+// shot. Ports of clusterSvc which are left as 0 are assigned in the placement's port range.
+// A *PortConflictError is returned if any port is held by another tenant of the LB, unless
+// it can be replaced in flexible mode, a *PortRangeExhaustedError if the range runs out, or
+// an *UnsupportedProtocolError; nothing is changed in any case.
+func (a *Allocator) ReservePorts(crName types.NamespacedName, clusterSvc *corev1.Service, placement Placement) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	lbName, ok := a.crToLB[crName]
+	if !ok {
+		return fmt.Errorf("%s is not placed onto any LB", crName)
+	}
+	if err := checkProtocols(a.name, clusterSvc, a.protocols); err != nil {
+		return err
+	}
+	// ports held by other tenants
+	occupied := make(portSet)
+	for key := range a.lbToPorts[lbName] {
+		if _, own := a.crToPorts[crName][key]; !own {
+			occupied[key] = struct{}{}
+		}
+	}
+	svc, conflicts := dropConflicts(clusterSvc, occupied)
+	if len(conflicts) > 0 && !placement.Flexible {
+		return &PortConflictError{LB: lbName, Ports: conflicts}
+	}
+	min, max := placement.portRange()
+	if _, err := updatePort(svc, occupied, min, max); err != nil {
+		if exhausted, ok := err.(*PortRangeExhaustedError); ok {
+			exhausted.LB = lbName
+		}
+		return err
+	}
+	setPortNumbers(clusterSvc, svc)
+	a.associate(crName, lbName, clusterSvc)
+	return nil
+}
+
+// HeldPorts returns a copy of svc only carrying ports held by crName, so that
+// ports of other tenants are never touched
+func (a *Allocator) HeldPorts(crName types.NamespacedName, svc *corev1.Service) *corev1.Service {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	held := svc.DeepCopy()
+	held.Spec.Ports = nil
+	for _, svcPort := range svc.Spec.Ports {
+		if _, ok := a.crToPorts[crName][PortKeyOf(svcPort)]; ok {
+			held.Spec.Ports = append(held.Spec.Ports, svcPort)
+		}
+	}
+	return held
+}
+
+// DeassociatePorts is a no-op for providers which don't configure anything per port
+func (a *Allocator) DeassociatePorts(crName types.NamespacedName, oldSvc, newSvc *corev1.Service) error {
+	return nil
+}
+
+// GetLBName returns the LB crName is associated with
+func (a *Allocator) GetLBName(crName types.NamespacedName) (types.NamespacedName, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	lbName, ok := a.crToLB[crName]
+	return lbName, ok
+}
+
+// GetLB returns the LB Service in inventory
+func (a *Allocator) GetLB(lbName types.NamespacedName) *corev1.Service {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.cacheMap[lbName]
+}
+
+// IsLBReady tells whether the LB Service has got its ingress info
+func (a *Allocator) IsLBReady(lbName types.NamespacedName) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	lbSvc, ok := a.cacheMap[lbName]
+	return ok && len(lbSvc.Status.LoadBalancer.Ingress) > 0
+}
+
+// AssignPorts fills in ports of svc which are left as 0,
+// with ones not occupied in lb
+func (a *Allocator) AssignPorts(svc, lb *corev1.Service) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	lbName := GetNamespacedName(lb)
+	if a.lbToPorts[lbName] == nil {
+		a.lbToPorts[lbName] = portSet{}
+	}
+	updated, err := updatePort(svc, a.lbToPorts[lbName], minPort, maxPort)
+	if err != nil {
+		log.WithName(a.name).Error(err, "fail to assign ports", "lb", lbName)
+	}
+	return updated
+}
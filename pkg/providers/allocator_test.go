@@ -0,0 +1,424 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+func newTestLBService(name string, ready bool) *corev1.Service {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+	}
+	if ready {
+		svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "1.2.3.4"}}
+	}
+	return svc
+}
+
+func newTestClusterService(ports ...int32) *corev1.Service {
+	svc := &corev1.Service{}
+	for _, p := range ports {
+		svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{Port: p})
+	}
+	return svc
+}
+
+func TestAllocatorGetAvailableLB(t *testing.T) {
+	lb1 := types.NamespacedName{Name: "lb-1", Namespace: "default"}
+	tests := []struct {
+		name       string
+		lbSvc      *corev1.Service
+		tenants    map[string][]int32
+		clusterSvc *corev1.Service
+		want       bool
+	}{
+		{
+			name:       "LB is not ready",
+			lbSvc:      newTestLBService("lb-1", false),
+			clusterSvc: newTestClusterService(80),
+			want:       false,
+		},
+		{
+			name:       "LB is empty",
+			lbSvc:      newTestLBService("lb-1", true),
+			clusterSvc: newTestClusterService(80),
+			want:       true,
+		},
+		{
+			name:       "LB has port conflict",
+			lbSvc:      newTestLBService("lb-1", true),
+			tenants:    map[string][]int32{"cr1": {80}},
+			clusterSvc: newTestClusterService(81, 80),
+			want:       false,
+		},
+		{
+			name:       "LB is full",
+			lbSvc:      newTestLBService("lb-1", true),
+			tenants:    map[string][]int32{"cr1": {80}, "cr2": {81}},
+			clusterSvc: newTestClusterService(82),
+			want:       false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAllocator("test")
+			a.capacityPerLB = 2
+			a.UpdateCache(lb1, tt.lbSvc)
+			for cr, ports := range tt.tenants {
+				a.RestoreAssociation(types.NamespacedName{Name: cr, Namespace: "default"}, lb1, newTestClusterService(ports...))
+			}
+			cr := types.NamespacedName{Name: "cr", Namespace: "default"}
+			if got, _ := a.GetAvailabelLB(cr, tt.clusterSvc, Placement{}); (got != nil) != tt.want {
+				t.Errorf("GetAvailabelLB() = %v, want available %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocatorRemoveAssociation(t *testing.T) {
+	a := NewAllocator("test")
+	a.capacityPerLB = 1
+	lb1 := types.NamespacedName{Name: "lb-1", Namespace: "default"}
+	cr1 := types.NamespacedName{Name: "cr1", Namespace: "default"}
+	cr2 := types.NamespacedName{Name: "cr2", Namespace: "default"}
+	a.UpdateCache(lb1, newTestLBService("lb-1", true))
+	a.RestoreAssociation(cr1, lb1, newTestClusterService(80))
+	if got, _ := a.GetAvailabelLB(cr2, newTestClusterService(81), Placement{}); got != nil {
+		t.Fatalf("GetAvailabelLB() = %v, want nil as LB is full", got)
+	}
+
+	if got, ok := a.RemoveAssociation(cr1, newTestClusterService(80)); !ok || got != lb1 {
+		t.Errorf("RemoveAssociation() = %v, %v, want %v, true", got, ok, lb1)
+	}
+	if _, ok := a.RemoveAssociation(cr1, newTestClusterService(80)); ok {
+		t.Errorf("RemoveAssociation() is expected to be a no-op for the 2nd time")
+	}
+	if got, _ := a.GetAvailabelLB(cr2, newTestClusterService(80), Placement{}); got == nil {
+		t.Errorf("GetAvailabelLB() = nil, want %v as slot and port are released", lb1)
+	}
+	a.CancelReservation(cr2, newTestClusterService(80))
+
+	// a deleted LB is removed from inventory
+	a.UpdateCache(lb1, nil)
+	if got, _ := a.GetAvailabelLB(cr2, newTestClusterService(80), Placement{}); got != nil {
+		t.Errorf("GetAvailabelLB() = %v, want nil as LB is deleted", got)
+	}
+}
+
+func TestAllocatorConcurrentReservation(t *testing.T) {
+	a := NewAllocator("test")
+	a.capacityPerLB = 5
+	for i := 0; i < 4; i++ {
+		lbName := fmt.Sprintf("lb-%d", i)
+		a.UpdateCache(types.NamespacedName{Name: lbName, Namespace: "default"}, newTestLBService(lbName, true))
+	}
+
+	// 40 tenants compete for 20 slots, half of them ask for port 80
+	var wg sync.WaitGroup
+	svcs := make([]*corev1.Service, 40)
+	lbs := make([]*corev1.Service, 40)
+	for i := range svcs {
+		if i%2 == 0 {
+			svcs[i] = newTestClusterService(80)
+		} else {
+			svcs[i] = newTestClusterService(0)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cr := types.NamespacedName{Name: fmt.Sprintf("cr%d", i), Namespace: "default"}
+			lbs[i], _ = a.GetAvailabelLB(cr, svcs[i], Placement{})
+		}(i)
+	}
+	wg.Wait()
+
+	tenants := map[string]int{}
+	ports := map[string]map[int32]struct{}{}
+	for i, lb := range lbs {
+		if lb == nil {
+			continue
+		}
+		tenants[lb.Name]++
+		if ports[lb.Name] == nil {
+			ports[lb.Name] = map[int32]struct{}{}
+		}
+		port := svcs[i].Spec.Ports[0].Port
+		if _, ok := ports[lb.Name][port]; ok {
+			t.Errorf("port %d is reserved more than once on %s", port, lb.Name)
+		}
+		ports[lb.Name][port] = struct{}{}
+	}
+	total := 0
+	for lbName, n := range tenants {
+		if n > a.capacityPerLB {
+			t.Errorf("%s has %d tenants, exceeding capacity %d", lbName, n, a.capacityPerLB)
+		}
+		total += n
+	}
+	// every slot is taken, as there are enough tenants w/o a fixed port
+	if total != 20 {
+		t.Errorf("%d tenants are placed, want 20", total)
+	}
+}
+
+func TestAllocatorReclaimLB(t *testing.T) {
+	a := newTestAllocator(2, "lb-1", "lb-2")
+	lb1 := types.NamespacedName{Name: "lb-1", Namespace: "default"}
+	lb2 := types.NamespacedName{Name: "lb-2", Namespace: "default"}
+	a.RestoreAssociation(types.NamespacedName{Name: "cr1", Namespace: "default"}, lb1, newTestClusterService(80))
+
+	if a.ReclaimLB(lb1) {
+		t.Errorf("ReclaimLB() = true, want false as %v holds a tenant", lb1)
+	}
+	if !a.ReclaimLB(lb2) {
+		t.Errorf("ReclaimLB() = false, want true as %v is empty", lb2)
+	}
+	if a.ReclaimLB(lb2) {
+		t.Errorf("ReclaimLB() = true, want false as %v is not in inventory", lb2)
+	}
+	usages := a.ListLBs()
+	if len(usages) != 1 || usages[0].Name != lb1 || usages[0].Tenants != 1 || usages[0].Ports != 1 || !usages[0].Ready {
+		t.Errorf("ListLBs() = %v, want only %v with 1 tenant on 1 port", usages, lb1)
+	}
+	// a reclaimed LB is never picked
+	for i := 0; i < 2; i++ {
+		lbSvc, _ := a.GetAvailabelLB(types.NamespacedName{Name: fmt.Sprintf("cr%d", i+2), Namespace: "default"}, newTestClusterService(0), Placement{})
+		if lbSvc != nil && lbSvc.Name == "lb-2" {
+			t.Errorf("GetAvailabelLB() = %v, want a LB other than the reclaimed one", lbSvc.Name)
+		}
+	}
+}
+
+func TestAllocatorEvents(t *testing.T) {
+	a := newTestAllocator(2, "lb-1")
+	lbSvc := a.GetLB(types.NamespacedName{Name: "lb-1", Namespace: "default"})
+	// no recorder is injected yet
+	a.Eventf(lbSvc, corev1.EventTypeNormal, "ListenersCreated", "Created listeners for %s", "default/foo-service")
+
+	recorder := record.NewFakeRecorder(10)
+	var injector RecorderInjector = a
+	injector.InjectRecorder(recorder)
+	a.Eventf(nil, corev1.EventTypeNormal, "ListenersCreated", "Created listeners for %s", "default/foo-service")
+	a.Eventf(lbSvc, corev1.EventTypeWarning, "CreateListenersFailed", "Failed to create listeners for %s: %v", "default/foo-service", "throttled")
+
+	want := "Warning CreateListenersFailed Failed to create listeners for default/foo-service: throttled"
+	if len(recorder.Events) != 1 {
+		t.Fatalf("got %d events, want 1", len(recorder.Events))
+	}
+	if got := <-recorder.Events; got != want {
+		t.Errorf("event = %q, want %q", got, want)
+	}
+}
+
+func TestAllocatorReservePorts(t *testing.T) {
+	a := newTestAllocator(2, "lb-1")
+	lb1 := types.NamespacedName{Name: "lb-1", Namespace: "default"}
+	cr1 := types.NamespacedName{Name: "cr1", Namespace: "default"}
+	cr2 := types.NamespacedName{Name: "cr2", Namespace: "default"}
+	a.RestoreAssociation(cr1, lb1, newTestClusterService(80))
+	a.RestoreAssociation(cr2, lb1, newTestClusterService(81, 82))
+
+	// port 80 is held by cr1
+	err := a.ReservePorts(cr2, newTestClusterService(80, 81), Placement{})
+	if conflict, ok := err.(*PortConflictError); !ok || len(conflict.Ports) != 1 || conflict.Ports[0] != (PortKey{Protocol: corev1.ProtocolTCP, Port: 80}) {
+		t.Fatalf("ReservePorts() error = %v, want a conflict on port 80", err)
+	}
+	if got := a.HeldPorts(cr2, newTestClusterService(80, 81, 82)); !reflect.DeepEqual(portNumbers(got), []int32{81, 82}) {
+		t.Errorf("HeldPorts() = %v after a conflict, want [81 82] unchanged", portNumbers(got))
+	}
+
+	// swap port 82 with 83, and get a port assigned in range [1000, 1001)
+	clusterSvc := newTestClusterService(81, 83, 0)
+	if err := a.ReservePorts(cr2, clusterSvc, Placement{MinPort: 1000, MaxPort: 1000}); err != nil {
+		t.Fatalf("ReservePorts() error = %v", err)
+	}
+	if want := []int32{81, 83, 1000}; !reflect.DeepEqual(portNumbers(clusterSvc), want) {
+		t.Errorf("ReservePorts() assigned %v, want %v", portNumbers(clusterSvc), want)
+	}
+	if got := a.HeldPorts(cr2, newTestClusterService(80, 81, 82, 83, 1000)); !reflect.DeepEqual(portNumbers(got), []int32{81, 83, 1000}) {
+		t.Errorf("HeldPorts() = %v, want [81 83 1000]", portNumbers(got))
+	}
+	// port 82 is released, and can be taken by cr1
+	if err := a.ReservePorts(cr1, newTestClusterService(80, 82), Placement{}); err != nil {
+		t.Errorf("ReservePorts() error = %v, want port 82 to be released", err)
+	}
+
+	if err := a.ReservePorts(types.NamespacedName{Name: "cr3", Namespace: "default"}, newTestClusterService(84), Placement{}); err == nil {
+		t.Errorf("ReservePorts() expected an error for a cr not placed")
+	}
+}
+
+func TestAllocatorPortModes(t *testing.T) {
+	a := newTestAllocator(3, "lb-1", "lb-2")
+	for i, lbName := range []string{"lb-1", "lb-2"} {
+		cr := types.NamespacedName{Name: fmt.Sprintf("cr%d", i), Namespace: "default"}
+		a.RestoreAssociation(cr, types.NamespacedName{Name: lbName, Namespace: "default"}, newTestClusterService(80))
+	}
+
+	// port 80 is taken on every LB, and a new LB won't be asked for
+	strict := types.NamespacedName{Name: "strict", Namespace: "default"}
+	lbSvc, err := a.GetAvailabelLB(strict, newTestClusterService(80, 81), Placement{})
+	if conflict, ok := err.(*PortConflictError); !ok || lbSvc != nil || !reflect.DeepEqual(conflict.Ports, []PortKey{{Protocol: corev1.ProtocolTCP, Port: 80}}) {
+		t.Fatalf("GetAvailabelLB() = %v, %v, want a conflict on port 80", lbSvc, err)
+	}
+
+	// port 80 is replaced by one in the port range
+	flexible := types.NamespacedName{Name: "flexible", Namespace: "default"}
+	clusterSvc := newTestClusterService(80, 81)
+	lbSvc, err = a.GetAvailabelLB(flexible, clusterSvc, Placement{Flexible: true, MinPort: 2000, MaxPort: 2000})
+	if err != nil || lbSvc == nil {
+		t.Fatalf("GetAvailabelLB() = %v, %v, want a LB", lbSvc, err)
+	}
+	if want := []int32{2000, 81}; !reflect.DeepEqual(portNumbers(clusterSvc), want) {
+		t.Errorf("GetAvailabelLB() assigned %v, want %v", portNumbers(clusterSvc), want)
+	}
+
+	// the range runs out on every LB
+	other := types.NamespacedName{Name: "other", Namespace: "default"}
+	if err := a.ReservePorts(flexible, newTestClusterService(80, 0), Placement{Flexible: true, MinPort: 81, MaxPort: 81}); err == nil {
+		t.Errorf("ReservePorts() expected a *PortRangeExhaustedError")
+	} else if _, ok := err.(*PortRangeExhaustedError); !ok {
+		t.Errorf("ReservePorts() error = %v, want a *PortRangeExhaustedError", err)
+	}
+	if _, err := a.GetAvailabelLB(other, newTestClusterService(0, 0), Placement{MinPort: 3000, MaxPort: 3000}); err == nil {
+		t.Errorf("GetAvailabelLB() expected an error as 2 ports can't fit into range [3000, 3000]")
+	} else if _, ok := err.(*PortRangeExhaustedError); !ok {
+		t.Errorf("GetAvailabelLB() error = %v, want a *PortRangeExhaustedError", err)
+	}
+}
+
+func TestAllocatorProtocols(t *testing.T) {
+	a := newTestAllocator(2, "lb-1")
+	lb1 := types.NamespacedName{Name: "lb-1", Namespace: "default"}
+	a.RestoreAssociation(types.NamespacedName{Name: "tcp", Namespace: "default"}, lb1, newTestClusterService(53))
+
+	// UDP 53 is not taken by TCP 53
+	udp := newTestClusterService(53, 0)
+	udp.Spec.Ports[0].Protocol = corev1.ProtocolUDP
+	udp.Spec.Ports[1].Protocol = corev1.ProtocolUDP
+	cr := types.NamespacedName{Name: "udp", Namespace: "default"}
+	if lbSvc, err := a.GetAvailabelLB(cr, udp, Placement{MinPort: 53, MaxPort: 54}); err != nil || lbSvc == nil {
+		t.Fatalf("GetAvailabelLB() = %v, %v, want lb-1", lbSvc, err)
+	}
+	if got := udp.Spec.Ports[1].Port; got != 54 {
+		t.Errorf("GetAvailabelLB() assigned UDP port %d, want 54", got)
+	}
+	if got := len(a.lbToPorts[lb1]); got != 3 {
+		t.Errorf("lb-1 holds %d ports, want 3", got)
+	}
+
+	// a provider only carrying TCP rejects UDP
+	a.protocols = []corev1.Protocol{corev1.ProtocolTCP}
+	_, err := a.GetAvailabelLB(types.NamespacedName{Name: "other", Namespace: "default"}, udp, Placement{})
+	if unsupported, ok := err.(*UnsupportedProtocolError); !ok || unsupported.Port != (PortKey{Protocol: corev1.ProtocolUDP, Port: 53}) {
+		t.Errorf("GetAvailabelLB() error = %v, want 53/UDP to be unsupported", err)
+	}
+	if err := a.ReservePorts(cr, udp, Placement{}); err == nil {
+		t.Errorf("ReservePorts() expected an *UnsupportedProtocolError")
+	}
+}
+
+func TestRemovedPorts(t *testing.T) {
+	oldSvc := newTestClusterService(80, 81, 82)
+	oldSvc.Spec.Ports[1].Protocol = corev1.ProtocolUDP
+	newSvc := newTestClusterService(80, 81, 83)
+	if got := portNumbers(removedPorts(oldSvc, newSvc)); !reflect.DeepEqual(got, []int32{81, 82}) {
+		t.Errorf("removedPorts() = %v, want [81 82] as 81/UDP is changed to 81/TCP", got)
+	}
+	if got := removedPorts(oldSvc, oldSvc); len(got.Spec.Ports) != 0 {
+		t.Errorf("removedPorts() = %v, want none", portNumbers(got))
+	}
+	// the protocol is defaulted to TCP in one of them
+	tcp := newTestClusterService(80)
+	tcp.Spec.Ports[0].Protocol = corev1.ProtocolTCP
+	if got := removedPorts(tcp, newTestClusterService(80)); len(got.Spec.Ports) != 0 {
+		t.Errorf("removedPorts() = %v, want none as 80 is kept", portNumbers(got))
+	}
+	if got := removedPorts(newTestClusterService(80), tcp); len(got.Spec.Ports) != 0 {
+		t.Errorf("removedPorts() = %v, want none as 80 is kept", portNumbers(got))
+	}
+}
+
+func TestAllocatorReserveLB(t *testing.T) {
+	a := newTestAllocator(2, "lb-1", "lb-2")
+	lb1 := types.NamespacedName{Name: "lb-1", Namespace: "default"}
+	lb2 := types.NamespacedName{Name: "lb-2", Namespace: "default"}
+	a.cacheMap[lb2].Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "5.6.7.8"}}
+	a.RestoreAssociation(types.NamespacedName{Name: "cr1", Namespace: "default"}, lb2, newTestClusterService(80))
+
+	if got, ok := a.LookupLB(Placement{IP: "5.6.7.8"}); !ok || got != lb2 {
+		t.Errorf("LookupLB() = %v, %v, want %v", got, ok, lb2)
+	}
+	if _, ok := a.LookupLB(Placement{IP: "9.9.9.9"}); ok {
+		t.Errorf("LookupLB() = true, want false as no LB is exposed on the IP")
+	}
+	// the pinned LB is never picked for others
+	for i := 0; i < 5; i++ {
+		cr := types.NamespacedName{Name: fmt.Sprintf("cr-%d", i), Namespace: "default"}
+		if got, _ := a.GetAvailabelLB(cr, newTestClusterService(0), Placement{IP: "1.2.3.4"}); got == nil || got.Name != "lb-1" {
+			t.Fatalf("GetAvailabelLB() = %v, want lb-1 exposed on the pinned IP", got)
+		}
+		a.CancelReservation(cr, nil)
+	}
+
+	cr2 := types.NamespacedName{Name: "cr2", Namespace: "default"}
+	tests := []struct {
+		name       string
+		lb         types.NamespacedName
+		placement  Placement
+		ports      []int32
+		wantReason string
+	}{
+		{name: "port conflict", lb: lb2, ports: []int32{80}, wantReason: "PortConflict"},
+		{name: "IP mismatch", lb: lb2, placement: Placement{IP: "1.2.3.4"}, ports: []int32{81}, wantReason: "LBIPMismatch"},
+		{name: "not in pool", lb: lb2, placement: Placement{Pool: "gold"}, ports: []int32{81}, wantReason: "LBNotInPool"},
+		{name: "LB is full", lb: lb2, placement: Placement{Capacity: 1}, ports: []int32{81}, wantReason: "LBFull"},
+		{name: "reserved", lb: lb2, placement: Placement{IP: "5.6.7.8"}, ports: []int32{81}},
+		{name: "reserved again", lb: lb2, placement: Placement{IP: "5.6.7.8"}, ports: []int32{81}},
+		{name: "placed onto another LB", lb: lb1, ports: []int32{81}, wantReason: "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.ReserveLB(cr2, tt.lb, newTestClusterService(tt.ports...), tt.placement)
+			reason := ""
+			switch e := err.(type) {
+			case nil:
+			case *PortConflictError:
+				reason = "PortConflict"
+			case *LBUnavailableError:
+				reason = e.Reason
+			default:
+				reason = "error"
+			}
+			if reason != tt.wantReason {
+				t.Fatalf("ReserveLB() error = %v, want reason %q", err, tt.wantReason)
+			}
+			if err == nil && (got == nil || got.Name != tt.lb.Name) {
+				t.Errorf("ReserveLB() = %v, want %v", got, tt.lb)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/metrics"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+// Refs:
+// https://docs.aws.amazon.com/sdk-for-go/api/aws/session/
+// https://docs.aws.amazon.com/eks/latest/userguide/iam-roles-for-service-accounts.html
+
+// awsConfig tells how EKS providers talk to AWS, it's read from env variables
+type awsConfig struct {
+	// region is discovered from instance metadata if it's not set, neither in
+	// env variables nor in the shared config file
+	region string
+	// endpoint overrides endpoints of all services, e.g. the one of LocalStack
+	endpoint string
+	// serviceEndpoints overrides endpoints per service ID, e.g. "ec2"
+	serviceEndpoints map[string]string
+	// roleARN is assumed with the token in webIdentityTokenFile, e.g. for IRSA
+	roleARN              string
+	webIdentityTokenFile string
+	roleSessionName      string
+	// assumeRoles are assumed one after another, on top of the credentials above
+	assumeRoles []string
+}
+
+// awsConfigFromEnv reads awsConfig from env variables; names of standard ones are
+// kept, so that it works with IRSA and the AWS CLI settings as they are
+func awsConfigFromEnv() awsConfig {
+	cfg := awsConfig{
+		region:               GetEnvVal("AWS_REGION", GetEnvVal("AWS_DEFAULT_REGION", "")),
+		endpoint:             GetEnvVal("AWS_ENDPOINT_URL", ""),
+		serviceEndpoints:     make(map[string]string),
+		roleARN:              GetEnvVal("AWS_ROLE_ARN", ""),
+		webIdentityTokenFile: GetEnvVal("AWS_WEB_IDENTITY_TOKEN_FILE", ""),
+		roleSessionName:      GetEnvVal("AWS_ROLE_SESSION_NAME", "shared-loadbalancer"),
+	}
+	for envKey, service := range map[string]string{
+		"AWS_ENDPOINT_URL_EC2":                    endpoints.Ec2ServiceID,
+		"AWS_ENDPOINT_URL_ELASTIC_LOAD_BALANCING": endpoints.ElasticloadbalancingServiceID,
+		"AWS_ENDPOINT_URL_STS":                    endpoints.StsServiceID,
+	} {
+		if url := GetEnvVal(envKey, ""); url != "" {
+			cfg.serviceEndpoints[service] = url
+		}
+	}
+	for _, roleARN := range strings.Split(GetEnvVal("AWS_ASSUME_ROLE_ARNS", ""), ",") {
+		if roleARN = strings.TrimSpace(roleARN); roleARN != "" {
+			cfg.assumeRoles = append(cfg.assumeRoles, roleARN)
+		}
+	}
+	return cfg
+}
+
+// resolver returns an endpoints.Resolver honoring endpoints set in cfg,
+// and falling back to the default one
+func (cfg awsConfig) resolver() endpoints.Resolver {
+	return endpoints.ResolverFunc(func(service, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		url, ok := cfg.serviceEndpoints[service]
+		if !ok {
+			url = cfg.endpoint
+		}
+		if url == "" {
+			return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+		}
+		return endpoints.ResolvedEndpoint{URL: url, SigningRegion: region}, nil
+	})
+}
+
+// newAWSSession creates the session shared by clients of EKS providers. Credentials
+// are checked upon creation, so that a misconfiguration fails the program on start.
+func newAWSSession() (*session.Session, error) {
+	cfg := awsConfigFromEnv()
+	awsCfg := aws.NewConfig().WithEndpointResolver(cfg.resolver())
+	if cfg.region != "" {
+		awsCfg = awsCfg.WithRegion(cfg.region)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config: *awsCfg,
+		// read region and profiles from ~/.aws/config as well
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot create aws session: %v", err)
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		region, err := ec2metadata.New(sess).Region()
+		if err != nil {
+			return nil, fmt.Errorf("cannot discover aws region from instance metadata, set AWS_REGION instead: %v", err)
+		}
+		sess.Config.Region = aws.String(region)
+	}
+	log.WithName("aws").Info("New aws session", "region", aws.StringValue(sess.Config.Region), "endpoint", cfg.endpoint)
+
+	if cfg.webIdentityTokenFile != "" {
+		if cfg.roleARN == "" {
+			return nil, errors.New("AWS_ROLE_ARN must be set along with AWS_WEB_IDENTITY_TOKEN_FILE")
+		}
+		sess.Config.Credentials = credentials.NewCredentials(&webIdentityProvider{
+			client:      sts.New(sess),
+			roleARN:     cfg.roleARN,
+			sessionName: cfg.roleSessionName,
+			tokenFile:   cfg.webIdentityTokenFile,
+		})
+	}
+	for _, roleARN := range cfg.assumeRoles {
+		// each role is assumed with credentials of the previous one
+		sess.Config.Credentials = stscreds.NewCredentials(sess.Copy(), roleARN)
+	}
+	if _, err := sess.Config.Credentials.Get(); err != nil {
+		return nil, fmt.Errorf("cannot get aws credentials: %v", err)
+	}
+	return sess, nil
+}
+
+// webIdentityProvider retrieves credentials by assuming roleARN with the OIDC token
+// in tokenFile, which is rotated by kubelet for IRSA, so it's read upon each retrieval
+type webIdentityProvider struct {
+	credentials.Expiry
+
+	client      stsiface.STSAPI
+	roleARN     string
+	sessionName string
+	tokenFile   string
+}
+
+// Retrieve implements credentials.Provider
+func (p *webIdentityProvider) Retrieve() (credentials.Value, error) {
+	token, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("cannot read web identity token: %v", err)
+	}
+	result, err := p.client.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.roleARN),
+		RoleSessionName:  aws.String(p.sessionName),
+		WebIdentityToken: aws.String(strings.TrimSpace(string(token))),
+	})
+	metrics.ObserveCloudCall("aws", "AssumeRoleWithWebIdentity", err)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	// refresh a bit earlier than expiration
+	p.SetExpiration(aws.TimeValue(result.Credentials.Expiration), time.Minute)
+	return credentials.Value{
+		AccessKeyID:     aws.StringValue(result.Credentials.AccessKeyId),
+		SecretAccessKey: aws.StringValue(result.Credentials.SecretAccessKey),
+		SessionToken:    aws.StringValue(result.Credentials.SessionToken),
+		ProviderName:    "WebIdentityProvider",
+	}, nil
+}
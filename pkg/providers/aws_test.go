@@ -0,0 +1,145 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+func TestAWSConfigFromEnv(t *testing.T) {
+	envs := map[string]string{
+		"AWS_REGION":           "eu-west-1",
+		"AWS_ENDPOINT_URL":     "http://localstack:4566",
+		"AWS_ENDPOINT_URL_STS": "http://sts:4566",
+		"AWS_ROLE_ARN":         "arn:aws:iam::123456789012:role/slb",
+		"AWS_ASSUME_ROLE_ARNS": "arn:aws:iam::1:role/a, ,arn:aws:iam::2:role/b",
+	}
+	for k, v := range envs {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	cfg := awsConfigFromEnv()
+	if cfg.region != "eu-west-1" {
+		t.Errorf("region = %q, want eu-west-1", cfg.region)
+	}
+	if cfg.roleSessionName != "shared-loadbalancer" {
+		t.Errorf("roleSessionName = %q, want the default one", cfg.roleSessionName)
+	}
+	wantRoles := []string{"arn:aws:iam::1:role/a", "arn:aws:iam::2:role/b"}
+	if !reflect.DeepEqual(cfg.assumeRoles, wantRoles) {
+		t.Errorf("assumeRoles = %v, want %v", cfg.assumeRoles, wantRoles)
+	}
+
+	tests := []struct {
+		service string
+		want    string
+	}{
+		{service: endpoints.StsServiceID, want: "http://sts:4566"},
+		{service: endpoints.Ec2ServiceID, want: "http://localstack:4566"},
+		{service: endpoints.ElasticloadbalancingServiceID, want: "http://localstack:4566"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.service, func(t *testing.T) {
+			got, err := cfg.resolver().EndpointFor(tt.service, cfg.region)
+			if err != nil {
+				t.Fatalf("EndpointFor() error = %v", err)
+			}
+			if got.URL != tt.want || got.SigningRegion != cfg.region {
+				t.Errorf("EndpointFor() = %+v, want URL %v in region %v", got, tt.want, cfg.region)
+			}
+		})
+	}
+
+	// without overrides, endpoints of the real region are used
+	got, err := awsConfig{}.resolver().EndpointFor(endpoints.Ec2ServiceID, "eu-west-1")
+	if err != nil || got.URL != "https://ec2.eu-west-1.amazonaws.com" {
+		t.Errorf("EndpointFor() = %+v, %v, want the default endpoint", got, err)
+	}
+}
+
+type fakeSTS struct {
+	stsiface.STSAPI
+	input *sts.AssumeRoleWithWebIdentityInput
+	err   error
+}
+
+func (f *fakeSTS) AssumeRoleWithWebIdentity(input *sts.AssumeRoleWithWebIdentityInput) (*sts.AssumeRoleWithWebIdentityOutput, error) {
+	f.input = input
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &sts.AssumeRoleWithWebIdentityOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String("AKID"),
+			SecretAccessKey: aws.String("SECRET"),
+			SessionToken:    aws.String("TOKEN"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
+
+func TestWebIdentityProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "web-identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("jwt\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &fakeSTS{}
+	p := &webIdentityProvider{client: client, roleARN: "arn:aws:iam::1:role/a", sessionName: "slb", tokenFile: tokenFile}
+	if !p.IsExpired() {
+		t.Errorf("IsExpired() = false before retrieval")
+	}
+	val, err := p.Retrieve()
+	if err != nil {
+		t.Fatalf("Retrieve() error = %v", err)
+	}
+	if val.AccessKeyID != "AKID" || val.SessionToken != "TOKEN" {
+		t.Errorf("Retrieve() = %+v", val)
+	}
+	if aws.StringValue(client.input.WebIdentityToken) != "jwt" || aws.StringValue(client.input.RoleArn) != p.roleARN {
+		t.Errorf("AssumeRoleWithWebIdentity() got input %v", client.input)
+	}
+	if p.IsExpired() {
+		t.Errorf("IsExpired() = true after retrieval")
+	}
+
+	client.err = errors.New("AccessDenied")
+	if _, err := p.Retrieve(); err == nil {
+		t.Errorf("Retrieve() error = nil, want the sts error")
+	}
+	p.tokenFile = filepath.Join(dir, "missing")
+	if _, err := p.Retrieve(); err == nil {
+		t.Errorf("Retrieve() error = nil, want an error on missing token file")
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2017-09-01/network"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// Refs:
+// * https://github.com/kubernetes/cloud-provider-azure/blob/master/docs/cloud-provider-config.md
+
+const (
+	// azureClusterLabel is set by AKS on nodes, valued with the node resource group
+	azureClusterLabel = "kubernetes.azure.com/cluster"
+	// azureProviderIDPrefix prefixes spec.providerID of Azure nodes, e.g.
+	// azure:///subscriptions/<id>/resourceGroups/<rg>/providers/Microsoft.Compute/virtualMachines/<vm>
+	azureProviderIDPrefix = "azure://"
+)
+
+// azureConfig locates the Azure resources AKS provider works on. Fields are named
+// after the cloud provider config file (azure.json), so that it can be read as is.
+type azureConfig struct {
+	TenantID                    string `json:"tenantId"`
+	SubscriptionID              string `json:"subscriptionId"`
+	AADClientID                 string `json:"aadClientId"`
+	AADClientSecret             string `json:"aadClientSecret"`
+	UseManagedIdentityExtension bool   `json:"useManagedIdentityExtension"`
+	ResourceGroup               string `json:"resourceGroup"`
+	SecurityGroupName           string `json:"securityGroupName"`
+	LoadBalancerName            string `json:"loadBalancerName"`
+}
+
+// loadAzureConfig reads azureConfig from the cloud provider config file at path;
+// a missing file is not an error as everything can be discovered or set otherwise
+func loadAzureConfig(path string) (*azureConfig, error) {
+	cfg := &azureConfig{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read azure cloud config: %v", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("cannot parse azure cloud config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides fields of cfg with env variables which are set
+func (cfg *azureConfig) applyEnv() {
+	cfg.SubscriptionID = GetEnvVal("AZURE_SUBSCRIPTION_ID", cfg.SubscriptionID)
+	cfg.ResourceGroup = GetEnvVal("RES_GRP_NAME", cfg.ResourceGroup)
+	cfg.SecurityGroupName = GetEnvVal("SG_NAME", cfg.SecurityGroupName)
+	cfg.LoadBalancerName = GetEnvVal("AZURE_LB_NAME", cfg.LoadBalancerName)
+}
+
+// applyNodes fills subscription and resource group of cfg which are not set yet,
+// from providerIDs and labels of nodes
+func (cfg *azureConfig) applyNodes(nodes []corev1.Node) {
+	for _, node := range nodes {
+		if cfg.SubscriptionID != "" && cfg.ResourceGroup != "" {
+			return
+		}
+		if subscriptionID, resGrpName, err := parseAzureProviderID(node.Spec.ProviderID); err == nil {
+			if cfg.SubscriptionID == "" {
+				cfg.SubscriptionID = subscriptionID
+			}
+			if cfg.ResourceGroup == "" {
+				cfg.ResourceGroup = resGrpName
+			}
+		}
+		if cfg.ResourceGroup == "" {
+			cfg.ResourceGroup = node.Labels[azureClusterLabel]
+		}
+	}
+}
+
+// validate checks that everything needed is found
+func (cfg *azureConfig) validate() error {
+	var missing []string
+	if cfg.SubscriptionID == "" {
+		missing = append(missing, "subscription (AZURE_SUBSCRIPTION_ID)")
+	}
+	if cfg.ResourceGroup == "" {
+		missing = append(missing, "resource group (RES_GRP_NAME)")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("cannot discover azure %s from azure cloud config or nodes, set them explicitly", strings.Join(missing, " and "))
+	}
+	return nil
+}
+
+// authorizer returns an authorizer with the service principal in cfg, if it's
+// not overridden by env variables; otherwise the one of env variables is returned,
+// which falls back to managed identity
+func (cfg *azureConfig) authorizer() (autorest.Authorizer, error) {
+	if GetEnvVal("AZURE_CLIENT_ID", "") == "" && !cfg.UseManagedIdentityExtension &&
+		cfg.AADClientID != "" && cfg.AADClientSecret != "" && cfg.AADClientID != "msi" {
+		return auth.NewClientCredentialsConfig(cfg.AADClientID, cfg.AADClientSecret, cfg.TenantID).Authorizer()
+	}
+	return auth.NewAuthorizerFromEnvironment()
+}
+
+// parseAzureProviderID returns subscription and resource group of a node's providerID,
+// which is in lower case for VMSS nodes, so the resource group is only reliable
+// up to case
+func parseAzureProviderID(providerID string) (string, string, error) {
+	if !strings.HasPrefix(providerID, azureProviderIDPrefix) {
+		return "", "", fmt.Errorf("%q is not an azure providerID", providerID)
+	}
+	var subscriptionID, resGrpName string
+	segments := strings.Split(strings.TrimPrefix(providerID, azureProviderIDPrefix), "/")
+	for i := 0; i+1 < len(segments); i++ {
+		switch strings.ToLower(segments[i]) {
+		case "subscriptions":
+			subscriptionID = segments[i+1]
+		case "resourcegroups":
+			resGrpName = segments[i+1]
+		}
+	}
+	if subscriptionID == "" || resGrpName == "" {
+		return "", "", fmt.Errorf("cannot parse subscription and resource group from providerID %q", providerID)
+	}
+	return subscriptionID, resGrpName, nil
+}
+
+// listNodes lists nodes with a client which doesn't need the manager's cache,
+// as the provider is created before the manager starts
+func listNodes() ([]corev1.Node, error) {
+	cfg, err := config.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.New(cfg, client.Options{})
+	if err != nil {
+		return nil, err
+	}
+	nodes := &corev1.NodeList{}
+	if err := c.List(context.TODO(), &client.ListOptions{}, nodes); err != nil {
+		return nil, err
+	}
+	return nodes.Items, nil
+}
+
+// discoverSGName returns the only NSG in the resource group, which is the one AKS
+// creates for agent pools
+func discoverSGName(sgClient network.SecurityGroupsClient, resGrpName string) (string, error) {
+	result, err := sgClient.List(context.TODO(), resGrpName)
+	metrics.ObserveCloudCall("aks", "SecurityGroupsList", err)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for ; result.NotDone(); err = result.Next() {
+		if err != nil {
+			return "", err
+		}
+		for _, sg := range result.Values() {
+			names = append(names, to.String(sg.Name))
+		}
+	}
+	if len(names) != 1 {
+		return "", fmt.Errorf("found %d network security groups %v in resource group %q, set SG_NAME to pick one", len(names), names, resGrpName)
+	}
+	return names[0], nil
+}
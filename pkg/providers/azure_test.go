@@ -0,0 +1,133 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseAzureProviderID(t *testing.T) {
+	tests := []struct {
+		name       string
+		providerID string
+		wantSub    string
+		wantResGrp string
+		wantErr    bool
+	}{
+		{
+			name:       "availability set vm",
+			providerID: "azure:///subscriptions/sub-1/resourceGroups/MC_rg_aks_eastus/providers/Microsoft.Compute/virtualMachines/aks-agentpool-1",
+			wantSub:    "sub-1",
+			wantResGrp: "MC_rg_aks_eastus",
+		},
+		{
+			name:       "vmss vm",
+			providerID: "azure:///subscriptions/sub-1/resourcegroups/mc_rg_aks_eastus/providers/Microsoft.Compute/virtualMachineScaleSets/aks-nodepool1-vmss/virtualMachines/0",
+			wantSub:    "sub-1",
+			wantResGrp: "mc_rg_aks_eastus",
+		},
+		{
+			name:       "not azure",
+			providerID: "aws:///us-west-2a/i-0123",
+			wantErr:    true,
+		},
+		{
+			name:       "no resource group",
+			providerID: "azure:///subscriptions/sub-1",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, resGrp, err := parseAzureProviderID(tt.providerID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAzureProviderID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if sub != tt.wantSub || resGrp != tt.wantResGrp {
+				t.Errorf("parseAzureProviderID() = %v, %v, want %v, %v", sub, resGrp, tt.wantSub, tt.wantResGrp)
+			}
+		})
+	}
+}
+
+func TestAzureConfigDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azure-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "azure.json")
+	if err := ioutil.WriteFile(path, []byte(`{"subscriptionId": "sub-json", "securityGroupName": "nsg-json", "aadClientId": "msi"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// missing file is not an error
+	cfg, err := loadAzureConfig(filepath.Join(dir, "missing.json"))
+	if err != nil || *cfg != (azureConfig{}) {
+		t.Errorf("loadAzureConfig() = %+v, %v, want an empty config", cfg, err)
+	}
+	if err := cfg.validate(); err == nil {
+		t.Errorf("validate() error = nil, want an error on empty config")
+	}
+
+	cfg, err = loadAzureConfig(path)
+	if err != nil {
+		t.Fatalf("loadAzureConfig() error = %v", err)
+	}
+	os.Setenv("SG_NAME", "nsg-env")
+	defer os.Unsetenv("SG_NAME")
+	cfg.applyEnv()
+	cfg.applyNodes([]corev1.Node{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "virtual-kubelet"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "aks-agentpool-1",
+				Labels: map[string]string{azureClusterLabel: "MC_rg_aks_eastus"},
+			},
+			Spec: corev1.NodeSpec{ProviderID: "azure:///subscriptions/sub-node/resourcegroups/mc_rg_aks_eastus/providers/Microsoft.Compute/virtualMachines/aks-agentpool-1"},
+		},
+	})
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("validate() error = %v", err)
+	}
+	want := azureConfig{
+		SubscriptionID:    "sub-json",
+		ResourceGroup:     "mc_rg_aks_eastus",
+		SecurityGroupName: "nsg-env",
+		AADClientID:       "msi",
+	}
+	if *cfg != want {
+		t.Errorf("discovered config = %+v, want %+v", *cfg, want)
+	}
+
+	// resource group falls back to the node label
+	cfg = &azureConfig{SubscriptionID: "sub-1"}
+	cfg.applyNodes([]corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{azureClusterLabel: "MC_rg_aks_eastus"}}},
+	})
+	if cfg.ResourceGroup != "MC_rg_aks_eastus" {
+		t.Errorf("ResourceGroup = %q, want the one of node label", cfg.ResourceGroup)
+	}
+}
@@ -17,12 +17,15 @@ limitations under the License.
 package providers
 
 import (
-	"os"
+	"fmt"
+	"sort"
+	"sync"
 
 	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
 )
 
@@ -36,6 +39,8 @@ var (
 	namespace = GetEnvVal("NAMESPACE", "default")
 	// capacity is the threshold value a LoadBalancer service can hold
 	capacity = GetEnvValInt("CAPACITY", 2)
+	// defaultStrategy is the placement strategy used when SharedLB doesn't specify one
+	defaultStrategy = GetEnvVal("STRATEGY", string(StrategyRandom))
 	// FinalizerName is the name of finalizer attached to Cluster Service object
 	FinalizerName = "sharedlb.kubecon.k8s.io/finalizer"
 )
@@ -43,60 +48,271 @@ var (
 type nameSet map[types.NamespacedName]struct{}
 type int32Set map[int32]struct{}
 
+// PortKey identifies a port exposed on a LB; TCP 53 and UDP 53 are different ports
+type PortKey struct {
+	Protocol corev1.Protocol
+	Port     int32
+}
+
+func (k PortKey) String() string {
+	return fmt.Sprintf("%d/%s", k.Port, k.Protocol)
+}
+
+// PortKeyOf returns the PortKey of svcPort, whose protocol defaults to TCP
+func PortKeyOf(svcPort corev1.ServicePort) PortKey {
+	protocol := svcPort.Protocol
+	if protocol == "" {
+		protocol = corev1.ProtocolTCP
+	}
+	return PortKey{Protocol: protocol, Port: svcPort.Port}
+}
+
+// ExposedPorts returns a copy of ports of sharedLB, in which the ones reassigned on its
+// LoadBalancer (see Status.ReassignedPorts) replace the requested ones
+func ExposedPorts(sharedLB *kubeconv1alpha1.SharedLB) []corev1.ServicePort {
+	if sharedLB.Spec.Ports == nil {
+		return nil
+	}
+	ports := make([]corev1.ServicePort, len(sharedLB.Spec.Ports))
+	copy(ports, sharedLB.Spec.Ports)
+	for i := range ports {
+		key := PortKeyOf(ports[i])
+		for _, reassigned := range sharedLB.Status.ReassignedPorts {
+			if key == (PortKey{Protocol: reassigned.Protocol, Port: reassigned.Port}) {
+				ports[i].Port = reassigned.AssignedPort
+			}
+		}
+	}
+	return ports
+}
+
+type portSet map[PortKey]struct{}
+
+// numbers returns numbers of ports of protocol in s
+func (s portSet) numbers(protocol corev1.Protocol) int32Set {
+	numbers := make(int32Set)
+	for key := range s {
+		if key.Protocol == protocol {
+			numbers[key.Port] = struct{}{}
+		}
+	}
+	return numbers
+}
+
 func init() {
 	log = logf.Log.WithName("providers")
 }
 
-func NewProvider() LBProvider {
-	providerStr := GetEnvVal("PROVIDER", "local")
-	log.Info("New LBProvider", "provider", providerStr)
-	var provider LBProvider
-	switch providerStr {
-	case "iks":
-		provider = newIKSProvider()
-	case "eks":
-		provider = newEKSProvider()
-	case "aks":
-		provider = newAKSProvider()
-	case "local":
-		provider = newLocalProvider()
-	default:
-		log.Info("Unsupported provider", "provider", providerStr)
-		os.Exit(1)
+// Factory is a function that returns a LBProvider.
+// An error is returned if the provider cannot be configured properly.
+type Factory func() (LBProvider, error)
+
+var (
+	factoriesLock sync.Mutex
+	// factories is keyed with provider name, and valued with its Factory
+	factories = make(map[string]Factory)
+)
+
+// RegisterProvider registers a LBProvider Factory by name. It's expected to be called
+// in init() of the package implementing the provider, so that an out-of-tree provider
+// can be plugged in by importing its package, e.g.
+//
+//	import _ "example.com/foo/provider"
+func RegisterProvider(name string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	if _, found := factories[name]; found {
+		panic(fmt.Sprintf("LBProvider %q was registered twice", name))
 	}
+	factories[name] = factory
+}
+
+// RegisteredProviders returns names of all registered providers in sorted order
+func RegisteredProviders() []string {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetProvider creates the LBProvider registered as name
+func GetProvider(name string) (LBProvider, error) {
+	factoriesLock.Lock()
+	factory, found := factories[name]
+	factoriesLock.Unlock()
+	if !found {
+		return nil, fmt.Errorf("unsupported provider %q, registered providers are %v", name, RegisteredProviders())
+	}
+	return factory()
+}
 
-	return provider
+// ProviderName returns name of the LBProvider specified by env variable PROVIDER
+func ProviderName() string {
+	return GetEnvVal("PROVIDER", "local")
 }
 
-// LBProvider defines methods that a loadbalancer provider should implement
+// NewProvider creates the LBProvider specified by env variable PROVIDER
+func NewProvider() (LBProvider, error) {
+	providerStr := ProviderName()
+	if _, err := ParseStrategy(defaultStrategy); err != nil {
+		return nil, err
+	}
+	log.Info("New LBProvider", "provider", providerStr)
+	return GetProvider(providerStr)
+}
+
+// LBProvider defines methods that a loadbalancer provider should implement.
+// Methods are expected to be safe for concurrent use.
 type LBProvider interface {
 	NewService(sharedLB *kubeconv1alpha1.SharedLB) *corev1.Service
 	NewLBService() *corev1.Service
-	GetAvailabelLB(clusterSvc *corev1.Service) *corev1.Service
+	// GetAvailabelLB returns a LB with a slot (and ports) reserved for cr, or nil if
+	// there isn't one in the placement's pool; it's safe to be called concurrently.
+	// A *PortConflictError, *PortRangeExhaustedError or *UnsupportedProtocolError is
+	// returned if a new LB won't help
+	GetAvailabelLB(cr types.NamespacedName, clusterSvc *corev1.Service, placement Placement) (*corev1.Service, error)
+	// LookupLB returns the LB a pinned placement refers to, by name or by ingress IP
+	LookupLB(placement Placement) (types.NamespacedName, bool)
+	// ReserveLB reserves a slot (and ports) on lb for cr pinned to it; it returns a
+	// *PortConflictError, *LBUnavailableError or *UnsupportedProtocolError if lb can't take cr
+	ReserveLB(cr, lb types.NamespacedName, clusterSvc *corev1.Service, placement Placement) (*corev1.Service, error)
+	// CancelReservation releases the slot (and ports) reserved by GetAvailabelLB or ReserveLB
+	CancelReservation(cr types.NamespacedName, clusterSvc *corev1.Service)
 	AssociateLB(cr, lb types.NamespacedName, clusterSvc *corev1.Service) error
 	DeassociateLB(cr types.NamespacedName, clusterSvc *corev1.Service) error
+	// ReservePorts swaps ports cr holds on its LB with the ones of clusterSvc, it's called
+	// before ports of cluster Service are updated; a *PortConflictError is returned if
+	// any port is held by another tenant, or an *UnsupportedProtocolError if the provider
+	// can't carry a port
+	ReservePorts(cr types.NamespacedName, clusterSvc *corev1.Service, placement Placement) error
+	// DeassociatePorts removes listeners and firewall rules of ports which are in oldSvc
+	// but not in newSvc, from the LB cr is associated with; it's called before ReservePorts
+	// and only touches ports held by cr
+	DeassociatePorts(cr types.NamespacedName, oldSvc, newSvc *corev1.Service) error
+	// MigrateLB reserves a slot (and ports) on lb for cr which is placed onto another LB,
+	// the source LB is still held until CompleteMigration; it returns a *PortConflictError
+	// or *LBUnavailableError if lb can't take cr
+	MigrateLB(cr, lb types.NamespacedName, clusterSvc *corev1.Service, placement Placement) error
+	// CancelMigration puts cr back onto the source LB before it's associated with the target
+	CancelMigration(cr types.NamespacedName)
+	// CompleteMigration removes cr from the source LB, after it's associated with the target
+	CompleteMigration(cr types.NamespacedName) error
 	UpdateCache(key types.NamespacedName, val *corev1.Service)
+	// RestoreAssociation records an existing cr->lb assignment in internal cache only,
+	// it's used to rebuild provider state upon program starts
+	RestoreAssociation(cr, lb types.NamespacedName, clusterSvc *corev1.Service)
+	// RestoreMigration records a move of cr from lb which is not completed yet, in internal
+	// cache only; it's called after RestoreAssociation upon program starts
+	RestoreMigration(cr, lb types.NamespacedName, clusterSvc *corev1.Service)
 	GetCapacityPerLB() int
+	// ListLBs returns usage of all LBs in inventory
+	ListLBs() []LBUsage
+	// ReclaimLB takes an empty LB out of inventory before it's deleted; it returns
+	// false if the LB is not empty, e.g. a placement onto it is in progress
+	ReclaimLB(lb types.NamespacedName) bool
 	UpdateService(svc, lb *corev1.Service) (portUpdated, externalIPUpdated bool)
 }
 
-func updatePort(svc, lb *corev1.Service, occupiedPorts int32Set) bool {
+// RecorderInjector is implemented by a LBProvider which emits events on LB Services
+// for cloud operations, e.g. listener creation or firewall changes
+type RecorderInjector interface {
+	InjectRecorder(recorder record.EventRecorder)
+}
+
+// removedPorts returns a copy of oldSvc only carrying ports which are not in newSvc;
+// an empty protocol is the same as TCP
+func removedPorts(oldSvc, newSvc *corev1.Service) *corev1.Service {
+	kept := make(portSet, len(newSvc.Spec.Ports))
+	for _, svcPort := range newSvc.Spec.Ports {
+		kept[PortKeyOf(svcPort)] = struct{}{}
+	}
+	removed := oldSvc.DeepCopy()
+	removed.Spec.Ports = nil
+	for _, svcPort := range oldSvc.Spec.Ports {
+		if _, ok := kept[PortKeyOf(svcPort)]; !ok {
+			removed.Spec.Ports = append(removed.Spec.Ports, svcPort)
+		}
+	}
+	return removed
+}
+
+// dropConflicts returns a copy of svc in which ports in occupiedPorts are left as 0, so that
+// they can be assigned again, along with keys of those ports
+func dropConflicts(svc *corev1.Service, occupiedPorts portSet) (*corev1.Service, []PortKey) {
+	dropped := svc.DeepCopy()
+	var conflicts []PortKey
+	for i, svcPort := range svc.Spec.Ports {
+		if _, ok := occupiedPorts[PortKeyOf(svcPort)]; ok && svcPort.Port != 0 {
+			dropped.Spec.Ports[i].Port = 0
+			conflicts = append(conflicts, PortKeyOf(svcPort))
+		}
+	}
+	return dropped, conflicts
+}
+
+// setPortNumbers copies numbers of ports of src to svc, which carries the same ports
+// in the same order; the ports slice of svc is kept as it may be shared
+func setPortNumbers(svc, src *corev1.Service) {
+	for i := range svc.Spec.Ports {
+		svc.Spec.Ports[i].Port = src.Spec.Ports[i].Port
+	}
+}
+
+// portNumbers returns numbers of ports of svc
+func portNumbers(svc *corev1.Service) []int32 {
+	ports := make([]int32, len(svc.Spec.Ports))
+	for i, svcPort := range svc.Spec.Ports {
+		ports[i] = svcPort.Port
+	}
+	return ports
+}
+
+// updatePort fills in ports of svc which are left as 0, with ones in range [min, max)
+// and not in occupiedPorts for the same protocol. An error is returned if the range runs out.
+func updatePort(svc *corev1.Service, occupiedPorts portSet, min, max int32) (bool, error) {
 	updated := false
+	// ports of svc itself are also occupied
+	occupied := make(portSet, len(occupiedPorts)+len(svc.Spec.Ports))
+	for key := range occupiedPorts {
+		occupied[key] = struct{}{}
+	}
+	for _, svcPort := range svc.Spec.Ports {
+		occupied[PortKeyOf(svcPort)] = struct{}{}
+	}
 	// check if svc carries port info or not
 	for i, svcPort := range svc.Spec.Ports {
 		if svcPort.Port != 0 {
 			continue
 		}
-		// TODO: if we run out of random ports..
-		for {
-			randomPort := GetRandomPort()
-			if _, ok := occupiedPorts[randomPort]; ok {
-				continue
+		key := PortKeyOf(svcPort)
+		port, err := GetAvailablePortInRange(occupied.numbers(key.Protocol), min, max)
+		if err != nil {
+			return updated, err
+		}
+		svc.Spec.Ports[i].Port = port
+		key.Port = port
+		occupied[key] = struct{}{}
+		updated = true
+	}
+	return updated, nil
+}
+
+// checkProtocols returns an *UnsupportedProtocolError if any port of svc uses
+// a protocol not in supported
+func checkProtocols(provider string, svc *corev1.Service, supported []corev1.Protocol) error {
+OUTERLOOP:
+	for _, svcPort := range svc.Spec.Ports {
+		key := PortKeyOf(svcPort)
+		for _, protocol := range supported {
+			if key.Protocol == protocol {
+				continue OUTERLOOP
 			}
-			svc.Spec.Ports[i].Port = randomPort
-			updated = true
-			break
 		}
+		return &UnsupportedProtocolError{Provider: provider, Port: key, Supported: supported}
 	}
-	return updated
+	return nil
 }
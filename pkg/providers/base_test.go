@@ -0,0 +1,92 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"reflect"
+	"testing"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// unregisterProvider removes the Factory registered by name, so that a test registering
+// it can run more than once, e.g. with -count=2
+func unregisterProvider(name string) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	delete(factories, name)
+}
+
+func TestGetProvider(t *testing.T) {
+	RegisterProvider("fake", func() (LBProvider, error) {
+		return newLocalProvider(), nil
+	})
+	defer unregisterProvider("fake")
+	tests := []struct {
+		name     string
+		provider string
+		wantErr  bool
+	}{
+		{
+			name:     "in-tree provider",
+			provider: "local",
+		},
+		{
+			name:     "registered provider",
+			provider: "fake",
+		},
+		{
+			name:     "unknown provider",
+			provider: "unknown",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetProvider(tt.provider)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetProvider() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got == nil {
+				t.Errorf("GetProvider() returns nil provider")
+			}
+		})
+	}
+}
+
+func TestExposedPorts(t *testing.T) {
+	sharedLB := &kubeconv1alpha1.SharedLB{
+		Spec: kubeconv1alpha1.SharedLBSpec{
+			Ports: []corev1.ServicePort{{Port: 80}, {Port: 53, Protocol: corev1.ProtocolUDP}, {Port: 53}},
+		},
+		Status: kubeconv1alpha1.SharedLBStatus{
+			ReassignedPorts: []kubeconv1alpha1.SharedLBPortReassignment{
+				{Protocol: corev1.ProtocolTCP, Port: 80, AssignedPort: 1080},
+				{Protocol: corev1.ProtocolUDP, Port: 53, AssignedPort: 1053},
+			},
+		},
+	}
+	want := []corev1.ServicePort{{Port: 1080}, {Port: 1053, Protocol: corev1.ProtocolUDP}, {Port: 53}}
+	if got := ExposedPorts(sharedLB); !reflect.DeepEqual(got, want) {
+		t.Errorf("ExposedPorts() = %v, want %v", got, want)
+	}
+	// spec is kept as requested
+	if sharedLB.Spec.Ports[0].Port != 80 {
+		t.Errorf("ExposedPorts() changed spec ports to %v", sharedLB.Spec.Ports)
+	}
+}
@@ -20,12 +20,12 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 
 	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/metrics"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/endpoints"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/elb"
 	corev1 "k8s.io/api/core/v1"
@@ -34,7 +34,8 @@ import (
 )
 
 // Notes:
-// - don't use elbv2 package as the EKS LB service generated by default is not elbv2 instance
+// - don't use elbv2 package as the EKS LB service generated by default is not elbv2 instance,
+//   see EKSNLB for LB services backed by Network Load Balancers
 
 // Refs:
 // https://docs.aws.amazon.com/sdk-for-go/api/service/elb/#New
@@ -47,52 +48,45 @@ import (
 
 // EKS stands for Elastic(Amazon) Kubernetes Service
 type EKS struct {
+	*Allocator
+
 	elbClient *elb.ELB
 	ec2Client *ec2.EC2
 
-	// key is namespacedName of a LB Serivce, val is the service
-	cacheMap map[types.NamespacedName]*corev1.Service
-	cacheELB map[types.NamespacedName]*elb.LoadBalancerDescription
-
-	// cr to LB is 1:1 mapping
-	crToLB map[types.NamespacedName]types.NamespacedName
-	// lb to CRD is 1:N mapping
-	lbToCRs map[types.NamespacedName]nameSet
-	// lbToPorts is keyed with ns/name of a LB, and valued with ports info it holds
-	lbToPorts map[types.NamespacedName]int32Set
-
-	capacityPerLB int
+	// key is namespacedName of a LB Serivce, val is the ELB description
+	cacheELB     map[types.NamespacedName]*elb.LoadBalancerDescription
+	cacheELBLock sync.RWMutex
 }
 
 var _ LBProvider = &EKS{}
 
-func newEKSProvider() *EKS {
-	// TODO(Huang-Wei): make aws credentials and regionID configurable
-	sess := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(endpoints.UsWest2RegionID),
-	}))
-	return &EKS{
-		elbClient:     elb.New(sess),
-		ec2Client:     ec2.New(sess),
-		cacheMap:      make(map[types.NamespacedName]*corev1.Service),
-		cacheELB:      make(map[types.NamespacedName]*elb.LoadBalancerDescription),
-		crToLB:        make(map[types.NamespacedName]types.NamespacedName),
-		lbToCRs:       make(map[types.NamespacedName]nameSet),
-		lbToPorts:     make(map[types.NamespacedName]int32Set),
-		capacityPerLB: capacity,
-	}
+func init() {
+	RegisterProvider("eks", func() (LBProvider, error) {
+		return newEKSProvider()
+	})
 }
 
-func (e *EKS) GetCapacityPerLB() int {
-	return e.capacityPerLB
+func newEKSProvider() (*EKS, error) {
+	sess, err := newAWSSession()
+	if err != nil {
+		return nil, err
+	}
+	return &EKS{
+		// classic ELB listeners only carry TCP (and HTTP/SSL on top of it)
+		Allocator: NewAllocator("eks", corev1.ProtocolTCP),
+		elbClient: elb.New(sess),
+		ec2Client: ec2.New(sess),
+		cacheELB:  make(map[types.NamespacedName]*elb.LoadBalancerDescription),
+	}, nil
 }
 
 func (e *EKS) UpdateCache(key types.NamespacedName, lbSvc *corev1.Service) {
+	e.Allocator.UpdateCache(key, lbSvc)
 	if lbSvc == nil {
-		delete(e.cacheMap, key)
+		e.cacheELBLock.Lock()
 		delete(e.cacheELB, key)
+		e.cacheELBLock.Unlock()
 	} else {
-		e.cacheMap[key] = lbSvc
 		// handle ELB stuff
 		if len(lbSvc.Status.LoadBalancer.Ingress) == 1 {
 			hostname := lbSvc.Status.LoadBalancer.Ingress[0].Hostname
@@ -101,7 +95,9 @@ func (e *EKS) UpdateCache(key types.NamespacedName, lbSvc *corev1.Service) {
 				log.WithName("eks").Error(err, "cannot query ELB", "key", key, "elbName", elbName)
 			} else {
 				log.WithName("eks").Info("ELB obj is updated in local cache", "key", key, "elbName", elbName)
+				e.cacheELBLock.Lock()
 				e.cacheELB[key] = result
+				e.cacheELBLock.Unlock()
 			}
 		}
 	}
@@ -116,7 +112,7 @@ func (e *EKS) NewService(sharedLB *kubeconv1alpha1.SharedLB) *corev1.Service {
 		Spec: corev1.ServiceSpec{
 			// NodePort is the solution we can come up with so far
 			Type:     corev1.ServiceTypeNodePort,
-			Ports:    sharedLB.Spec.Ports,
+			Ports:    ExposedPorts(sharedLB),
 			Selector: sharedLB.Spec.Selector,
 		},
 	}
@@ -138,73 +134,36 @@ func (e *EKS) NewLBService() *corev1.Service {
 					Protocol: corev1.ProtocolTCP,
 					Port:     33333,
 				},
-				// EKS doesn't support UDP, so don't bother
-				// {
-				// 	Name:     "UDP",
-				// 	Protocol: corev1.ProtocolUDP,
-				// 	Port:     33333,
-				// },
+				// classic ELB doesn't support UDP, UDP tenants are rejected
 			},
 		},
 	}
 }
 
-func (e *EKS) GetAvailabelLB(clusterSvc *corev1.Service) *corev1.Service {
-	// we leverage the randomness of golang "for range" when iterating
-OUTERLOOP:
-	for lbKey, lbSvc := range e.cacheMap {
-		if len(e.lbToCRs[lbKey]) >= e.capacityPerLB || len(lbSvc.Status.LoadBalancer.Ingress) == 0 {
-			continue
-		}
-		// must satisfy that all svc ports are not occupied in lbSvc
-		for _, svcPort := range clusterSvc.Spec.Ports {
-			if e.lbToPorts[lbKey] == nil {
-				e.lbToPorts[lbKey] = int32Set{}
-			}
-			if _, ok := e.lbToPorts[lbKey][svcPort.Port]; ok {
-				log.WithName("eks").Info(fmt.Sprintf("incoming service has port conflict with lbSvc %q on port %d", lbKey, svcPort.Port))
-				continue OUTERLOOP
-			}
-		}
-		return lbSvc
-	}
-	return nil
-}
-
 func (e *EKS) AssociateLB(crName, lbName types.NamespacedName, clusterSvc *corev1.Service) error {
 	// a) create LoadBalancer listener (create-load-balancer-listeners)
 	// b) create inbound rules to security group (authorize-security-group-ingress)
 	if clusterSvc != nil {
-		if elbDesc := e.cacheELB[lbName]; elbDesc != nil {
+		if elbDesc := e.getELB(lbName); elbDesc != nil {
+			lbSvc, svcName := e.GetLB(lbName), GetNamespacedName(clusterSvc)
 			executed, err := e.createListeners(clusterSvc, elbDesc)
 			if err != nil {
-				return err
+				e.Eventf(lbSvc, corev1.EventTypeWarning, "CreateListenersFailed", "Failed to create listeners for %s: %v", svcName, err)
+				return &AssociationError{Step: StepListeners, Err: err}
 			}
 			if executed {
+				e.Eventf(lbSvc, corev1.EventTypeNormal, "ListenersCreated", "Created listeners for %s", svcName)
 				if err := e.createInboundRules(clusterSvc, elbDesc); err != nil {
-					return err
+					e.Eventf(lbSvc, corev1.EventTypeWarning, "CreateFirewallRulesFailed", "Failed to create inbound rules for %s: %v", svcName, err)
+					return &AssociationError{Step: StepFirewall, Err: err}
 				}
+				e.Eventf(lbSvc, corev1.EventTypeNormal, "FirewallRulesCreated", "Created inbound rules for %s", svcName)
 			}
 		}
-		// upon program starts, e.lbToPorts[lbName] can be nil
-		if e.lbToPorts[lbName] == nil {
-			e.lbToPorts[lbName] = int32Set{}
-		}
-		// update crToPorts
-		for _, svcPort := range clusterSvc.Spec.Ports {
-			e.lbToPorts[lbName][svcPort.Port] = struct{}{}
-		}
 	}
 
 	// c) update internal cache
-	// following code might be called multiple times, but shouldn't impact
-	// performance a lot as all of them are O(1) operation
-	_, ok := e.lbToCRs[lbName]
-	if !ok {
-		e.lbToCRs[lbName] = make(nameSet)
-	}
-	e.lbToCRs[lbName][crName] = struct{}{}
-	e.crToLB[crName] = lbName
+	e.RestoreAssociation(crName, lbName, clusterSvc)
 	log.WithName("eks").Info("AssociateLB", "cr", crName, "lb", lbName)
 	return nil
 }
@@ -212,43 +171,123 @@ func (e *EKS) AssociateLB(crName, lbName types.NamespacedName, clusterSvc *corev
 // DeassociateLB is called by EKS finalizer to clean listeners
 // and inbound rules of security group
 func (e *EKS) DeassociateLB(crName types.NamespacedName, clusterSvc *corev1.Service) error {
-	lbName, ok := e.crToLB[crName]
+	lbName, ok := e.GetLBName(crName)
 	if !ok {
 		return nil
 	}
 
 	// a) remove LoadBalancer listener (delete-load-balancer-listeners)
 	// b) remove inbound rules from security group (revoke-security-group-ingress)
-	if elbDesc := e.cacheELB[lbName]; elbDesc != nil {
+	if elbDesc := e.getELB(lbName); elbDesc != nil {
+		lbSvc, svcName := e.GetLB(lbName), GetNamespacedName(clusterSvc)
 		if err := e.removeListeners(clusterSvc, elbDesc); err != nil {
+			e.Eventf(lbSvc, corev1.EventTypeWarning, "DeleteListenersFailed", "Failed to delete listeners for %s: %v", svcName, err)
 			return err
 		}
+		e.forgetListeners(lbName, clusterSvc)
+		e.Eventf(lbSvc, corev1.EventTypeNormal, "ListenersDeleted", "Deleted listeners for %s", svcName)
 		if err := e.removeInboundRules(clusterSvc, elbDesc); err != nil {
+			e.Eventf(lbSvc, corev1.EventTypeWarning, "DeleteFirewallRulesFailed", "Failed to delete inbound rules for %s: %v", svcName, err)
 			return err
 		}
+		e.Eventf(lbSvc, corev1.EventTypeNormal, "FirewallRulesDeleted", "Deleted inbound rules for %s", svcName)
 	}
 
 	// c) update internal cache
-	delete(e.crToLB, crName)
-	delete(e.lbToCRs[lbName], crName)
-	for _, svcPort := range clusterSvc.Spec.Ports {
-		delete(e.lbToPorts[lbName], svcPort.Port)
-	}
+	e.RemoveAssociation(crName, clusterSvc)
 	log.WithName("eks").Info("DeassociateLB", "cr", crName, "lb", lbName)
 	return nil
 }
 
-func (e *EKS) UpdateService(svc, lb *corev1.Service) (bool, bool) {
-	lbName := types.NamespacedName{Name: lb.Name, Namespace: lb.Namespace}
-	occupiedPorts := e.lbToPorts[lbName]
-	if len(occupiedPorts) == 0 {
-		occupiedPorts = int32Set{}
+// DeassociatePorts removes listeners and inbound rules of ports which are
+// in oldSvc but not in newSvc
+func (e *EKS) DeassociatePorts(crName types.NamespacedName, oldSvc, newSvc *corev1.Service) error {
+	lbName, ok := e.GetLBName(crName)
+	if !ok {
+		return nil
 	}
-	portUpdated := updatePort(svc, lb, occupiedPorts)
+	removed := e.HeldPorts(crName, removedPorts(oldSvc, newSvc))
+	if len(removed.Spec.Ports) == 0 {
+		return nil
+	}
+	if elbDesc := e.getELB(lbName); elbDesc != nil {
+		lbSvc, svcName := e.GetLB(lbName), GetNamespacedName(oldSvc)
+		if err := e.removeListeners(removed, elbDesc); err != nil {
+			e.Eventf(lbSvc, corev1.EventTypeWarning, "DeleteListenersFailed", "Failed to delete listeners of removed ports for %s: %v", svcName, err)
+			return &AssociationError{Step: StepListeners, Err: err}
+		}
+		e.forgetListeners(lbName, removed)
+		if err := e.removeInboundRules(removed, elbDesc); err != nil {
+			e.Eventf(lbSvc, corev1.EventTypeWarning, "DeleteFirewallRulesFailed", "Failed to delete inbound rules of removed ports for %s: %v", svcName, err)
+			return &AssociationError{Step: StepFirewall, Err: err}
+		}
+		e.Eventf(lbSvc, corev1.EventTypeNormal, "ListenersDeleted", "Deleted listeners and inbound rules of ports %v for %s", portNumbers(removed), svcName)
+	}
+	log.WithName("eks").Info("DeassociatePorts", "cr", crName, "lb", lbName, "ports", portNumbers(removed))
+	return nil
+}
+
+// CompleteMigration removes listeners and inbound rules of crName from
+// the LB it's being moved from
+func (e *EKS) CompleteMigration(crName types.NamespacedName) error {
+	lbName, held, ok := e.GetMigration(crName)
+	if !ok {
+		return nil
+	}
+	if elbDesc := e.getELB(lbName); elbDesc != nil && len(held.Spec.Ports) > 0 {
+		lbSvc, svcName := e.GetLB(lbName), GetNamespacedName(held)
+		if err := e.removeListeners(held, elbDesc); err != nil {
+			e.Eventf(lbSvc, corev1.EventTypeWarning, "DeleteListenersFailed", "Failed to delete listeners for %s moved to another LB: %v", svcName, err)
+			return &AssociationError{Step: StepListeners, Err: err}
+		}
+		e.forgetListeners(lbName, held)
+		if err := e.removeInboundRules(held, elbDesc); err != nil {
+			e.Eventf(lbSvc, corev1.EventTypeWarning, "DeleteFirewallRulesFailed", "Failed to delete inbound rules for %s moved to another LB: %v", svcName, err)
+			return &AssociationError{Step: StepFirewall, Err: err}
+		}
+		e.Eventf(lbSvc, corev1.EventTypeNormal, "ListenersDeleted", "Deleted listeners and inbound rules for %s moved to another LB", svcName)
+	}
+	e.EndMigration(crName)
+	return nil
+}
+
+func (e *EKS) UpdateService(svc, lb *corev1.Service) (bool, bool) {
+	portUpdated := e.AssignPorts(svc, lb)
 	// don't need to update externalIP
 	return portUpdated, false
 }
 
+func (e *EKS) getELB(lbName types.NamespacedName) *elb.LoadBalancerDescription {
+	e.cacheELBLock.RLock()
+	defer e.cacheELBLock.RUnlock()
+	return e.cacheELB[lbName]
+}
+
+// forgetListeners drops listeners of ports of svc from the cached description of lbName
+// once they're deleted, so that createListeners doesn't take them as existing when the
+// ports come back
+func (e *EKS) forgetListeners(lbName types.NamespacedName, svc *corev1.Service) {
+	removed := make(map[int64]struct{}, len(svc.Spec.Ports))
+	for _, p := range svc.Spec.Ports {
+		removed[int64(p.Port)] = struct{}{}
+	}
+	e.cacheELBLock.Lock()
+	defer e.cacheELBLock.Unlock()
+	elbDesc, ok := e.cacheELB[lbName]
+	if !ok {
+		return
+	}
+	// the cached description may be being read, so it's replaced rather than modified
+	updated := *elbDesc
+	updated.ListenerDescriptions = nil
+	for _, desc := range elbDesc.ListenerDescriptions {
+		if _, ok := removed[aws.Int64Value(desc.Listener.LoadBalancerPort)]; !ok {
+			updated.ListenerDescriptions = append(updated.ListenerDescriptions, desc)
+		}
+	}
+	e.cacheELB[lbName] = &updated
+}
+
 func (e *EKS) queryELB(elbName string) (*elb.LoadBalancerDescription, error) {
 	if elbName == "" {
 		return nil, errors.New("elbName cannot be empty")
@@ -259,6 +298,7 @@ func (e *EKS) queryELB(elbName string) (*elb.LoadBalancerDescription, error) {
 		},
 	}
 	result, err := e.elbClient.DescribeLoadBalancers(input)
+	metrics.ObserveCloudCall("eks", "DescribeLoadBalancers", err)
 	if err != nil {
 		return nil, err
 	}
@@ -299,6 +339,7 @@ func (e *EKS) createListeners(clusterSvc *corev1.Service, elbDesc *elb.LoadBalan
 		LoadBalancerName: elbDesc.LoadBalancerName,
 	}
 	_, err := e.elbClient.CreateLoadBalancerListeners(input)
+	metrics.ObserveCloudCall("eks", "CreateLoadBalancerListeners", err)
 
 	// tolerate if the listener exists in server side
 	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == elb.ErrCodeDuplicateListenerException {
@@ -357,6 +398,7 @@ func (e *EKS) createInboundRules(clusterSvc *corev1.Service, elbDesc *elb.LoadBa
 		IpPermissions: ipPermissions,
 	}
 	_, err := e.ec2Client.AuthorizeSecurityGroupIngress(input)
+	metrics.ObserveCloudCall("eks", "AuthorizeSecurityGroupIngress", err)
 	// tolerate if the rules exist in server side
 	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidPermission.Duplicate" {
 		return nil
@@ -377,6 +419,7 @@ func (e *EKS) removeListeners(clusterSvc *corev1.Service, elbDesc *elb.LoadBalan
 		LoadBalancerPorts: ports,
 	}
 	_, err := e.elbClient.DeleteLoadBalancerListeners(input)
+	metrics.ObserveCloudCall("eks", "DeleteLoadBalancerListeners", err)
 	return err
 }
 
@@ -417,5 +460,10 @@ func (e *EKS) removeInboundRules(clusterSvc *corev1.Service, elbDesc *elb.LoadBa
 		IpPermissions: ipPermissions,
 	}
 	_, err := e.ec2Client.RevokeSecurityGroupIngress(input)
+	metrics.ObserveCloudCall("eks", "RevokeSecurityGroupIngress", err)
+	// tolerate if the rules don't exist in server side
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidPermission.NotFound" {
+		return nil
+	}
 	return err
 }
@@ -0,0 +1,716 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/metrics"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Refs:
+// https://docs.aws.amazon.com/sdk-for-go/api/service/elbv2/
+// https://docs.aws.amazon.com/elasticloadbalancing/latest/network/load-balancer-target-groups.html
+
+// for a NLB backed loadbalancer service, the NLB is the one whose DNS name is the
+// ingress hostname, e.g. a150664e6b12311e883b3061edd716de-1234567890abcdef.elb.us-west-2.amazonaws.com
+
+const (
+	// nlbAnnotation asks the AWS cloud provider to back a LB service by a NLB
+	nlbAnnotation = "service.beta.kubernetes.io/aws-load-balancer-type"
+	// nlbTargetGroupPrefix prefixes names of target groups created for tenant ports
+	nlbTargetGroupPrefix = "slb"
+)
+
+// EKSNLB stands for Elastic(Amazon) Kubernetes Service whose LB services are backed by
+// Network Load Balancers. Each tenant port gets a listener forwarding to a target group
+// of the cluster nodes on its NodePort. Unlike classic ELB, NLB carries UDP and keeps
+// client IPs, so inbound rules are added to security groups of the nodes.
+type EKSNLB struct {
+	*Allocator
+
+	elbv2Client elbv2iface.ELBV2API
+	ec2Client   ec2iface.EC2API
+	// healthzPort is the port kube-proxy serves health checks on every node, UDP target
+	// groups are health checked on it as nothing answers TCP on a UDP NodePort
+	healthzPort int
+
+	// key is namespacedName of a LB Serivce, val is the NLB
+	cacheNLB     map[types.NamespacedName]*elbv2.LoadBalancer
+	cacheNLBLock sync.RWMutex
+}
+
+var _ LBProvider = &EKSNLB{}
+
+func init() {
+	RegisterProvider("eks-nlb", func() (LBProvider, error) {
+		sess, err := newAWSSession()
+		if err != nil {
+			return nil, err
+		}
+		return newEKSNLBProvider(elbv2.New(sess), ec2.New(sess)), nil
+	})
+}
+
+func newEKSNLBProvider(elbv2Client elbv2iface.ELBV2API, ec2Client ec2iface.EC2API) *EKSNLB {
+	return &EKSNLB{
+		Allocator:   NewAllocator("eks-nlb"),
+		elbv2Client: elbv2Client,
+		ec2Client:   ec2Client,
+		healthzPort: GetEnvValInt("KUBE_PROXY_HEALTHZ_PORT", 10256),
+		cacheNLB:    make(map[types.NamespacedName]*elbv2.LoadBalancer),
+	}
+}
+
+func (e *EKSNLB) UpdateCache(key types.NamespacedName, lbSvc *corev1.Service) {
+	e.Allocator.UpdateCache(key, lbSvc)
+	if lbSvc == nil {
+		e.cacheNLBLock.Lock()
+		delete(e.cacheNLB, key)
+		e.cacheNLBLock.Unlock()
+	} else {
+		// handle NLB stuff
+		if len(lbSvc.Status.LoadBalancer.Ingress) == 1 {
+			hostname := lbSvc.Status.LoadBalancer.Ingress[0].Hostname
+			if result, err := e.queryNLB(hostname); err != nil {
+				log.WithName("eks-nlb").Error(err, "cannot query NLB", "key", key, "hostname", hostname)
+			} else {
+				log.WithName("eks-nlb").Info("NLB obj is updated in local cache", "key", key, "nlbName", aws.StringValue(result.LoadBalancerName))
+				e.cacheNLBLock.Lock()
+				e.cacheNLB[key] = result
+				e.cacheNLBLock.Unlock()
+				if _, err := e.syncTargets(result); err != nil {
+					log.WithName("eks-nlb").Error(err, "cannot sync targets of NLB", "key", key, "nlbName", aws.StringValue(result.LoadBalancerName))
+				}
+			}
+		}
+	}
+}
+
+func (e *EKSNLB) NewService(sharedLB *kubeconv1alpha1.SharedLB) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sharedLB.Name + SvcPostfix,
+			Namespace: sharedLB.Namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			// targets of the NLB are the nodes, listening on the NodePorts
+			Type:     corev1.ServiceTypeNodePort,
+			Ports:    ExposedPorts(sharedLB),
+			Selector: sharedLB.Spec.Selector,
+		},
+	}
+}
+
+func (e *EKSNLB) NewLBService() *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "lb-" + RandStringRunes(8),
+			Namespace:   namespace,
+			Labels:      map[string]string{"lb-template": ""},
+			Annotations: map[string]string{nlbAnnotation: "nlb"},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceTypeLoadBalancer,
+			Selector: map[string]string{"app": "lb-placeholder"},
+			Ports: []corev1.ServicePort{
+				{
+					Name:     "tcp",
+					Protocol: corev1.ProtocolTCP,
+					Port:     33333,
+				},
+			},
+		},
+	}
+}
+
+func (e *EKSNLB) AssociateLB(crName, lbName types.NamespacedName, clusterSvc *corev1.Service) error {
+	// a) create target groups and listeners (create-target-group, create-listener)
+	// b) create inbound rules to security group of nodes (authorize-security-group-ingress)
+	if clusterSvc != nil {
+		if nlb := e.getNLB(lbName); nlb != nil {
+			lbSvc, svcName := e.GetLB(lbName), GetNamespacedName(clusterSvc)
+			executed, err := e.createListeners(clusterSvc, nlb)
+			if err != nil {
+				e.Eventf(lbSvc, corev1.EventTypeWarning, "CreateListenersFailed", "Failed to create listeners for %s: %v", svcName, err)
+				return &AssociationError{Step: StepListeners, Err: err}
+			}
+			if executed {
+				e.Eventf(lbSvc, corev1.EventTypeNormal, "ListenersCreated", "Created listeners for %s", svcName)
+				if err := e.createInboundRules(clusterSvc, nlb); err != nil {
+					e.Eventf(lbSvc, corev1.EventTypeWarning, "CreateFirewallRulesFailed", "Failed to create inbound rules for %s: %v", svcName, err)
+					return &AssociationError{Step: StepFirewall, Err: err}
+				}
+				e.Eventf(lbSvc, corev1.EventTypeNormal, "FirewallRulesCreated", "Created inbound rules for %s", svcName)
+			}
+			// nodes may be added or removed since target groups of other tenants are created
+			synced, err := e.syncTargets(nlb)
+			if err != nil {
+				e.Eventf(lbSvc, corev1.EventTypeWarning, "SyncTargetsFailed", "Failed to sync targets with nodes of the NLB: %v", err)
+				return &AssociationError{Step: StepListeners, Err: err}
+			}
+			if synced {
+				e.Eventf(lbSvc, corev1.EventTypeNormal, "TargetsSynced", "Synced targets with nodes of the NLB")
+			}
+		}
+	}
+
+	// c) update internal cache
+	e.RestoreAssociation(crName, lbName, clusterSvc)
+	log.WithName("eks-nlb").Info("AssociateLB", "cr", crName, "lb", lbName)
+	return nil
+}
+
+// DeassociateLB is called by EKSNLB finalizer to clean listeners, target groups
+// and inbound rules of security group
+func (e *EKSNLB) DeassociateLB(crName types.NamespacedName, clusterSvc *corev1.Service) error {
+	lbName, ok := e.GetLBName(crName)
+	if !ok {
+		return nil
+	}
+
+	// a) remove listeners and target groups (delete-listener, delete-target-group)
+	// b) remove inbound rules from security group (revoke-security-group-ingress)
+	if nlb := e.getNLB(lbName); nlb != nil {
+		lbSvc, svcName := e.GetLB(lbName), GetNamespacedName(clusterSvc)
+		if err := e.removeListeners(clusterSvc, nlb); err != nil {
+			e.Eventf(lbSvc, corev1.EventTypeWarning, "DeleteListenersFailed", "Failed to delete listeners for %s: %v", svcName, err)
+			return err
+		}
+		e.Eventf(lbSvc, corev1.EventTypeNormal, "ListenersDeleted", "Deleted listeners for %s", svcName)
+		if err := e.removeInboundRules(clusterSvc, nlb); err != nil {
+			e.Eventf(lbSvc, corev1.EventTypeWarning, "DeleteFirewallRulesFailed", "Failed to delete inbound rules for %s: %v", svcName, err)
+			return err
+		}
+		e.Eventf(lbSvc, corev1.EventTypeNormal, "FirewallRulesDeleted", "Deleted inbound rules for %s", svcName)
+	}
+
+	// c) update internal cache
+	e.RemoveAssociation(crName, clusterSvc)
+	log.WithName("eks-nlb").Info("DeassociateLB", "cr", crName, "lb", lbName)
+	return nil
+}
+
+// DeassociatePorts removes listeners, target groups and inbound rules of ports
+// which are in oldSvc but not in newSvc
+func (e *EKSNLB) DeassociatePorts(crName types.NamespacedName, oldSvc, newSvc *corev1.Service) error {
+	lbName, ok := e.GetLBName(crName)
+	if !ok {
+		return nil
+	}
+	removed := e.HeldPorts(crName, removedPorts(oldSvc, newSvc))
+	if len(removed.Spec.Ports) == 0 {
+		return nil
+	}
+	if nlb := e.getNLB(lbName); nlb != nil {
+		lbSvc, svcName := e.GetLB(lbName), GetNamespacedName(oldSvc)
+		if err := e.removeListeners(removed, nlb); err != nil {
+			e.Eventf(lbSvc, corev1.EventTypeWarning, "DeleteListenersFailed", "Failed to delete listeners of removed ports for %s: %v", svcName, err)
+			return &AssociationError{Step: StepListeners, Err: err}
+		}
+		if err := e.removeInboundRules(removed, nlb); err != nil {
+			e.Eventf(lbSvc, corev1.EventTypeWarning, "DeleteFirewallRulesFailed", "Failed to delete inbound rules of removed ports for %s: %v", svcName, err)
+			return &AssociationError{Step: StepFirewall, Err: err}
+		}
+		e.Eventf(lbSvc, corev1.EventTypeNormal, "ListenersDeleted", "Deleted listeners and inbound rules of ports %v for %s", portNumbers(removed), svcName)
+	}
+	log.WithName("eks-nlb").Info("DeassociatePorts", "cr", crName, "lb", lbName, "ports", portNumbers(removed))
+	return nil
+}
+
+// CompleteMigration removes listeners, target groups and inbound rules of crName
+// from the LB it's being moved from
+func (e *EKSNLB) CompleteMigration(crName types.NamespacedName) error {
+	lbName, held, ok := e.GetMigration(crName)
+	if !ok {
+		return nil
+	}
+	if nlb := e.getNLB(lbName); nlb != nil && len(held.Spec.Ports) > 0 {
+		lbSvc, svcName := e.GetLB(lbName), GetNamespacedName(held)
+		if err := e.removeListeners(held, nlb); err != nil {
+			e.Eventf(lbSvc, corev1.EventTypeWarning, "DeleteListenersFailed", "Failed to delete listeners for %s moved to another LB: %v", svcName, err)
+			return &AssociationError{Step: StepListeners, Err: err}
+		}
+		if err := e.removeInboundRules(held, nlb); err != nil {
+			e.Eventf(lbSvc, corev1.EventTypeWarning, "DeleteFirewallRulesFailed", "Failed to delete inbound rules for %s moved to another LB: %v", svcName, err)
+			return &AssociationError{Step: StepFirewall, Err: err}
+		}
+		e.Eventf(lbSvc, corev1.EventTypeNormal, "ListenersDeleted", "Deleted listeners and inbound rules for %s moved to another LB", svcName)
+	}
+	e.EndMigration(crName)
+	return nil
+}
+
+func (e *EKSNLB) UpdateService(svc, lb *corev1.Service) (bool, bool) {
+	portUpdated := e.AssignPorts(svc, lb)
+	// don't need to update externalIP
+	return portUpdated, false
+}
+
+func (e *EKSNLB) getNLB(lbName types.NamespacedName) *elbv2.LoadBalancer {
+	e.cacheNLBLock.RLock()
+	defer e.cacheNLBLock.RUnlock()
+	return e.cacheNLB[lbName]
+}
+
+// queryNLB returns the NLB whose DNS name is hostname
+func (e *EKSNLB) queryNLB(hostname string) (*elbv2.LoadBalancer, error) {
+	if hostname == "" {
+		return nil, errors.New("hostname cannot be empty")
+	}
+	input := &elbv2.DescribeLoadBalancersInput{}
+	for {
+		result, err := e.elbv2Client.DescribeLoadBalancers(input)
+		metrics.ObserveCloudCall("eks-nlb", "DescribeLoadBalancers", err)
+		if err != nil {
+			return nil, err
+		}
+		for _, lb := range result.LoadBalancers {
+			if strings.EqualFold(aws.StringValue(lb.DNSName), hostname) {
+				return lb, nil
+			}
+		}
+		if aws.StringValue(result.NextMarker) == "" {
+			return nil, fmt.Errorf("no NLB is found with DNS name %s", hostname)
+		}
+		input.Marker = result.NextMarker
+	}
+}
+
+// listeners returns listeners of nlb keyed with the port they listen on
+func (e *EKSNLB) listeners(nlb *elbv2.LoadBalancer) (map[PortKey]*elbv2.Listener, error) {
+	listeners := make(map[PortKey]*elbv2.Listener)
+	input := &elbv2.DescribeListenersInput{LoadBalancerArn: nlb.LoadBalancerArn}
+	for {
+		result, err := e.elbv2Client.DescribeListeners(input)
+		metrics.ObserveCloudCall("eks-nlb", "DescribeListeners", err)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range result.Listeners {
+			key := PortKey{Protocol: corev1.Protocol(aws.StringValue(l.Protocol)), Port: int32(aws.Int64Value(l.Port))}
+			listeners[key] = l
+		}
+		if aws.StringValue(result.NextMarker) == "" {
+			return listeners, nil
+		}
+		input.Marker = result.NextMarker
+	}
+}
+
+// targets returns the nodes registered to nlb by the cloud provider, i.e. targets of the
+// target group any listener of nlb not created for tenants forwards to; the cloud provider
+// keeps them in sync with nodes of the cluster
+func (e *EKSNLB) targets(listeners map[PortKey]*elbv2.Listener) ([]*elbv2.TargetDescription, error) {
+	for _, l := range listeners {
+		for _, action := range l.DefaultActions {
+			if action.TargetGroupArn == nil || isTenantTargetGroup(aws.StringValue(action.TargetGroupArn)) {
+				continue
+			}
+			ids, err := e.registeredTargets(action.TargetGroupArn)
+			if err != nil {
+				return nil, err
+			}
+			var targets []*elbv2.TargetDescription
+			for _, id := range ids {
+				// the port is taken from the target group it's registered to
+				targets = append(targets, &elbv2.TargetDescription{Id: aws.String(id)})
+			}
+			if len(targets) > 0 {
+				return targets, nil
+			}
+		}
+	}
+	return nil, errors.New("no target is registered to the NLB")
+}
+
+// registeredTargets returns IDs of targets registered to the target group of tgArn
+// in sorted order
+func (e *EKSNLB) registeredTargets(tgArn *string) ([]string, error) {
+	result, err := e.elbv2Client.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{TargetGroupArn: tgArn})
+	metrics.ObserveCloudCall("eks-nlb", "DescribeTargetHealth", err)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, desc := range result.TargetHealthDescriptions {
+		ids = append(ids, aws.StringValue(desc.Target.Id))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// syncTargets registers nodes of nlb to target groups of tenant ports, and deregisters
+// the ones which are gone, as the cloud provider only keeps its own target groups in
+// sync with nodes of the cluster. It returns whether any target is changed.
+func (e *EKSNLB) syncTargets(nlb *elbv2.LoadBalancer) (bool, error) {
+	listeners, err := e.listeners(nlb)
+	if err != nil {
+		return false, err
+	}
+	var tgArns []*string
+	for _, l := range listeners {
+		for _, action := range l.DefaultActions {
+			if action.TargetGroupArn != nil && isTenantTargetGroup(aws.StringValue(action.TargetGroupArn)) {
+				tgArns = append(tgArns, action.TargetGroupArn)
+			}
+		}
+	}
+	if len(tgArns) == 0 {
+		return false, nil
+	}
+	nodes, err := e.targets(listeners)
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	for _, tgArn := range tgArns {
+		ids, err := e.registeredTargets(tgArn)
+		if err != nil {
+			return changed, err
+		}
+		stale := make(map[string]struct{}, len(ids))
+		for _, id := range ids {
+			stale[id] = struct{}{}
+		}
+		var toRegister, toDeregister []*elbv2.TargetDescription
+		for _, node := range nodes {
+			if _, ok := stale[aws.StringValue(node.Id)]; ok {
+				delete(stale, aws.StringValue(node.Id))
+			} else {
+				toRegister = append(toRegister, node)
+			}
+		}
+		for _, id := range ids {
+			if _, ok := stale[id]; ok {
+				toDeregister = append(toDeregister, &elbv2.TargetDescription{Id: aws.String(id)})
+			}
+		}
+		if len(toRegister) > 0 {
+			_, err := e.elbv2Client.RegisterTargets(&elbv2.RegisterTargetsInput{TargetGroupArn: tgArn, Targets: toRegister})
+			metrics.ObserveCloudCall("eks-nlb", "RegisterTargets", err)
+			if err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+		if len(toDeregister) > 0 {
+			_, err := e.elbv2Client.DeregisterTargets(&elbv2.DeregisterTargetsInput{TargetGroupArn: tgArn, Targets: toDeregister})
+			metrics.ObserveCloudCall("eks-nlb", "DeregisterTargets", err)
+			if err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// isTenantTargetGroup tells whether the target group of tgArn is created for a tenant
+// port, e.g. arn:aws:elasticloadbalancing:us-west-2:123456789012:targetgroup/slb-1a2b3c4d-tcp-80/73e2d6bc24d8a067
+func isTenantTargetGroup(tgArn string) bool {
+	return strings.Contains(tgArn, ":targetgroup/"+nlbTargetGroupPrefix+"-")
+}
+
+// targetGroupName returns the name of target group for port p of nlb; it's unique
+// per region and account, and no longer than 32 characters
+func targetGroupName(nlb *elbv2.LoadBalancer, p corev1.ServicePort) string {
+	key := PortKeyOf(p)
+	hash := fmt.Sprintf("%x", sha1.Sum([]byte(aws.StringValue(nlb.LoadBalancerArn))))
+	return fmt.Sprintf("%s-%s-%s-%d", nlbTargetGroupPrefix, hash[:8], strings.ToLower(string(key.Protocol)), key.Port)
+}
+
+// 1st return value means if it's executed
+// 2nd return value returns error if it's executed
+func (e *EKSNLB) createListeners(clusterSvc *corev1.Service, nlb *elbv2.LoadBalancer) (bool, error) {
+	if clusterSvc == nil || nlb == nil {
+		return false, errors.New("clusterSvc or nlb is nil")
+	}
+	listeners, err := e.listeners(nlb)
+	if err != nil {
+		return false, err
+	}
+	var toCreate []corev1.ServicePort
+	for _, p := range clusterSvc.Spec.Ports {
+		// check if it exists in nlb
+		if _, ok := listeners[PortKeyOf(p)]; !ok {
+			toCreate = append(toCreate, p)
+		}
+	}
+	if len(toCreate) == 0 {
+		return false, nil
+	}
+	targets, err := e.targets(listeners)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range toCreate {
+		protocol := string(PortKeyOf(p).Protocol)
+		healthCheckPort := int(p.NodePort)
+		if PortKeyOf(p).Protocol == corev1.ProtocolUDP {
+			healthCheckPort = e.healthzPort
+		}
+		// it returns the existing one if a target group with the same settings exists
+		tgResult, err := e.elbv2Client.CreateTargetGroup(&elbv2.CreateTargetGroupInput{
+			Name:       aws.String(targetGroupName(nlb, p)),
+			Protocol:   aws.String(protocol),
+			Port:       aws.Int64(int64(p.NodePort)),
+			VpcId:      nlb.VpcId,
+			TargetType: aws.String(elbv2.TargetTypeEnumInstance),
+			// NLB health checks UDP target groups over TCP as well, see healthzPort
+			HealthCheckProtocol: aws.String(elbv2.ProtocolEnumTcp),
+			HealthCheckPort:     aws.String(strconv.Itoa(healthCheckPort)),
+		})
+		metrics.ObserveCloudCall("eks-nlb", "CreateTargetGroup", err)
+		if err != nil {
+			return true, err
+		}
+		if len(tgResult.TargetGroups) != 1 {
+			return true, fmt.Errorf("got %d elbv2.TargetGroup, but expected 1", len(tgResult.TargetGroups))
+		}
+		tgArn := tgResult.TargetGroups[0].TargetGroupArn
+		_, err = e.elbv2Client.RegisterTargets(&elbv2.RegisterTargetsInput{
+			TargetGroupArn: tgArn,
+			Targets:        targets,
+		})
+		metrics.ObserveCloudCall("eks-nlb", "RegisterTargets", err)
+		if err != nil {
+			return true, err
+		}
+		_, err = e.elbv2Client.CreateListener(&elbv2.CreateListenerInput{
+			LoadBalancerArn: nlb.LoadBalancerArn,
+			Port:            aws.Int64(int64(p.Port)),
+			Protocol:        aws.String(protocol),
+			DefaultActions: []*elbv2.Action{
+				{
+					Type:           aws.String(elbv2.ActionTypeEnumForward),
+					TargetGroupArn: tgArn,
+				},
+			},
+		})
+		metrics.ObserveCloudCall("eks-nlb", "CreateListener", err)
+		// tolerate if the listener exists in server side
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == elbv2.ErrCodeDuplicateListenerException {
+			log.WithName("eks-nlb").Info("awserr", "code", aerr.Code())
+			continue
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// removeListeners deletes listeners of ports of clusterSvc, along with target
+// groups they forward to
+func (e *EKSNLB) removeListeners(clusterSvc *corev1.Service, nlb *elbv2.LoadBalancer) error {
+	if clusterSvc == nil || nlb == nil {
+		return errors.New("clusterSvc or nlb is nil")
+	}
+	listeners, err := e.listeners(nlb)
+	if err != nil {
+		return err
+	}
+	for _, p := range clusterSvc.Spec.Ports {
+		l, ok := listeners[PortKeyOf(p)]
+		if !ok {
+			continue
+		}
+		// a target group can't be deleted while a listener forwards to it
+		_, err := e.elbv2Client.DeleteListener(&elbv2.DeleteListenerInput{ListenerArn: l.ListenerArn})
+		metrics.ObserveCloudCall("eks-nlb", "DeleteListener", err)
+		if aerr, ok := err.(awserr.Error); err != nil && (!ok || aerr.Code() != elbv2.ErrCodeListenerNotFoundException) {
+			return err
+		}
+		for _, action := range l.DefaultActions {
+			if action.TargetGroupArn == nil {
+				continue
+			}
+			_, err := e.elbv2Client.DeleteTargetGroup(&elbv2.DeleteTargetGroupInput{TargetGroupArn: action.TargetGroupArn})
+			metrics.ObserveCloudCall("eks-nlb", "DeleteTargetGroup", err)
+			if aerr, ok := err.(awserr.Error); err != nil && (!ok || aerr.Code() != elbv2.ErrCodeTargetGroupNotFoundException) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nodeSecurityGroup returns the security group of nodes registered to nlb
+func (e *EKSNLB) nodeSecurityGroup(nlb *elbv2.LoadBalancer) (*string, error) {
+	listeners, err := e.listeners(nlb)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := e.targets(listeners)
+	if err != nil {
+		return nil, err
+	}
+	result, err := e.ec2Client.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{targets[0].Id},
+	})
+	metrics.ObserveCloudCall("eks-nlb", "DescribeInstances", err)
+	if err != nil {
+		return nil, err
+	}
+	for _, reservation := range result.Reservations {
+		for _, instance := range reservation.Instances {
+			// pick up the first security group
+			// TODO(Huang-Wei): what if multiple security groups are found
+			if len(instance.SecurityGroups) > 0 {
+				return instance.SecurityGroups[0].GroupId, nil
+			}
+		}
+	}
+	return nil, errors.New("no security group is attached to the nodes")
+}
+
+// nodePortPermissions returns inbound rules allowing clients to NodePorts of clusterSvc,
+// as NLB keeps client IPs
+func nodePortPermissions(clusterSvc *corev1.Service) []*ec2.IpPermission {
+	ipPermissions := make([]*ec2.IpPermission, 0)
+	for _, p := range clusterSvc.Spec.Ports {
+		permission := ec2.IpPermission{
+			FromPort:   aws.Int64(int64(p.NodePort)),
+			IpProtocol: aws.String(strings.ToLower(string(PortKeyOf(p).Protocol))),
+			IpRanges: []*ec2.IpRange{
+				{
+					CidrIp:      aws.String("0.0.0.0/0"),
+					Description: aws.String("Generated by shared-loadblancer"),
+				},
+			},
+			ToPort: aws.Int64(int64(p.NodePort)),
+		}
+		ipPermissions = append(ipPermissions, &permission)
+	}
+	return ipPermissions
+}
+
+// healthzPermission returns the inbound rule allowing NLB health checks from within
+// the VPC to kube-proxy healthz of nodes
+func (e *EKSNLB) healthzPermission(nlb *elbv2.LoadBalancer) (*ec2.IpPermission, error) {
+	result, err := e.ec2Client.DescribeVpcs(&ec2.DescribeVpcsInput{VpcIds: []*string{nlb.VpcId}})
+	metrics.ObserveCloudCall("eks-nlb", "DescribeVpcs", err)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Vpcs) != 1 {
+		return nil, fmt.Errorf("got %d ec2.Vpc, but expected 1", len(result.Vpcs))
+	}
+	return &ec2.IpPermission{
+		FromPort:   aws.Int64(int64(e.healthzPort)),
+		IpProtocol: aws.String("tcp"),
+		IpRanges: []*ec2.IpRange{
+			{
+				CidrIp:      result.Vpcs[0].CidrBlock,
+				Description: aws.String("Generated by shared-loadblancer"),
+			},
+		},
+		ToPort: aws.Int64(int64(e.healthzPort)),
+	}, nil
+}
+
+func hasUDPPort(svc *corev1.Service) bool {
+	for _, p := range svc.Spec.Ports {
+		if PortKeyOf(p).Protocol == corev1.ProtocolUDP {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *EKSNLB) createInboundRules(clusterSvc *corev1.Service, nlb *elbv2.LoadBalancer) error {
+	if clusterSvc == nil || nlb == nil {
+		return errors.New("clusterSvc or nlb is nil")
+	}
+	ipPermissions := nodePortPermissions(clusterSvc)
+	if len(ipPermissions) == 0 {
+		return nil
+	}
+	groupID, err := e.nodeSecurityGroup(nlb)
+	if err != nil {
+		return err
+	}
+	if err := e.authorizeIngress(groupID, ipPermissions); err != nil {
+		return err
+	}
+	if !hasUDPPort(clusterSvc) {
+		return nil
+	}
+	// it's shared by UDP target groups of all tenants, so it's authorized on its own
+	// and never revoked
+	healthz, err := e.healthzPermission(nlb)
+	if err != nil {
+		return err
+	}
+	return e.authorizeIngress(groupID, []*ec2.IpPermission{healthz})
+}
+
+func (e *EKSNLB) authorizeIngress(groupID *string, ipPermissions []*ec2.IpPermission) error {
+	_, err := e.ec2Client.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId:       groupID,
+		IpPermissions: ipPermissions,
+	})
+	metrics.ObserveCloudCall("eks-nlb", "AuthorizeSecurityGroupIngress", err)
+	// tolerate if the rules exist in server side
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidPermission.Duplicate" {
+		return nil
+	}
+	return err
+}
+
+func (e *EKSNLB) removeInboundRules(clusterSvc *corev1.Service, nlb *elbv2.LoadBalancer) error {
+	if clusterSvc == nil || nlb == nil {
+		return errors.New("clusterSvc or nlb is nil")
+	}
+	ipPermissions := nodePortPermissions(clusterSvc)
+	if len(ipPermissions) == 0 {
+		return nil
+	}
+	groupID, err := e.nodeSecurityGroup(nlb)
+	if err != nil {
+		return err
+	}
+	_, err = e.ec2Client.RevokeSecurityGroupIngress(&ec2.RevokeSecurityGroupIngressInput{
+		GroupId:       groupID,
+		IpPermissions: ipPermissions,
+	})
+	metrics.ObserveCloudCall("eks-nlb", "RevokeSecurityGroupIngress", err)
+	// tolerate if the rules don't exist in server side
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidPermission.NotFound" {
+		return nil
+	}
+	return err
+}
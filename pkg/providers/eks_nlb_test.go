@@ -0,0 +1,327 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// fakeELBV2 keeps listeners and target groups of NLBs in memory
+type fakeELBV2 struct {
+	elbv2iface.ELBV2API
+
+	lbs []*elbv2.LoadBalancer
+	// listeners is keyed with LB arn
+	listeners map[string][]*elbv2.Listener
+	// targetGroups is keyed with target group arn
+	targetGroups map[string]*elbv2.TargetGroup
+	// targets is keyed with target group arn
+	targets map[string][]*elbv2.TargetDescription
+}
+
+func newFakeELBV2() *fakeELBV2 {
+	f := &fakeELBV2{
+		listeners:    make(map[string][]*elbv2.Listener),
+		targetGroups: make(map[string]*elbv2.TargetGroup),
+		targets:      make(map[string][]*elbv2.TargetDescription),
+	}
+	// an NLB created by the cloud provider for a LB service, forwarding its
+	// placeholder port to node i-1
+	f.lbs = append(f.lbs, &elbv2.LoadBalancer{
+		LoadBalancerArn:  aws.String("arn:nlb-1"),
+		LoadBalancerName: aws.String("a1b2c3"),
+		DNSName:          aws.String("a1b2c3-123456.elb.us-west-2.amazonaws.com"),
+		VpcId:            aws.String("vpc-1"),
+	})
+	tg, _ := f.CreateTargetGroup(&elbv2.CreateTargetGroupInput{Name: aws.String("k8s-placeholder"), Protocol: aws.String("TCP"), Port: aws.Int64(31333)})
+	f.RegisterTargets(&elbv2.RegisterTargetsInput{
+		TargetGroupArn: tg.TargetGroups[0].TargetGroupArn,
+		Targets:        []*elbv2.TargetDescription{{Id: aws.String("i-1"), Port: aws.Int64(31333)}},
+	})
+	f.CreateListener(&elbv2.CreateListenerInput{
+		LoadBalancerArn: aws.String("arn:nlb-1"),
+		Port:            aws.Int64(33333),
+		Protocol:        aws.String("TCP"),
+		DefaultActions:  []*elbv2.Action{{Type: aws.String("forward"), TargetGroupArn: tg.TargetGroups[0].TargetGroupArn}},
+	})
+	return f
+}
+
+func (f *fakeELBV2) DescribeLoadBalancers(input *elbv2.DescribeLoadBalancersInput) (*elbv2.DescribeLoadBalancersOutput, error) {
+	return &elbv2.DescribeLoadBalancersOutput{LoadBalancers: f.lbs}, nil
+}
+
+func (f *fakeELBV2) DescribeListeners(input *elbv2.DescribeListenersInput) (*elbv2.DescribeListenersOutput, error) {
+	return &elbv2.DescribeListenersOutput{Listeners: f.listeners[aws.StringValue(input.LoadBalancerArn)]}, nil
+}
+
+func (f *fakeELBV2) DescribeTargetHealth(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+	output := &elbv2.DescribeTargetHealthOutput{}
+	for _, target := range f.targets[aws.StringValue(input.TargetGroupArn)] {
+		output.TargetHealthDescriptions = append(output.TargetHealthDescriptions, &elbv2.TargetHealthDescription{Target: target})
+	}
+	return output, nil
+}
+
+func (f *fakeELBV2) CreateTargetGroup(input *elbv2.CreateTargetGroupInput) (*elbv2.CreateTargetGroupOutput, error) {
+	arn := "arn:aws:elasticloadbalancing:us-west-2:123456789012:targetgroup/" + aws.StringValue(input.Name) + "/1"
+	if _, ok := f.targetGroups[arn]; !ok {
+		f.targetGroups[arn] = &elbv2.TargetGroup{
+			TargetGroupArn:  aws.String(arn),
+			TargetGroupName: input.Name,
+			Protocol:        input.Protocol,
+			Port:            input.Port,
+			HealthCheckPort: input.HealthCheckPort,
+		}
+	}
+	return &elbv2.CreateTargetGroupOutput{TargetGroups: []*elbv2.TargetGroup{f.targetGroups[arn]}}, nil
+}
+
+func (f *fakeELBV2) RegisterTargets(input *elbv2.RegisterTargetsInput) (*elbv2.RegisterTargetsOutput, error) {
+	arn := aws.StringValue(input.TargetGroupArn)
+	f.targets[arn] = append(f.targets[arn], input.Targets...)
+	return &elbv2.RegisterTargetsOutput{}, nil
+}
+
+func (f *fakeELBV2) DeregisterTargets(input *elbv2.DeregisterTargetsInput) (*elbv2.DeregisterTargetsOutput, error) {
+	arn := aws.StringValue(input.TargetGroupArn)
+	var kept []*elbv2.TargetDescription
+	for _, target := range f.targets[arn] {
+		deregistered := false
+		for _, t := range input.Targets {
+			deregistered = deregistered || *t.Id == *target.Id
+		}
+		if !deregistered {
+			kept = append(kept, target)
+		}
+	}
+	f.targets[arn] = kept
+	return &elbv2.DeregisterTargetsOutput{}, nil
+}
+
+func (f *fakeELBV2) CreateListener(input *elbv2.CreateListenerInput) (*elbv2.CreateListenerOutput, error) {
+	lbArn := aws.StringValue(input.LoadBalancerArn)
+	for _, l := range f.listeners[lbArn] {
+		if *l.Port == *input.Port && *l.Protocol == *input.Protocol {
+			return nil, awserr.New(elbv2.ErrCodeDuplicateListenerException, "duplicate listener", nil)
+		}
+	}
+	l := &elbv2.Listener{
+		ListenerArn:     aws.String(fmt.Sprintf("arn:listener/%s/%d", *input.Protocol, *input.Port)),
+		LoadBalancerArn: input.LoadBalancerArn,
+		Port:            input.Port,
+		Protocol:        input.Protocol,
+		DefaultActions:  input.DefaultActions,
+	}
+	f.listeners[lbArn] = append(f.listeners[lbArn], l)
+	return &elbv2.CreateListenerOutput{Listeners: []*elbv2.Listener{l}}, nil
+}
+
+func (f *fakeELBV2) DeleteListener(input *elbv2.DeleteListenerInput) (*elbv2.DeleteListenerOutput, error) {
+	for lbArn, listeners := range f.listeners {
+		for i, l := range listeners {
+			if *l.ListenerArn == *input.ListenerArn {
+				f.listeners[lbArn] = append(listeners[:i], listeners[i+1:]...)
+				return &elbv2.DeleteListenerOutput{}, nil
+			}
+		}
+	}
+	return nil, awserr.New(elbv2.ErrCodeListenerNotFoundException, "listener not found", nil)
+}
+
+func (f *fakeELBV2) DeleteTargetGroup(input *elbv2.DeleteTargetGroupInput) (*elbv2.DeleteTargetGroupOutput, error) {
+	delete(f.targetGroups, aws.StringValue(input.TargetGroupArn))
+	delete(f.targets, aws.StringValue(input.TargetGroupArn))
+	return &elbv2.DeleteTargetGroupOutput{}, nil
+}
+
+// setNodes replaces targets of the placeholder target group with nodes,
+// like the cloud provider does when nodes of the cluster change
+func (f *fakeELBV2) setNodes(nodes ...string) {
+	var targets []*elbv2.TargetDescription
+	for _, node := range nodes {
+		targets = append(targets, &elbv2.TargetDescription{Id: aws.String(node), Port: aws.Int64(31333)})
+	}
+	for arn, tg := range f.targetGroups {
+		if *tg.TargetGroupName == "k8s-placeholder" {
+			f.targets[arn] = targets
+		}
+	}
+}
+
+// tenantTargets returns "port/protocol: nodes" of listeners of tenants in sorted order
+func (f *fakeELBV2) tenantTargets() []string {
+	var result []string
+	for _, l := range f.listeners["arn:nlb-1"] {
+		if *l.Port == 33333 {
+			continue
+		}
+		var nodes []string
+		for _, target := range f.targets[*l.DefaultActions[0].TargetGroupArn] {
+			nodes = append(nodes, *target.Id)
+		}
+		sort.Strings(nodes)
+		result = append(result, fmt.Sprintf("%d/%s: %v", *l.Port, *l.Protocol, nodes))
+	}
+	sort.Strings(result)
+	return result
+}
+
+// ports returns ports of listeners on the NLB in sorted order
+func (f *fakeELBV2) ports() []string {
+	var ports []string
+	for _, l := range f.listeners["arn:nlb-1"] {
+		ports = append(ports, fmt.Sprintf("%d/%s", *l.Port, *l.Protocol))
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// fakeEC2 keeps inbound rules of security groups in memory
+type fakeEC2 struct {
+	ec2iface.EC2API
+
+	// rules is keyed with "sg/protocol/port"
+	rules map[string]bool
+}
+
+func (f *fakeEC2) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	return &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{{
+			Instances: []*ec2.Instance{{
+				InstanceId:     input.InstanceIds[0],
+				SecurityGroups: []*ec2.GroupIdentifier{{GroupId: aws.String("sg-node")}},
+			}},
+		}},
+	}, nil
+}
+
+func (f *fakeEC2) DescribeVpcs(input *ec2.DescribeVpcsInput) (*ec2.DescribeVpcsOutput, error) {
+	return &ec2.DescribeVpcsOutput{
+		Vpcs: []*ec2.Vpc{{VpcId: input.VpcIds[0], CidrBlock: aws.String("10.0.0.0/16")}},
+	}, nil
+}
+
+func (f *fakeEC2) AuthorizeSecurityGroupIngress(input *ec2.AuthorizeSecurityGroupIngressInput) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	for _, p := range input.IpPermissions {
+		f.rules[fmt.Sprintf("%s/%s/%d", *input.GroupId, *p.IpProtocol, *p.FromPort)] = true
+	}
+	return &ec2.AuthorizeSecurityGroupIngressOutput{}, nil
+}
+
+func (f *fakeEC2) RevokeSecurityGroupIngress(input *ec2.RevokeSecurityGroupIngressInput) (*ec2.RevokeSecurityGroupIngressOutput, error) {
+	for _, p := range input.IpPermissions {
+		delete(f.rules, fmt.Sprintf("%s/%s/%d", *input.GroupId, *p.IpProtocol, *p.FromPort))
+	}
+	return &ec2.RevokeSecurityGroupIngressOutput{}, nil
+}
+
+func TestEKSNLB(t *testing.T) {
+	elbv2Client, ec2Client := newFakeELBV2(), &fakeEC2{rules: make(map[string]bool)}
+	e := newEKSNLBProvider(elbv2Client, ec2Client)
+	lbName := types.NamespacedName{Name: "lb-1", Namespace: "default"}
+	lbSvc := newTestLBService("lb-1", false)
+	lbSvc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{Hostname: "a1b2c3-123456.elb.us-west-2.amazonaws.com"}}
+	e.UpdateCache(lbName, lbSvc)
+	if nlb := e.getNLB(lbName); nlb == nil || *nlb.LoadBalancerArn != "arn:nlb-1" {
+		t.Fatalf("getNLB() = %v, want the NLB exposed on the ingress hostname", nlb)
+	}
+
+	crName := types.NamespacedName{Name: "cr", Namespace: "default"}
+	clusterSvc := newTestClusterService(8080, 53)
+	clusterSvc.Name, clusterSvc.Namespace = "cr-service", "default"
+	clusterSvc.Spec.Ports[0].NodePort = 30080
+	clusterSvc.Spec.Ports[1].Protocol = corev1.ProtocolUDP
+	clusterSvc.Spec.Ports[1].NodePort = 30053
+	for i := 0; i < 2; i++ {
+		// it's idempotent
+		if err := e.AssociateLB(crName, lbName, clusterSvc); err != nil {
+			t.Fatalf("AssociateLB() error = %v", err)
+		}
+	}
+	if got, want := fmt.Sprint(elbv2Client.ports()), "[33333/TCP 53/UDP 8080/TCP]"; got != want {
+		t.Errorf("listeners = %v, want %v", got, want)
+	}
+	for _, l := range elbv2Client.listeners["arn:nlb-1"] {
+		tgArn := aws.StringValue(l.DefaultActions[0].TargetGroupArn)
+		tg, targets := elbv2Client.targetGroups[tgArn], elbv2Client.targets[tgArn]
+		if len(targets) != 1 || *targets[0].Id != "i-1" {
+			t.Errorf("targets of %s = %v, want node i-1", tgArn, targets)
+		}
+		switch {
+		case *l.Port == 33333:
+		case *tg.Protocol == "UDP" && *tg.HealthCheckPort != "10256":
+			// nothing answers the TCP health check on a UDP NodePort
+			t.Errorf("target group %s is health checked on port %s, want kube-proxy healthz 10256", tgArn, *tg.HealthCheckPort)
+		case *tg.Protocol == "TCP" && *tg.HealthCheckPort != fmt.Sprint(*tg.Port):
+			t.Errorf("target group %s is health checked on port %s, want its NodePort %d", tgArn, *tg.HealthCheckPort, *tg.Port)
+		}
+	}
+	if !ec2Client.rules["sg-node/tcp/30080"] || !ec2Client.rules["sg-node/udp/30053"] || !ec2Client.rules["sg-node/tcp/10256"] {
+		t.Errorf("inbound rules = %v, want NodePorts and kube-proxy healthz to be allowed", ec2Client.rules)
+	}
+
+	// node i-1 is replaced by i-2, targets of tenants follow on association
+	elbv2Client.setNodes("i-2")
+	if err := e.AssociateLB(crName, lbName, clusterSvc); err != nil {
+		t.Fatalf("AssociateLB() error = %v", err)
+	}
+	if got, want := fmt.Sprint(elbv2Client.tenantTargets()), "[53/UDP: [i-2] 8080/TCP: [i-2]]"; got != want {
+		t.Errorf("targets = %v, want %v", got, want)
+	}
+	// and on cache update of the LB
+	elbv2Client.setNodes("i-2", "i-3")
+	e.UpdateCache(lbName, lbSvc)
+	if got, want := fmt.Sprint(elbv2Client.tenantTargets()), "[53/UDP: [i-2 i-3] 8080/TCP: [i-2 i-3]]"; got != want {
+		t.Errorf("targets = %v, want %v", got, want)
+	}
+
+	// 53/UDP is removed
+	newSvc := clusterSvc.DeepCopy()
+	newSvc.Spec.Ports = newSvc.Spec.Ports[:1]
+	if err := e.DeassociatePorts(crName, clusterSvc, newSvc); err != nil {
+		t.Fatalf("DeassociatePorts() error = %v", err)
+	}
+	if got, want := fmt.Sprint(elbv2Client.ports()), "[33333/TCP 8080/TCP]"; got != want {
+		t.Errorf("listeners = %v, want %v", got, want)
+	}
+	if ec2Client.rules["sg-node/udp/30053"] {
+		t.Errorf("inbound rules = %v, want NodePort 30053 to be revoked", ec2Client.rules)
+	}
+
+	if err := e.DeassociateLB(crName, newSvc); err != nil {
+		t.Fatalf("DeassociateLB() error = %v", err)
+	}
+	if got, want := fmt.Sprint(elbv2Client.ports()), "[33333/TCP]"; got != want {
+		t.Errorf("listeners = %v, want %v", got, want)
+	}
+	// kube-proxy healthz may be health checked for other tenants
+	if len(elbv2Client.targetGroups) != 1 || len(ec2Client.rules) != 1 || !ec2Client.rules["sg-node/tcp/10256"] {
+		t.Errorf("target groups = %v, inbound rules = %v, want only the placeholder and kube-proxy healthz left", elbv2Client.targetGroups, ec2Client.rules)
+	}
+}
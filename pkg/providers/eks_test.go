@@ -0,0 +1,58 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestEKSForgetListeners(t *testing.T) {
+	lbName := types.NamespacedName{Name: "lb-1", Namespace: "default"}
+	newListener := func(port, nodePort int64) elb.Listener {
+		return elb.Listener{
+			InstancePort:     aws.Int64(nodePort),
+			InstanceProtocol: aws.String("tcp"),
+			LoadBalancerPort: aws.Int64(port),
+			Protocol:         aws.String("tcp"),
+		}
+	}
+	l80, l81 := newListener(80, 30080), newListener(81, 30081)
+	elbDesc := &elb.LoadBalancerDescription{
+		LoadBalancerName:     aws.String("a1b2c3"),
+		ListenerDescriptions: []*elb.ListenerDescription{{Listener: &l80}, {Listener: &l81}},
+	}
+	e := &EKS{
+		Allocator: NewAllocator("eks", corev1.ProtocolTCP),
+		cacheELB:  map[types.NamespacedName]*elb.LoadBalancerDescription{lbName: elbDesc},
+	}
+
+	e.forgetListeners(lbName, newTestClusterService(81))
+	cached := e.getELB(lbName)
+	if !isListenerExisted(l80, cached.ListenerDescriptions) || isListenerExisted(l81, cached.ListenerDescriptions) {
+		t.Errorf("cached listeners = %v, want only the one of port 80", cached.ListenerDescriptions)
+	}
+	if len(elbDesc.ListenerDescriptions) != 2 {
+		t.Errorf("the description read before is modified")
+	}
+	// it's a no-op for an unknown LB
+	e.forgetListeners(types.NamespacedName{Name: "lb-2", Namespace: "default"}, newTestClusterService(80))
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// AssociationStep is a step of AssociateLB which talks to the cloud
+type AssociationStep string
+
+const (
+	// StepListeners configures listeners (or LB rules) forwarding ports of the LB to the cluster
+	StepListeners AssociationStep = "Listeners"
+	// StepFirewall configures firewall (or security group) rules allowing traffic to the cluster
+	StepFirewall AssociationStep = "Firewall"
+)
+
+// AssociationError is returned by AssociateLB when a step of it fails
+type AssociationError struct {
+	Step AssociationStep
+	Err  error
+}
+
+func (e *AssociationError) Error() string {
+	return fmt.Sprintf("fail to configure %s: %v", e.Step, e.Err)
+}
+
+// FailedStep returns the step err is failed at, or "" if it's not an AssociationError
+func FailedStep(err error) AssociationStep {
+	if assocErr, ok := err.(*AssociationError); ok {
+		return assocErr.Step
+	}
+	return ""
+}
+
+// PortConflictError is returned when ports are held by other tenants of the LB
+type PortConflictError struct {
+	LB    types.NamespacedName
+	Ports []PortKey
+}
+
+func (e *PortConflictError) Error() string {
+	// the ports are taken on all LBs which could take the tenant
+	if e.LB.Name == "" {
+		return fmt.Sprintf("port(s) %v are in use on every LoadBalancer with a free slot", e.Ports)
+	}
+	return fmt.Sprintf("port(s) %v are in use by other tenants of LoadBalancer %s", e.Ports, e.LB)
+}
+
+// PortRangeExhaustedError is returned when ports left as 0 can't be assigned,
+// as all ports in range [Min, Max) are occupied
+type PortRangeExhaustedError struct {
+	// LB is empty if the range is too small even for an empty LB
+	LB       types.NamespacedName
+	Min, Max int32
+}
+
+func (e *PortRangeExhaustedError) Error() string {
+	if e.LB.Name == "" {
+		return fmt.Sprintf("not enough ports in range [%d, %d)", e.Min, e.Max)
+	}
+	return fmt.Sprintf("all ports in range [%d, %d) are occupied on LoadBalancer %s", e.Min, e.Max, e.LB)
+}
+
+// LBUnavailableError is returned when a LB asked for explicitly can't take a tenant
+type LBUnavailableError struct {
+	LB types.NamespacedName
+	// Reason is a one-word CamelCase reason, e.g. "LBFull"
+	Reason  string
+	Message string
+}
+
+func (e *LBUnavailableError) Error() string {
+	// the LB is unknown, e.g. no LB is exposed on the IP asked for
+	if e.LB.Name == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("LoadBalancer %s is unavailable: %s", e.LB, e.Message)
+}
+
+// UnsupportedProtocolError is returned when a port uses a protocol the provider's
+// LBs can't carry, e.g. UDP on a classic ELB
+type UnsupportedProtocolError struct {
+	Provider  string
+	Port      PortKey
+	Supported []corev1.Protocol
+}
+
+func (e *UnsupportedProtocolError) Error() string {
+	return fmt.Sprintf("port %s is not supported by provider %q, supported protocols are %v", e.Port, e.Provider, e.Supported)
+}
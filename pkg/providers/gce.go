@@ -0,0 +1,194 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/metrics"
+	"golang.org/x/oauth2/google"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Refs:
+// https://cloud.google.com/compute/docs/reference/rest/v1/
+// https://cloud.google.com/load-balancing/docs/network/
+
+// gceClient is the subset of GCE compute API used by GKE provider. Resources live in
+// one project, and regional ones in one region. Mutating calls return after the
+// operations they start are done.
+type gceClient interface {
+	GetForwardingRule(name string) (*compute.ForwardingRule, error)
+	InsertForwardingRule(rule *compute.ForwardingRule) error
+	DeleteForwardingRule(name string) error
+	InsertAddress(address *compute.Address) error
+	GetFirewall(name string) (*compute.Firewall, error)
+	InsertFirewall(firewall *compute.Firewall) error
+	DeleteFirewall(name string) error
+}
+
+// gceComputeClient implements gceClient on top of the compute service
+type gceComputeClient struct {
+	svc     *compute.Service
+	project string
+	region  string
+	// opTimeout is how long to wait for an operation to be done
+	opTimeout time.Duration
+}
+
+var _ gceClient = &gceComputeClient{}
+
+// newGCEComputeClient creates a gceClient with application default credentials, i.e.
+// the service account of the node or workload identity when running in GKE. Project
+// and region are discovered from instance metadata unless GCE_PROJECT_ID and GCE_REGION
+// are set, and GCE_ENDPOINT points it to another endpoint, e.g. an emulator.
+func newGCEComputeClient() (*gceComputeClient, error) {
+	project, region := GetEnvVal("GCE_PROJECT_ID", ""), GetEnvVal("GCE_REGION", "")
+	if (project == "" || region == "") && !metadata.OnGCE() {
+		return nil, fmt.Errorf("cannot discover gce project and region outside of GCE, set GCE_PROJECT_ID and GCE_REGION instead")
+	}
+	if project == "" {
+		id, err := metadata.ProjectID()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get gce project from instance metadata: %v", err)
+		}
+		project = id
+	}
+	if region == "" {
+		zone, err := metadata.Zone()
+		if err != nil {
+			return nil, fmt.Errorf("cannot get gce zone from instance metadata: %v", err)
+		}
+		// e.g. us-central1-a is in us-central1
+		region = zone[:strings.LastIndex(zone, "-")]
+	}
+
+	ctx := context.Background()
+	httpClient, err := google.DefaultClient(ctx, compute.ComputeScope)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create gce http client: %v", err)
+	}
+	svc, err := compute.New(httpClient)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create gce compute service: %v", err)
+	}
+	if endpoint := GetEnvVal("GCE_ENDPOINT", ""); endpoint != "" {
+		svc.BasePath = endpoint
+	}
+	log.WithName("gke").Info("New gce compute client", "project", project, "region", region, "endpoint", svc.BasePath)
+	return &gceComputeClient{
+		svc:       svc,
+		project:   project,
+		region:    region,
+		opTimeout: GetEnvValDuration("GCE_OPERATION_TIMEOUT", 2*time.Minute),
+	}, nil
+}
+
+func (c *gceComputeClient) GetForwardingRule(name string) (*compute.ForwardingRule, error) {
+	rule, err := c.svc.ForwardingRules.Get(c.project, c.region, name).Do()
+	metrics.ObserveCloudCall("gke", "ForwardingRulesGet", err)
+	return rule, err
+}
+
+func (c *gceComputeClient) InsertForwardingRule(rule *compute.ForwardingRule) error {
+	op, err := c.svc.ForwardingRules.Insert(c.project, c.region, rule).Do()
+	metrics.ObserveCloudCall("gke", "ForwardingRulesInsert", err)
+	return c.wait(op, err)
+}
+
+func (c *gceComputeClient) DeleteForwardingRule(name string) error {
+	op, err := c.svc.ForwardingRules.Delete(c.project, c.region, name).Do()
+	metrics.ObserveCloudCall("gke", "ForwardingRulesDelete", err)
+	return c.wait(op, err)
+}
+
+func (c *gceComputeClient) InsertAddress(address *compute.Address) error {
+	op, err := c.svc.Addresses.Insert(c.project, c.region, address).Do()
+	metrics.ObserveCloudCall("gke", "AddressesInsert", err)
+	return c.wait(op, err)
+}
+
+func (c *gceComputeClient) GetFirewall(name string) (*compute.Firewall, error) {
+	firewall, err := c.svc.Firewalls.Get(c.project, name).Do()
+	metrics.ObserveCloudCall("gke", "FirewallsGet", err)
+	return firewall, err
+}
+
+func (c *gceComputeClient) InsertFirewall(firewall *compute.Firewall) error {
+	op, err := c.svc.Firewalls.Insert(c.project, firewall).Do()
+	metrics.ObserveCloudCall("gke", "FirewallsInsert", err)
+	return c.wait(op, err)
+}
+
+func (c *gceComputeClient) DeleteFirewall(name string) error {
+	op, err := c.svc.Firewalls.Delete(c.project, name).Do()
+	metrics.ObserveCloudCall("gke", "FirewallsDelete", err)
+	return c.wait(op, err)
+}
+
+// wait polls op until it's done; err is the one of the call starting op
+func (c *gceComputeClient) wait(op *compute.Operation, err error) error {
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(c.opTimeout)
+	for op.Status != "DONE" {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("gce operation %s is not done in %v", op.Name, c.opTimeout)
+		}
+		time.Sleep(time.Second)
+		// firewalls are global resources, others are regional
+		if op.Region == "" {
+			op, err = c.svc.GlobalOperations.Get(c.project, op.Name).Do()
+		} else {
+			op, err = c.svc.RegionOperations.Get(c.project, c.region, op.Name).Do()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		// surface it as an API error, so that callers can check its code
+		return &googleapi.Error{
+			Code:    int(op.HttpErrorStatusCode),
+			Message: fmt.Sprintf("gce operation %s failed: %s %s", op.Name, op.Error.Errors[0].Code, op.Error.Errors[0].Message),
+		}
+	}
+	return nil
+}
+
+// isGCEErrorCode tells whether err is a GCE API error with HTTP status code
+func isGCEErrorCode(err error, code int) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == code
+}
+
+// isGCENotFound tells whether err means the resource doesn't exist
+func isGCENotFound(err error) bool {
+	return isGCEErrorCode(err, http.StatusNotFound)
+}
+
+// isGCEAlreadyExists tells whether err means the resource exists
+func isGCEAlreadyExists(err error) bool {
+	return isGCEErrorCode(err, http.StatusConflict)
+}
@@ -0,0 +1,365 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	compute "google.golang.org/api/compute/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	cloudprovider "k8s.io/cloud-provider"
+)
+
+// for a GKE loadbalancer service, the GCE cloud provider creates a forwarding rule, a
+// target pool and a firewall rule "k8s-fw-<name>", where name is
+// cloudprovider.DefaultLoadBalancerName(lbSvc), e.g. a2b4c6d8e0f2a4b6c8d0e2f4a6b8c0d2
+
+const (
+	// gceFirewallPrefix prefixes names of firewall rules, as the GCE cloud provider does
+	gceFirewallPrefix = "k8s-fw-"
+)
+
+// GKE stands for Google Kubernetes Engine. Each tenant port gets a forwarding rule on
+// the IP of the LB service, forwarding to its target pool. A target pool doesn't
+// translate ports, so packets reach the nodes on the tenant port, where kube-proxy
+// picks them up by externalIPs of the cluster service, as it's done for IKS. Firewall
+// rules are opened for the tenant ports on the nodes accordingly.
+type GKE struct {
+	*Allocator
+
+	client gceClient
+
+	// key is namespacedName of a LB Serivce, val is its forwarding rule
+	cacheFR     map[types.NamespacedName]*compute.ForwardingRule
+	cacheFRLock sync.RWMutex
+}
+
+var _ LBProvider = &GKE{}
+
+func init() {
+	RegisterProvider("gke", func() (LBProvider, error) {
+		client, err := newGCEComputeClient()
+		if err != nil {
+			return nil, err
+		}
+		return newGKEProvider(client), nil
+	})
+}
+
+func newGKEProvider(client gceClient) *GKE {
+	return &GKE{
+		Allocator: NewAllocator("gke"),
+		client:    client,
+		cacheFR:   make(map[types.NamespacedName]*compute.ForwardingRule),
+	}
+}
+
+func (g *GKE) UpdateCache(key types.NamespacedName, lbSvc *corev1.Service) {
+	g.Allocator.UpdateCache(key, lbSvc)
+	if lbSvc == nil {
+		g.cacheFRLock.Lock()
+		delete(g.cacheFR, key)
+		g.cacheFRLock.Unlock()
+	} else {
+		// handle forwarding rule stuff
+		if len(lbSvc.Status.LoadBalancer.Ingress) == 1 {
+			frName := cloudprovider.DefaultLoadBalancerName(lbSvc)
+			if result, err := g.client.GetForwardingRule(frName); err != nil {
+				log.WithName("gke").Error(err, "cannot query forwarding rule", "key", key, "frName", frName)
+			} else {
+				log.WithName("gke").Info("forwarding rule obj is updated in local cache", "key", key, "frName", frName)
+				g.cacheFRLock.Lock()
+				g.cacheFR[key] = result
+				g.cacheFRLock.Unlock()
+			}
+		}
+	}
+}
+
+func (g *GKE) NewService(sharedLB *kubeconv1alpha1.SharedLB) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sharedLB.Name + SvcPostfix,
+			Namespace: sharedLB.Namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Ports:    ExposedPorts(sharedLB),
+			Selector: sharedLB.Spec.Selector,
+		},
+	}
+}
+
+func (g *GKE) NewLBService() *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "lb-" + RandStringRunes(8),
+			Namespace: namespace,
+			Labels:    map[string]string{"lb-template": ""},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:     corev1.ServiceTypeLoadBalancer,
+			Selector: map[string]string{"app": "lb-placeholder"},
+			Ports: []corev1.ServicePort{
+				{
+					Name:     "tcp",
+					Protocol: corev1.ProtocolTCP,
+					Port:     33333,
+				},
+			},
+		},
+	}
+}
+
+func (g *GKE) AssociateLB(crName, lbName types.NamespacedName, clusterSvc *corev1.Service) error {
+	// a) create forwarding rules (gcloud compute forwarding-rules create)
+	// b) create firewall rules (gcloud compute firewall-rules create)
+	if clusterSvc != nil {
+		if fr := g.getFR(lbName); fr != nil {
+			lbSvc, svcName := g.GetLB(lbName), GetNamespacedName(clusterSvc)
+			executed, err := g.createForwardingRules(clusterSvc, fr)
+			if err != nil {
+				g.Eventf(lbSvc, corev1.EventTypeWarning, "CreateListenersFailed", "Failed to create forwarding rules for %s: %v", svcName, err)
+				return &AssociationError{Step: StepListeners, Err: err}
+			}
+			if executed {
+				g.Eventf(lbSvc, corev1.EventTypeNormal, "ListenersCreated", "Created forwarding rules for %s", svcName)
+			}
+			// firewall rules are checked on their own, as creating them may fail after
+			// forwarding rules are created
+			executed, err = g.createFirewallRules(clusterSvc, fr)
+			if err != nil {
+				g.Eventf(lbSvc, corev1.EventTypeWarning, "CreateFirewallRulesFailed", "Failed to create firewall rules for %s: %v", svcName, err)
+				return &AssociationError{Step: StepFirewall, Err: err}
+			}
+			if executed {
+				g.Eventf(lbSvc, corev1.EventTypeNormal, "FirewallRulesCreated", "Created firewall rules for %s", svcName)
+			}
+		}
+	}
+
+	// c) update internal cache
+	g.RestoreAssociation(crName, lbName, clusterSvc)
+	log.WithName("gke").Info("AssociateLB", "cr", crName, "lb", lbName)
+	return nil
+}
+
+// DeassociateLB is called by GKE finalizer to clean forwarding rules and firewall rules
+func (g *GKE) DeassociateLB(crName types.NamespacedName, clusterSvc *corev1.Service) error {
+	lbName, ok := g.GetLBName(crName)
+	if !ok {
+		return nil
+	}
+
+	// a) delete forwarding rules (gcloud compute forwarding-rules delete)
+	// b) delete firewall rules (gcloud compute firewall-rules delete)
+	if fr := g.getFR(lbName); fr != nil {
+		lbSvc, svcName := g.GetLB(lbName), GetNamespacedName(clusterSvc)
+		if err := g.removeRules(clusterSvc, fr); err != nil {
+			g.Eventf(lbSvc, corev1.EventTypeWarning, "DeleteListenersFailed", "Failed to delete forwarding and firewall rules for %s: %v", svcName, err)
+			return err
+		}
+		g.Eventf(lbSvc, corev1.EventTypeNormal, "ListenersDeleted", "Deleted forwarding and firewall rules for %s", svcName)
+	}
+
+	// c) update internal cache
+	g.RemoveAssociation(crName, clusterSvc)
+	log.WithName("gke").Info("DeassociateLB", "cr", crName, "lb", lbName)
+	return nil
+}
+
+// DeassociatePorts removes forwarding rules and firewall rules of ports which are
+// in oldSvc but not in newSvc
+func (g *GKE) DeassociatePorts(crName types.NamespacedName, oldSvc, newSvc *corev1.Service) error {
+	lbName, ok := g.GetLBName(crName)
+	if !ok {
+		return nil
+	}
+	removed := g.HeldPorts(crName, removedPorts(oldSvc, newSvc))
+	if len(removed.Spec.Ports) == 0 {
+		return nil
+	}
+	if fr := g.getFR(lbName); fr != nil {
+		lbSvc, svcName := g.GetLB(lbName), GetNamespacedName(oldSvc)
+		if err := g.removeRules(removed, fr); err != nil {
+			g.Eventf(lbSvc, corev1.EventTypeWarning, "DeleteListenersFailed", "Failed to delete forwarding and firewall rules of removed ports for %s: %v", svcName, err)
+			return &AssociationError{Step: StepListeners, Err: err}
+		}
+		g.Eventf(lbSvc, corev1.EventTypeNormal, "ListenersDeleted", "Deleted forwarding and firewall rules of ports %v for %s", portNumbers(removed), svcName)
+	}
+	log.WithName("gke").Info("DeassociatePorts", "cr", crName, "lb", lbName, "ports", portNumbers(removed))
+	return nil
+}
+
+// CompleteMigration removes forwarding rules and firewall rules of crName from the
+// LB it's being moved from
+func (g *GKE) CompleteMigration(crName types.NamespacedName) error {
+	lbName, held, ok := g.GetMigration(crName)
+	if !ok {
+		return nil
+	}
+	if fr := g.getFR(lbName); fr != nil && len(held.Spec.Ports) > 0 {
+		lbSvc, svcName := g.GetLB(lbName), GetNamespacedName(held)
+		if err := g.removeRules(held, fr); err != nil {
+			g.Eventf(lbSvc, corev1.EventTypeWarning, "DeleteListenersFailed", "Failed to delete forwarding and firewall rules for %s moved to another LB: %v", svcName, err)
+			return &AssociationError{Step: StepListeners, Err: err}
+		}
+		g.Eventf(lbSvc, corev1.EventTypeNormal, "ListenersDeleted", "Deleted forwarding and firewall rules for %s moved to another LB", svcName)
+	}
+	g.EndMigration(crName)
+	return nil
+}
+
+func (g *GKE) UpdateService(svc, lb *corev1.Service) (bool, bool) {
+	portUpdated := g.AssignPorts(svc, lb)
+	// packets are delivered to the nodes with the LB IP as destination
+	externalIPUpdated := updateExternalIP(svc, lb)
+	return portUpdated, externalIPUpdated
+}
+
+func (g *GKE) getFR(lbName types.NamespacedName) *compute.ForwardingRule {
+	g.cacheFRLock.RLock()
+	defer g.cacheFRLock.RUnlock()
+	return g.cacheFR[lbName]
+}
+
+// tenantRuleName returns the name of forwarding rule and firewall rule (with
+// gceFirewallPrefix) of port p on fr; it's no longer than 63 characters
+func tenantRuleName(fr *compute.ForwardingRule, p corev1.ServicePort) string {
+	key := PortKeyOf(p)
+	return fmt.Sprintf("%s-%s-%d", fr.Name, strings.ToLower(string(key.Protocol)), key.Port)
+}
+
+// 1st return value means if it's executed
+// 2nd return value returns error if it's executed
+func (g *GKE) createForwardingRules(clusterSvc *corev1.Service, fr *compute.ForwardingRule) (bool, error) {
+	if clusterSvc == nil || fr == nil {
+		return false, errors.New("clusterSvc or fr is nil")
+	}
+	var toCreate []corev1.ServicePort
+	for _, p := range clusterSvc.Spec.Ports {
+		// check if it exists in server side
+		_, err := g.client.GetForwardingRule(tenantRuleName(fr, p))
+		if isGCENotFound(err) {
+			toCreate = append(toCreate, p)
+		} else if err != nil {
+			return false, err
+		}
+	}
+	if len(toCreate) == 0 {
+		return false, nil
+	}
+
+	// an IP can only be shared by forwarding rules when it's static; inserting an
+	// address with the IP of fr promotes it, and as it's named after the LB, the
+	// GCE cloud provider releases it along with the LB
+	err := g.client.InsertAddress(&compute.Address{
+		Name:        fr.Name,
+		Address:     fr.IPAddress,
+		Description: "Generated by shared-loadbalancer",
+	})
+	if err != nil && !isGCEAlreadyExists(err) {
+		return true, err
+	}
+	for _, p := range toCreate {
+		err := g.client.InsertForwardingRule(&compute.ForwardingRule{
+			Name:        tenantRuleName(fr, p),
+			Description: fmt.Sprintf("Generated by shared-loadbalancer for %s", GetNamespacedName(clusterSvc)),
+			IPAddress:   fr.IPAddress,
+			IPProtocol:  string(PortKeyOf(p).Protocol),
+			PortRange:   fmt.Sprintf("%d-%d", p.Port, p.Port),
+			Target:      fr.Target,
+		})
+		// tolerate if the rule exists in server side
+		if err != nil && !isGCEAlreadyExists(err) {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// 1st return value means if it's executed
+// 2nd return value returns error if it's executed
+func (g *GKE) createFirewallRules(clusterSvc *corev1.Service, fr *compute.ForwardingRule) (bool, error) {
+	if clusterSvc == nil || fr == nil {
+		return false, errors.New("clusterSvc or fr is nil")
+	}
+	var toCreate []corev1.ServicePort
+	for _, p := range clusterSvc.Spec.Ports {
+		// check if it exists in server side
+		_, err := g.client.GetFirewall(gceFirewallPrefix + tenantRuleName(fr, p))
+		if isGCENotFound(err) {
+			toCreate = append(toCreate, p)
+		} else if err != nil {
+			return false, err
+		}
+	}
+	if len(toCreate) == 0 {
+		return false, nil
+	}
+
+	// network, nodes and sources are the same as the ones of the LB itself
+	lbFirewall, err := g.client.GetFirewall(gceFirewallPrefix + fr.Name)
+	if err != nil {
+		return true, err
+	}
+	for _, p := range toCreate {
+		err := g.client.InsertFirewall(&compute.Firewall{
+			Name:        gceFirewallPrefix + tenantRuleName(fr, p),
+			Description: fmt.Sprintf("Generated by shared-loadbalancer for %s", GetNamespacedName(clusterSvc)),
+			Network:     lbFirewall.Network,
+			Direction:   "INGRESS",
+			Allowed: []*compute.FirewallAllowed{
+				{
+					IPProtocol: strings.ToLower(string(PortKeyOf(p).Protocol)),
+					Ports:      []string{strconv.Itoa(int(p.Port))},
+				},
+			},
+			SourceRanges: lbFirewall.SourceRanges,
+			TargetTags:   lbFirewall.TargetTags,
+		})
+		// tolerate if the rule exists in server side
+		if err != nil && !isGCEAlreadyExists(err) {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// removeRules deletes forwarding rules and firewall rules of ports of clusterSvc
+func (g *GKE) removeRules(clusterSvc *corev1.Service, fr *compute.ForwardingRule) error {
+	if clusterSvc == nil || fr == nil {
+		return errors.New("clusterSvc or fr is nil")
+	}
+	for _, p := range clusterSvc.Spec.Ports {
+		name := tenantRuleName(fr, p)
+		// tolerate if the rules don't exist in server side
+		if err := g.client.DeleteForwardingRule(name); err != nil && !isGCENotFound(err) {
+			return err
+		}
+		if err := g.client.DeleteFirewall(gceFirewallPrefix + name); err != nil && !isGCENotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+// fakeGCE keeps forwarding rules, addresses and firewalls in memory
+type fakeGCE struct {
+	forwardingRules map[string]*compute.ForwardingRule
+	addresses       map[string]*compute.Address
+	firewalls       map[string]*compute.Firewall
+	// inserts counts calls of Insert*
+	inserts int
+}
+
+var _ gceClient = &fakeGCE{}
+
+func newFakeGCE() *fakeGCE {
+	// the ones created by the GCE cloud provider for the LB service
+	return &fakeGCE{
+		forwardingRules: map[string]*compute.ForwardingRule{
+			"a1b2c3": {Name: "a1b2c3", IPAddress: "1.2.3.4", IPProtocol: "TCP", PortRange: "33333-33333", Target: "targetPools/a1b2c3"},
+		},
+		addresses: make(map[string]*compute.Address),
+		firewalls: map[string]*compute.Firewall{
+			"k8s-fw-a1b2c3": {Name: "k8s-fw-a1b2c3", Network: "default", SourceRanges: []string{"0.0.0.0/0"}, TargetTags: []string{"gke-node"}},
+		},
+	}
+}
+
+func (f *fakeGCE) GetForwardingRule(name string) (*compute.ForwardingRule, error) {
+	if rule, ok := f.forwardingRules[name]; ok {
+		return rule, nil
+	}
+	return nil, &googleapi.Error{Code: http.StatusNotFound}
+}
+
+func (f *fakeGCE) InsertForwardingRule(rule *compute.ForwardingRule) error {
+	f.inserts++
+	if _, ok := f.forwardingRules[rule.Name]; ok {
+		return &googleapi.Error{Code: http.StatusConflict}
+	}
+	// an IP in use can only be shared when it's static
+	for _, existing := range f.forwardingRules {
+		if existing.IPAddress == rule.IPAddress && !f.isStatic(rule.IPAddress) {
+			return &googleapi.Error{Code: http.StatusBadRequest, Message: "IP is in use"}
+		}
+	}
+	f.forwardingRules[rule.Name] = rule
+	return nil
+}
+
+func (f *fakeGCE) isStatic(ip string) bool {
+	for _, address := range f.addresses {
+		if address.Address == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeGCE) DeleteForwardingRule(name string) error {
+	if _, ok := f.forwardingRules[name]; !ok {
+		return &googleapi.Error{Code: http.StatusNotFound}
+	}
+	delete(f.forwardingRules, name)
+	return nil
+}
+
+func (f *fakeGCE) InsertAddress(address *compute.Address) error {
+	f.inserts++
+	if _, ok := f.addresses[address.Name]; ok {
+		return &googleapi.Error{Code: http.StatusConflict}
+	}
+	f.addresses[address.Name] = address
+	return nil
+}
+
+func (f *fakeGCE) GetFirewall(name string) (*compute.Firewall, error) {
+	if firewall, ok := f.firewalls[name]; ok {
+		return firewall, nil
+	}
+	return nil, &googleapi.Error{Code: http.StatusNotFound}
+}
+
+func (f *fakeGCE) InsertFirewall(firewall *compute.Firewall) error {
+	f.inserts++
+	if _, ok := f.firewalls[firewall.Name]; ok {
+		return &googleapi.Error{Code: http.StatusConflict}
+	}
+	f.firewalls[firewall.Name] = firewall
+	return nil
+}
+
+func (f *fakeGCE) DeleteFirewall(name string) error {
+	if _, ok := f.firewalls[name]; !ok {
+		return &googleapi.Error{Code: http.StatusNotFound}
+	}
+	delete(f.firewalls, name)
+	return nil
+}
+
+// ports returns "port/protocol" of forwarding rules on ip in sorted order
+func (f *fakeGCE) ports(ip string) []string {
+	var ports []string
+	for _, rule := range f.forwardingRules {
+		if rule.IPAddress == ip {
+			ports = append(ports, fmt.Sprintf("%s/%s", rule.PortRange, rule.IPProtocol))
+		}
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// firewallNames returns names of firewalls in sorted order
+func (f *fakeGCE) firewallNames() []string {
+	var names []string
+	for name := range f.firewalls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestGKE(t *testing.T) {
+	client := newFakeGCE()
+	g := newGKEProvider(client)
+	recorder := record.NewFakeRecorder(10)
+	g.InjectRecorder(recorder)
+	lbName := types.NamespacedName{Name: "lb-1", Namespace: "default"}
+	lbSvc := newTestLBService("lb-1", true)
+	// the GCE cloud provider names resources "a" + UID without dashes
+	lbSvc.UID = "1b2c3"
+	g.UpdateCache(lbName, lbSvc)
+	if fr := g.getFR(lbName); fr == nil || fr.Name != "a1b2c3" {
+		t.Fatalf("getFR() = %v, want the forwarding rule of the LB service", fr)
+	}
+
+	crName := types.NamespacedName{Name: "cr", Namespace: "default"}
+	clusterSvc := newTestClusterService(8080, 53)
+	clusterSvc.Name, clusterSvc.Namespace = "cr-service", "default"
+	clusterSvc.Spec.Ports[1].Protocol = corev1.ProtocolUDP
+	if _, externalIPUpdated := g.UpdateService(clusterSvc, lbSvc); !externalIPUpdated || !reflect.DeepEqual(clusterSvc.Spec.ExternalIPs, []string{"1.2.3.4"}) {
+		t.Errorf("UpdateService() set externalIPs %v, want the LB IP", clusterSvc.Spec.ExternalIPs)
+	}
+	if err := g.AssociateLB(crName, lbName, clusterSvc); err != nil {
+		t.Fatalf("AssociateLB() error = %v", err)
+	}
+	// an address, and a forwarding rule and a firewall per port
+	if client.inserts != 5 || len(recorder.Events) != 2 {
+		t.Errorf("AssociateLB() inserted %d resources and emitted %d events, want 5 and 2", client.inserts, len(recorder.Events))
+	}
+	// nothing is inserted as all exist
+	inserts, events := client.inserts, len(recorder.Events)
+	if err := g.AssociateLB(crName, lbName, clusterSvc); err != nil {
+		t.Fatalf("AssociateLB() error = %v", err)
+	}
+	if client.inserts != inserts || len(recorder.Events) != events {
+		t.Errorf("AssociateLB() inserted %d resources and emitted %d events again, want none", client.inserts-inserts, len(recorder.Events)-events)
+	}
+	if client.addresses["a1b2c3"] == nil || client.addresses["a1b2c3"].Address != "1.2.3.4" {
+		t.Errorf("addresses = %v, want the LB IP to be promoted to static", client.addresses)
+	}
+	if got, want := fmt.Sprint(client.ports("1.2.3.4")), "[33333-33333/TCP 53-53/UDP 8080-8080/TCP]"; got != want {
+		t.Errorf("forwarding rules = %v, want %v", got, want)
+	}
+	if rule := client.forwardingRules["a1b2c3-udp-53"]; rule == nil || rule.Target != "targetPools/a1b2c3" {
+		t.Errorf("forwarding rule of 53/UDP = %v, want it to forward to the target pool of the LB", rule)
+	}
+	firewall := client.firewalls["k8s-fw-a1b2c3-udp-53"]
+	if firewall == nil || firewall.Allowed[0].IPProtocol != "udp" || firewall.Allowed[0].Ports[0] != "53" ||
+		!reflect.DeepEqual(firewall.TargetTags, []string{"gke-node"}) {
+		t.Errorf("firewall of 53/UDP = %v, want it to open port 53 on nodes of the LB", firewall)
+	}
+
+	// 53/UDP is removed
+	newSvc := clusterSvc.DeepCopy()
+	newSvc.Spec.Ports = newSvc.Spec.Ports[:1]
+	if err := g.DeassociatePorts(crName, clusterSvc, newSvc); err != nil {
+		t.Fatalf("DeassociatePorts() error = %v", err)
+	}
+	if got, want := fmt.Sprint(client.ports("1.2.3.4")), "[33333-33333/TCP 8080-8080/TCP]"; got != want {
+		t.Errorf("forwarding rules = %v, want %v", got, want)
+	}
+	if got, want := fmt.Sprint(client.firewallNames()), "[k8s-fw-a1b2c3 k8s-fw-a1b2c3-tcp-8080]"; got != want {
+		t.Errorf("firewalls = %v, want %v", got, want)
+	}
+
+	if err := g.DeassociateLB(crName, newSvc); err != nil {
+		t.Fatalf("DeassociateLB() error = %v", err)
+	}
+	if got, want := fmt.Sprint(client.ports("1.2.3.4")), "[33333-33333/TCP]"; got != want {
+		t.Errorf("forwarding rules = %v, want %v", got, want)
+	}
+	if got, want := fmt.Sprint(client.firewallNames()), "[k8s-fw-a1b2c3]"; got != want {
+		t.Errorf("firewalls = %v, want %v", got, want)
+	}
+}
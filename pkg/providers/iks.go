@@ -18,7 +18,6 @@ package providers
 
 import (
 	"errors"
-	"fmt"
 
 	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
@@ -28,40 +27,20 @@ import (
 
 // IKS stands for IBM Kubernetes Service
 type IKS struct {
-	// key is namespacedName of a LB Serivce, val is the service
-	cacheMap map[types.NamespacedName]*corev1.Service
-
-	// cr to LB is 1:1 mapping
-	crToLB map[types.NamespacedName]types.NamespacedName
-	// lb to CRD is 1:N mapping
-	lbToCRs map[types.NamespacedName]nameSet
-	// lbToPorts is keyed with ns/name of a LB, and valued with ports info it holds
-	lbToPorts map[types.NamespacedName]int32Set
-
-	capacityPerLB int
+	*Allocator
 }
 
 var _ LBProvider = &IKS{}
 
-func newIKSProvider() *IKS {
-	return &IKS{
-		cacheMap:      make(map[types.NamespacedName]*corev1.Service),
-		crToLB:        make(map[types.NamespacedName]types.NamespacedName),
-		lbToCRs:       make(map[types.NamespacedName]nameSet),
-		lbToPorts:     make(map[types.NamespacedName]int32Set),
-		capacityPerLB: capacity,
-	}
-}
-
-func (i *IKS) GetCapacityPerLB() int {
-	return i.capacityPerLB
+func init() {
+	RegisterProvider("iks", func() (LBProvider, error) {
+		return newIKSProvider(), nil
+	})
 }
 
-func (i *IKS) UpdateCache(key types.NamespacedName, lbSvc *corev1.Service) {
-	if lbSvc == nil {
-		delete(i.cacheMap, key)
-	} else {
-		i.cacheMap[key] = lbSvc
+func newIKSProvider() *IKS {
+	return &IKS{
+		Allocator: NewAllocator("iks"),
 	}
 }
 
@@ -72,7 +51,7 @@ func (i *IKS) NewService(sharedLB *kubeconv1alpha1.SharedLB) *corev1.Service {
 			Namespace: sharedLB.Namespace,
 		},
 		Spec: corev1.ServiceSpec{
-			Ports:    sharedLB.Spec.Ports,
+			Ports:    ExposedPorts(sharedLB),
 			Selector: sharedLB.Spec.Selector,
 		},
 	}
@@ -92,63 +71,23 @@ func (i *IKS) NewLBService() *corev1.Service {
 					Protocol: corev1.ProtocolTCP,
 					Port:     33333,
 				},
-				// TODO(Huang-Wei): handle UDP case
-				// {
-				// 	Name:     "UDP",
-				// 	Protocol: corev1.ProtocolUDP,
-				// 	Port:     33333,
-				// },
+				// tenants are exposed by externalIPs of their own Services, so UDP
+				// tenants need no UDP port here; Kubernetes rejects a LoadBalancer
+				// Service mixing TCP and UDP anyway
 			},
 			Type: corev1.ServiceTypeLoadBalancer,
 		},
 	}
 }
 
-func (i *IKS) GetAvailabelLB(clusterSvc *corev1.Service) *corev1.Service {
-	// we leverage the randomness of golang "for range" when iterating
-OUTERLOOP:
-	for lbKey, lbSvc := range i.cacheMap {
-		if len(i.lbToCRs[lbKey]) >= i.capacityPerLB || len(lbSvc.Status.LoadBalancer.Ingress) == 0 {
-			continue
-		}
-		// must satisfy that all svc ports are not occupied in lbSvc
-		for _, svcPort := range clusterSvc.Spec.Ports {
-			if i.lbToPorts[lbKey] == nil {
-				i.lbToPorts[lbKey] = int32Set{}
-			}
-			if _, ok := i.lbToPorts[lbKey][svcPort.Port]; ok {
-				log.WithName("iks").Info(fmt.Sprintf("incoming service has port conflict with lbSvc %q on port %d", lbKey, svcPort.Port))
-				continue OUTERLOOP
-			}
-		}
-		return lbSvc
-	}
-	return nil
-}
-
 func (i *IKS) AssociateLB(crName, lbName types.NamespacedName, clusterSvc *corev1.Service) error {
 	if clusterSvc != nil {
-		if lbSvc, ok := i.cacheMap[lbName]; !ok || len(lbSvc.Status.LoadBalancer.Ingress) == 0 {
+		if !i.IsLBReady(lbName) {
 			return errors.New("LoadBalancer service not exist yet")
 		}
-		// upon program starts, i.lbToPorts[lbName] can be nil
-		if i.lbToPorts[lbName] == nil {
-			i.lbToPorts[lbName] = int32Set{}
-		}
-		// update crToPorts
-		for _, svcPort := range clusterSvc.Spec.Ports {
-			i.lbToPorts[lbName][svcPort.Port] = struct{}{}
-		}
 	}
 
-	// following code might be called multiple times, but shouldn't impact
-	// performance a lot as all of them are O(1) operation
-	_, ok := i.lbToCRs[lbName]
-	if !ok {
-		i.lbToCRs[lbName] = make(nameSet)
-	}
-	i.lbToCRs[lbName][crName] = struct{}{}
-	i.crToLB[crName] = lbName
+	i.RestoreAssociation(crName, lbName, clusterSvc)
 	log.WithName("iks").Info("AssociateLB", "cr", crName, "lb", lbName)
 	return nil
 }
@@ -157,24 +96,14 @@ func (i *IKS) AssociateLB(crName, lbName types.NamespacedName, clusterSvc *corev
 // no IaaS things should be done for IKS
 func (i *IKS) DeassociateLB(crName types.NamespacedName, clusterSvc *corev1.Service) error {
 	// update internal cache
-	if lb, ok := i.crToLB[crName]; ok {
-		delete(i.crToLB, crName)
-		delete(i.lbToCRs[lb], crName)
-		for _, svcPort := range clusterSvc.Spec.Ports {
-			delete(i.lbToPorts[lb], svcPort.Port)
-		}
+	if lb, ok := i.RemoveAssociation(crName, clusterSvc); ok {
 		log.WithName("iks").Info("DeassociateLB", "cr", crName, "lb", lb)
 	}
 	return nil
 }
 
 func (i *IKS) UpdateService(svc, lb *corev1.Service) (bool, bool) {
-	lbName := types.NamespacedName{Name: lb.Name, Namespace: lb.Namespace}
-	occupiedPorts := i.lbToPorts[lbName]
-	if len(occupiedPorts) == 0 {
-		occupiedPorts = int32Set{}
-	}
-	portUpdated := updatePort(svc, lb, occupiedPorts)
+	portUpdated := i.AssignPorts(svc, lb)
 	externalIPUpdated := updateExternalIP(svc, lb)
 	return portUpdated, externalIPUpdated
 }
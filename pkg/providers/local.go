@@ -18,7 +18,6 @@ package providers
 
 import (
 	"errors"
-	"fmt"
 
 	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
@@ -27,39 +26,23 @@ import (
 )
 
 type Local struct {
-	// key is namespacedName of a LB Serivce, val is the service
-	cacheMap map[types.NamespacedName]*corev1.Service
-
-	// cr to LB is 1:1 mapping
-	crToLB map[types.NamespacedName]types.NamespacedName
-	// lb to CRD is 1:N mapping
-	lbToCRs map[types.NamespacedName]nameSet
-	// lbToPorts is keyed with ns/name of a LB, and valued with ports info it holds
-	lbToPorts map[types.NamespacedName]int32Set
-
-	capacityPerLB int
+	*Allocator
 }
 
 var _ LBProvider = &Local{}
 
+func init() {
+	RegisterProvider("local", func() (LBProvider, error) {
+		return newLocalProvider(), nil
+	})
+}
+
 func newLocalProvider() *Local {
 	return &Local{
-		cacheMap:      make(map[types.NamespacedName]*corev1.Service),
-		crToLB:        make(map[types.NamespacedName]types.NamespacedName),
-		lbToCRs:       make(map[types.NamespacedName]nameSet),
-		lbToPorts:     make(map[types.NamespacedName]int32Set),
-		capacityPerLB: capacity,
+		Allocator: NewAllocator("local"),
 	}
 }
 
-func (l *Local) GetCapacityPerLB() int {
-	return l.capacityPerLB
-}
-
-func (l *Local) UpdateCache(key types.NamespacedName, val *corev1.Service) {
-	l.cacheMap[key] = val
-}
-
 func (l *Local) NewService(sharedLB *kubeconv1alpha1.SharedLB) *corev1.Service {
 	return &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
@@ -67,7 +50,7 @@ func (l *Local) NewService(sharedLB *kubeconv1alpha1.SharedLB) *corev1.Service {
 			Namespace: sharedLB.Namespace,
 		},
 		Spec: corev1.ServiceSpec{
-			Ports:    sharedLB.Spec.Ports,
+			Ports:    ExposedPorts(sharedLB),
 			Selector: sharedLB.Spec.Selector,
 		},
 	}
@@ -91,71 +74,29 @@ func (l *Local) NewLBService() *corev1.Service {
 	}
 }
 
-func (l *Local) GetAvailabelLB(clusterSvc *corev1.Service) *corev1.Service {
-	// we leverage the randomness of golang "for range" when iterating
-OUTERLOOP:
-	for lbKey, lbSvc := range l.cacheMap {
-		if len(l.lbToCRs[lbKey]) >= l.capacityPerLB {
-			continue
-		}
-		// must satisfy that all svc ports are not occupied in lbSvc
-		for _, svcPort := range clusterSvc.Spec.Ports {
-			if l.lbToPorts[lbKey] == nil {
-				l.lbToPorts[lbKey] = int32Set{}
-			}
-			if _, ok := l.lbToPorts[lbKey][svcPort.Port]; ok {
-				log.WithName("local").Info(fmt.Sprintf("incoming service has port conflict with lbSvc %q on port %d", lbKey, svcPort.Port))
-				continue OUTERLOOP
-			}
-		}
-		return lbSvc
-	}
-	return nil
-}
-
 func (l *Local) AssociateLB(crName, lbName types.NamespacedName, clusterSvc *corev1.Service) error {
 	if clusterSvc != nil {
 		// for a local (dev) env, we need some 3rd party network L2/L3 solution to work
 		// as a "LoadBalancer" provider, e.g. metallb
-		if lbSvc, ok := l.cacheMap[lbName]; !ok || len(lbSvc.Status.LoadBalancer.Ingress) == 0 {
+		if !l.IsLBReady(lbName) {
 			return errors.New("LoadBalancer service not exist yet")
 		}
-		// upon program starts, l.lbToPorts[lbName] can be nil
-		if l.lbToPorts[lbName] == nil {
-			l.lbToPorts[lbName] = int32Set{}
-		}
-		// update crToPorts
-		for _, svcPort := range clusterSvc.Spec.Ports {
-			l.lbToPorts[lbName][svcPort.Port] = struct{}{}
-		}
 	}
 
-	// following code might be called multiple times, but shouldn't impact
-	// performance a lot as all of them are O(1) operation
-	_, ok := l.lbToCRs[lbName]
-	if !ok {
-		l.lbToCRs[lbName] = make(nameSet)
-	}
-	l.lbToCRs[lbName][crName] = struct{}{}
-	l.crToLB[crName] = lbName
+	l.RestoreAssociation(crName, lbName, clusterSvc)
 	log.WithName("local").Info("AssociateLB", "cr", crName, "lb", lbName)
 	return nil
 }
 
 func (l *Local) DeassociateLB(crName types.NamespacedName, clusterSvc *corev1.Service) error {
 	// update internal cache
-	if lb, ok := l.crToLB[crName]; ok {
-		delete(l.crToLB, crName)
-		delete(l.lbToCRs[lb], crName)
-		for _, svcPort := range clusterSvc.Spec.Ports {
-			delete(l.lbToPorts[lb], svcPort.Port)
-		}
+	if lb, ok := l.RemoveAssociation(crName, clusterSvc); ok {
 		log.WithName("local").Info("DeassociateLB", "crName", crName, "lb", lb)
 	}
 	return nil
 }
 
 func (l *Local) UpdateService(svc, lb *corev1.Service) (bool, bool) {
-	// nothing to do with local provider here
-	return false, false
+	portUpdated := l.AssignPorts(svc, lb)
+	return portUpdated, false
 }
@@ -0,0 +1,206 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// TargetLBAnnotation is the annotation on a SharedLB asking for it to be moved onto
+// a specific LB Service, in format of "namespace/name" or "name" (in the namespace
+// LB Services are created in)
+const TargetLBAnnotation = "sharedlb.kubecon.k8s.io/target-lb"
+
+// ConsolidatedAnnotation is valued with the TargetLBAnnotation set by consolidator;
+// unlike the one set by users, it doesn't pin the SharedLB to the target, and both are
+// removed once the SharedLB is moved
+const ConsolidatedAnnotation = "sharedlb.kubecon.k8s.io/consolidated-to"
+
+// ParseLBName converts a reference to a LB Service, in format of "namespace/name"
+// or "name", to a NamespacedName
+func ParseLBName(ref string) (types.NamespacedName, error) {
+	strs := strings.Split(ref, "/")
+	switch {
+	case len(strs) == 1 && strs[0] != "":
+		return types.NamespacedName{Namespace: namespace, Name: strs[0]}, nil
+	case len(strs) == 2 && strs[0] != "" && strs[1] != "":
+		return types.NamespacedName{Namespace: strs[0], Name: strs[1]}, nil
+	}
+	return types.NamespacedName{}, fmt.Errorf("invalid LoadBalancer reference %q", ref)
+}
+
+// migration is a move of a cr from one LB to another which is not completed yet
+type migration struct {
+	// lb is the source LB
+	lb types.NamespacedName
+	// svc carries ports held by the cr on lb until the move is completed
+	svc *corev1.Service
+}
+
+// checkLB tells whether lbName can take crName along with ports of clusterSvc, and returns
+// a copy of clusterSvc in which ports taken are left as 0 in flexible mode; it must be
+// called with a.lock held
+func (a *Allocator) checkLB(crName, lbName types.NamespacedName, clusterSvc *corev1.Service, placement Placement) (*corev1.Service, error) {
+	lbSvc, ok := a.cacheMap[lbName]
+	if !ok {
+		return nil, &LBUnavailableError{LB: lbName, Reason: "LBNotFound", Message: "not in inventory"}
+	}
+	if !placement.matches(lbSvc) {
+		return nil, &LBUnavailableError{LB: lbName, Reason: "LBNotInPool", Message: fmt.Sprintf("not in pool %q", placement.Pool)}
+	}
+	if len(lbSvc.Status.LoadBalancer.Ingress) == 0 {
+		return nil, &LBUnavailableError{LB: lbName, Reason: "LBNotReady", Message: "not provisioned yet"}
+	}
+	if placement.IP != "" && !hasIngress(lbSvc, placement.IP) {
+		return nil, &LBUnavailableError{LB: lbName, Reason: "LBIPMismatch", Message: fmt.Sprintf("not exposed on %s", placement.IP)}
+	}
+	capacity := a.capacityPerLB
+	if placement.Capacity > 0 {
+		capacity = placement.Capacity
+	}
+	if _, ok := a.lbToCRs[lbName][crName]; !ok && len(a.lbToCRs[lbName]) >= capacity {
+		return nil, &LBUnavailableError{LB: lbName, Reason: "LBFull", Message: fmt.Sprintf("all %d slots are taken", capacity)}
+	}
+	if err := checkProtocols(a.name, clusterSvc, a.protocols); err != nil {
+		return nil, err
+	}
+	svc, conflicts := dropConflicts(clusterSvc, a.lbToPorts[lbName])
+	if len(conflicts) > 0 && !placement.Flexible {
+		return nil, &PortConflictError{LB: lbName, Ports: conflicts}
+	}
+	min, max := placement.portRange()
+	if !hasFreePorts(svc, a.lbToPorts[lbName], min, max) {
+		return nil, &LBUnavailableError{LB: lbName, Reason: "NoFreePort", Message: fmt.Sprintf("no free port left in range [%d, %d)", min, max)}
+	}
+	return svc, nil
+}
+
+// MigrateLB reserves a slot and ports of clusterSvc on lbName for crName, which is
+// placed onto another LB. The slot and ports on the source LB are still held until
+// CompleteMigration, so that crName is exposed on both LBs in the meantime.
+// Ports of clusterSvc which are left as 0 are assigned as well.
+func (a *Allocator) MigrateLB(crName, lbName types.NamespacedName, clusterSvc *corev1.Service, placement Placement) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	source, ok := a.crToLB[crName]
+	if !ok {
+		return fmt.Errorf("%s is not placed onto any LB", crName)
+	}
+	if source == lbName {
+		return nil
+	}
+	if m, ok := a.migrations[crName]; ok {
+		return fmt.Errorf("%s is being moved from %s to %s", crName, m.lb, source)
+	}
+	svc, err := a.checkLB(crName, lbName, clusterSvc, placement)
+	if err != nil {
+		return err
+	}
+	held := clusterSvc.DeepCopy()
+	held.Spec.Ports = nil
+	for _, svcPort := range clusterSvc.Spec.Ports {
+		if _, ok := a.crToPorts[crName][PortKeyOf(svcPort)]; ok {
+			held.Spec.Ports = append(held.Spec.Ports, svcPort)
+		}
+	}
+	a.migrations[crName] = migration{lb: source, svc: held}
+	// detach crName from the source without releasing its slot and ports
+	delete(a.crToLB, crName)
+	delete(a.crToPorts, crName)
+	if a.lbToPorts[lbName] == nil {
+		a.lbToPorts[lbName] = portSet{}
+	}
+	min, max := placement.portRange()
+	// it won't fail as free ports have been checked
+	updatePort(svc, a.lbToPorts[lbName], min, max)
+	setPortNumbers(clusterSvc, svc)
+	a.associate(crName, lbName, clusterSvc)
+	log.WithName(a.name).Info("MigrateLB", "cr", crName, "from", source, "to", lbName)
+	return nil
+}
+
+// CancelMigration gives the slot and ports reserved by MigrateLB back, and puts crName
+// back onto the source LB. It only updates internal cache, so it's expected to be called
+// before crName is associated with the target LB.
+func (a *Allocator) CancelMigration(crName types.NamespacedName) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	m, ok := a.migrations[crName]
+	if !ok {
+		return
+	}
+	delete(a.migrations, crName)
+	a.associate(crName, m.lb, m.svc)
+	log.WithName(a.name).Info("CancelMigration", "cr", crName, "lb", m.lb)
+}
+
+// RestoreMigration records a move of crName from lbName, which is not completed yet,
+// in internal cache only; it's called after RestoreAssociation upon program starts
+func (a *Allocator) RestoreMigration(crName, lbName types.NamespacedName, clusterSvc *corev1.Service) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.lbToCRs[lbName] == nil {
+		a.lbToCRs[lbName] = make(nameSet)
+	}
+	if a.lbToPorts[lbName] == nil {
+		a.lbToPorts[lbName] = portSet{}
+	}
+	for _, svcPort := range clusterSvc.Spec.Ports {
+		a.lbToPorts[lbName][PortKeyOf(svcPort)] = struct{}{}
+	}
+	a.lbToCRs[lbName][crName] = struct{}{}
+	a.migrations[crName] = migration{lb: lbName, svc: clusterSvc.DeepCopy()}
+}
+
+// CompleteMigration releases the slot and ports crName holds on the source LB; providers
+// which configure anything per port remove them from the source LB before calling it
+func (a *Allocator) CompleteMigration(crName types.NamespacedName) error {
+	a.EndMigration(crName)
+	return nil
+}
+
+// GetMigration returns the source LB crName is being moved from, along with
+// a Service carrying ports crName holds on it
+func (a *Allocator) GetMigration(crName types.NamespacedName) (types.NamespacedName, *corev1.Service, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	m, ok := a.migrations[crName]
+	if !ok {
+		return types.NamespacedName{}, nil, false
+	}
+	return m.lb, m.svc.DeepCopy(), true
+}
+
+// EndMigration releases the slot and ports crName holds on the source LB
+func (a *Allocator) EndMigration(crName types.NamespacedName) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	m, ok := a.migrations[crName]
+	if !ok {
+		return
+	}
+	delete(a.lbToCRs[m.lb], crName)
+	for _, svcPort := range m.svc.Spec.Ports {
+		delete(a.lbToPorts[m.lb], PortKeyOf(svcPort))
+	}
+	delete(a.migrations, crName)
+	log.WithName(a.name).Info("CompleteMigration", "cr", crName, "lb", m.lb)
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestParseLBName(t *testing.T) {
+	tests := []struct {
+		ref     string
+		want    types.NamespacedName
+		wantErr bool
+	}{
+		{ref: "lb-1", want: types.NamespacedName{Name: "lb-1", Namespace: namespace}},
+		{ref: "kube-system/lb-1", want: types.NamespacedName{Name: "lb-1", Namespace: "kube-system"}},
+		{ref: "", wantErr: true},
+		{ref: "/lb-1", wantErr: true},
+		{ref: "a/b/c", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLBName(tt.ref)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseLBName(%q) = %v, %v, want %v, error %v", tt.ref, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestAllocatorMigrateLB(t *testing.T) {
+	a := newTestAllocator(2, "lb-1", "lb-2", "lb-3")
+	lb1 := types.NamespacedName{Name: "lb-1", Namespace: "default"}
+	lb2 := types.NamespacedName{Name: "lb-2", Namespace: "default"}
+	lb3 := types.NamespacedName{Name: "lb-3", Namespace: "default"}
+	cr1 := types.NamespacedName{Name: "cr1", Namespace: "default"}
+	cr2 := types.NamespacedName{Name: "cr2", Namespace: "default"}
+	cr3 := types.NamespacedName{Name: "cr3", Namespace: "default"}
+	a.RestoreAssociation(cr1, lb1, newTestClusterService(80))
+	a.RestoreAssociation(cr2, lb2, newTestClusterService(80))
+	a.RestoreAssociation(cr3, lb3, newTestClusterService(81))
+	a.RestoreAssociation(types.NamespacedName{Name: "cr4", Namespace: "default"}, lb3, newTestClusterService(82))
+
+	err := a.MigrateLB(cr1, lb2, newTestClusterService(80), Placement{})
+	if _, ok := err.(*PortConflictError); !ok {
+		t.Errorf("MigrateLB() error = %v, want a port conflict", err)
+	}
+	err = a.MigrateLB(cr1, lb3, newTestClusterService(80), Placement{})
+	if _, ok := err.(*LBUnavailableError); !ok {
+		t.Errorf("MigrateLB() error = %v, want %v to be full", err, lb3)
+	}
+	err = a.MigrateLB(cr1, types.NamespacedName{Name: "lb-4", Namespace: "default"}, newTestClusterService(80), Placement{})
+	if _, ok := err.(*LBUnavailableError); !ok {
+		t.Errorf("MigrateLB() error = %v, want a LB not in inventory", err)
+	}
+
+	// move cr3 from lb-3 to lb-1, it's held on both until completed
+	if err := a.MigrateLB(cr3, lb1, newTestClusterService(81), Placement{}); err != nil {
+		t.Fatalf("MigrateLB() error = %v", err)
+	}
+	if got := tenantsPerLB(a); !reflect.DeepEqual(got, map[string]int{"lb-1": 2, "lb-2": 1, "lb-3": 2}) {
+		t.Errorf("tenants = %v during migration", got)
+	}
+	if lbName, _ := a.GetLBName(cr3); lbName != lb1 {
+		t.Errorf("GetLBName() = %v, want %v", lbName, lb1)
+	}
+	if err := a.MigrateLB(cr3, lb2, newTestClusterService(81), Placement{}); err == nil {
+		t.Errorf("MigrateLB() expected an error as a migration is in progress")
+	}
+	source, held, ok := a.GetMigration(cr3)
+	if !ok || source != lb3 || !reflect.DeepEqual(portNumbers(held), []int32{81}) {
+		t.Errorf("GetMigration() = %v, %v, %v, want %v holding port 81", source, portNumbers(held), ok, lb3)
+	}
+
+	if err := a.CompleteMigration(cr3); err != nil {
+		t.Fatalf("CompleteMigration() error = %v", err)
+	}
+	if got := tenantsPerLB(a); !reflect.DeepEqual(got, map[string]int{"lb-1": 2, "lb-2": 1, "lb-3": 1}) {
+		t.Errorf("tenants = %v after migration", got)
+	}
+	if _, ok := a.lbToPorts[lb3][PortKey{Protocol: corev1.ProtocolTCP, Port: 81}]; ok {
+		t.Errorf("port 81 is still held on %v after migration", lb3)
+	}
+}
+
+func TestAllocatorCancelMigration(t *testing.T) {
+	a := newTestAllocator(2, "lb-1", "lb-2")
+	lb1 := types.NamespacedName{Name: "lb-1", Namespace: "default"}
+	lb2 := types.NamespacedName{Name: "lb-2", Namespace: "default"}
+	cr1 := types.NamespacedName{Name: "cr1", Namespace: "default"}
+	a.RestoreAssociation(cr1, lb1, newTestClusterService(80))
+
+	if err := a.MigrateLB(cr1, lb2, newTestClusterService(80), Placement{}); err != nil {
+		t.Fatalf("MigrateLB() error = %v", err)
+	}
+	a.CancelMigration(cr1)
+	if lbName, _ := a.GetLBName(cr1); lbName != lb1 {
+		t.Errorf("GetLBName() = %v, want %v", lbName, lb1)
+	}
+	if got := tenantsPerLB(a); !reflect.DeepEqual(got, map[string]int{"lb-1": 1}) {
+		t.Errorf("tenants = %v after cancellation", got)
+	}
+	if _, ok := a.lbToPorts[lb2][PortKey{Protocol: corev1.ProtocolTCP, Port: 80}]; ok {
+		t.Errorf("port 80 is still held on %v after cancellation", lb2)
+	}
+	if _, _, ok := a.GetMigration(cr1); ok {
+		t.Errorf("GetMigration() = true after cancellation")
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"fmt"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// PoolLabel is the label carrying name of the SharedLBPool a LB Service belongs to
+const PoolLabel = "sharedlb.kubecon.k8s.io/pool"
+
+// Placement tells GetAvailabelLB where a SharedLB can be placed
+type Placement struct {
+	Strategy Strategy
+	// Pool is name of the SharedLBPool; empty means LBs not belonging to any pool
+	Pool string
+	// Capacity is the number of tenants a LB can hold; 0 means the provider's default
+	Capacity int
+	// MinPort and MaxPort (both inclusive) is the range ports are assigned from;
+	// 0 means the default range
+	MinPort, MaxPort int32
+	// LB is the LB Service the SharedLB is pinned to, if it's not empty
+	LB types.NamespacedName
+	// IP is the ingress IP (or hostname) of the LB the SharedLB is pinned to, if it's not empty
+	IP string
+	// Flexible tells whether requested ports which are taken on a LB can be replaced
+	// by free ones in the port range, rather than looking for another LB
+	Flexible bool
+}
+
+// NewPlacement builds the Placement of sharedLB; pool is the SharedLBPool it refers to,
+// or nil if it doesn't refer to any
+func NewPlacement(sharedLB *kubeconv1alpha1.SharedLB, pool *kubeconv1alpha1.SharedLBPool) (Placement, error) {
+	strategy, err := ParseStrategy(sharedLB.Spec.Strategy)
+	if err != nil {
+		return Placement{}, err
+	}
+	placement := Placement{
+		Strategy: strategy,
+		IP:       sharedLB.Spec.LoadBalancerIP,
+		Flexible: sharedLB.Spec.PortMode == kubeconv1alpha1.SharedLBPortModeFlexible,
+	}
+	if target, ok := PinnedLB(sharedLB); ok {
+		if placement.LB, err = ParseLBName(target); err != nil {
+			return Placement{}, err
+		}
+	}
+	if pool == nil {
+		return placement, nil
+	}
+	placement.Pool = pool.Name
+	placement.Capacity = pool.Spec.Capacity
+	if r := pool.Spec.PortRange; r != nil {
+		if err := ValidatePortRange(r); err != nil {
+			return Placement{}, fmt.Errorf("invalid port range of SharedLBPool %q: %v", pool.Name, err)
+		}
+		placement.MinPort, placement.MaxPort = r.Min, r.Max
+	}
+	return placement, nil
+}
+
+// matches tells whether lbSvc is in the pool of the placement
+func (p Placement) matches(lbSvc *corev1.Service) bool {
+	return lbSvc.Labels[PoolLabel] == p.Pool
+}
+
+// Pinned tells whether the SharedLB can only be placed onto a specific LB
+func (p Placement) Pinned() bool {
+	return p.LB.Name != "" || p.IP != ""
+}
+
+// pinnedTo tells whether lbSvc is the LB the placement is pinned to, if any
+func (p Placement) pinnedTo(lbSvc *corev1.Service) bool {
+	if p.LB.Name != "" && p.LB != GetNamespacedName(lbSvc) {
+		return false
+	}
+	return p.IP == "" || hasIngress(lbSvc, p.IP)
+}
+
+// PinnedLB returns TargetLBAnnotation of sharedLB, if it's set by users rather than
+// by consolidator, i.e. sharedLB is pinned to the LB
+func PinnedLB(sharedLB *kubeconv1alpha1.SharedLB) (string, bool) {
+	target, ok := sharedLB.Annotations[TargetLBAnnotation]
+	if !ok || target == sharedLB.Annotations[ConsolidatedAnnotation] {
+		return "", false
+	}
+	return target, true
+}
+
+// hasIngress tells whether lbSvc is exposed on ip, which can be a hostname as well
+func hasIngress(lbSvc *corev1.Service, ip string) bool {
+	for _, ingress := range lbSvc.Status.LoadBalancer.Ingress {
+		if ingress.IP == ip || ingress.Hostname == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// portRange returns the range [min, max) ports are assigned from
+func (p Placement) portRange() (int32, int32) {
+	if p.MinPort == 0 {
+		return minPort, maxPort
+	}
+	return p.MinPort, p.MaxPort + 1
+}
+
+// PortRangeOf returns the range [min, max) ports are assigned from, for SharedLBs
+// in pool; pool can be nil. An error is returned if the range of pool is invalid.
+func PortRangeOf(pool *kubeconv1alpha1.SharedLBPool) (int32, int32, error) {
+	if pool == nil || pool.Spec.PortRange == nil {
+		return minPort, maxPort, nil
+	}
+	if err := ValidatePortRange(pool.Spec.PortRange); err != nil {
+		return 0, 0, fmt.Errorf("invalid port range of SharedLBPool %q: %v", pool.Name, err)
+	}
+	return pool.Spec.PortRange.Min, pool.Spec.PortRange.Max + 1, nil
+}
+
+// ValidatePortRange returns an error if r is not a range of valid ports. Bounds are checked
+// one by one by the CRD schema, but whether min is greater than max is only checked here.
+func ValidatePortRange(r *kubeconv1alpha1.PortRange) error {
+	if r.Min <= 0 || r.Max > 65535 {
+		return fmt.Errorf("[%d, %d] is not in range 1-65535", r.Min, r.Max)
+	}
+	if r.Min > r.Max {
+		return fmt.Errorf("min %d is greater than max %d", r.Min, r.Max)
+	}
+	return nil
+}
+
+// ApplyPool puts lbSvc into pool, and applies the pool's template onto it.
+// It's a no-op if pool is nil.
+func ApplyPool(lbSvc *corev1.Service, pool *kubeconv1alpha1.SharedLBPool) {
+	if pool == nil {
+		return
+	}
+	if lbSvc.Labels == nil {
+		lbSvc.Labels = make(map[string]string)
+	}
+	template := pool.Spec.Template
+	for k, v := range template.Labels {
+		lbSvc.Labels[k] = v
+	}
+	// set after template labels, so that it can't be overridden
+	lbSvc.Labels[PoolLabel] = pool.Name
+	if len(template.Annotations) > 0 && lbSvc.Annotations == nil {
+		lbSvc.Annotations = make(map[string]string)
+	}
+	for k, v := range template.Annotations {
+		lbSvc.Annotations[k] = v
+	}
+	if len(template.LoadBalancerSourceRanges) > 0 {
+		lbSvc.Spec.LoadBalancerSourceRanges = append([]string(nil), template.LoadBalancerSourceRanges...)
+	}
+	if template.ExternalTrafficPolicy != "" {
+		lbSvc.Spec.ExternalTrafficPolicy = template.ExternalTrafficPolicy
+	}
+}
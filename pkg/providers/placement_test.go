@@ -0,0 +1,170 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"testing"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newTestPool(name string, capacity int, portRange *kubeconv1alpha1.PortRange) *kubeconv1alpha1.SharedLBPool {
+	return &kubeconv1alpha1.SharedLBPool{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: kubeconv1alpha1.SharedLBPoolSpec{
+			Capacity:  capacity,
+			PortRange: portRange,
+		},
+	}
+}
+
+func TestNewPlacement(t *testing.T) {
+	tests := []struct {
+		name     string
+		sharedLB *kubeconv1alpha1.SharedLB
+		pool     *kubeconv1alpha1.SharedLBPool
+		want     Placement
+		wantErr  bool
+	}{
+		{
+			name:     "no pool",
+			sharedLB: &kubeconv1alpha1.SharedLB{Spec: kubeconv1alpha1.SharedLBSpec{Strategy: "pack"}},
+			want:     Placement{Strategy: StrategyPack},
+		},
+		{
+			name:     "pool with capacity and port range",
+			sharedLB: &kubeconv1alpha1.SharedLB{Spec: kubeconv1alpha1.SharedLBSpec{Strategy: "spread"}},
+			pool:     newTestPool("gold", 5, &kubeconv1alpha1.PortRange{Min: 30000, Max: 30099}),
+			want:     Placement{Strategy: StrategySpread, Pool: "gold", Capacity: 5, MinPort: 30000, MaxPort: 30099},
+		},
+		{
+			name:     "invalid port range",
+			sharedLB: &kubeconv1alpha1.SharedLB{},
+			pool:     newTestPool("gold", 5, &kubeconv1alpha1.PortRange{Min: 30099, Max: 30000}),
+			wantErr:  true,
+		},
+		{
+			name: "pinned to an IP and a LB",
+			sharedLB: &kubeconv1alpha1.SharedLB{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{TargetLBAnnotation: "kube-system/lb-1"}},
+				Spec:       kubeconv1alpha1.SharedLBSpec{LoadBalancerIP: "1.2.3.4"},
+			},
+			want: Placement{Strategy: StrategyRandom, LB: types.NamespacedName{Name: "lb-1", Namespace: "kube-system"}, IP: "1.2.3.4"},
+		},
+		{
+			name: "not pinned by consolidator",
+			sharedLB: &kubeconv1alpha1.SharedLB{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{TargetLBAnnotation: "lb-1", ConsolidatedAnnotation: "lb-1"}},
+			},
+			want: Placement{Strategy: StrategyRandom},
+		},
+		{
+			name:     "invalid strategy",
+			sharedLB: &kubeconv1alpha1.SharedLB{Spec: kubeconv1alpha1.SharedLBSpec{Strategy: "first-fit"}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewPlacement(tt.sharedLB, tt.pool)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewPlacement() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("NewPlacement() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortRangeOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		pool     *kubeconv1alpha1.SharedLBPool
+		min, max int32
+		wantErr  bool
+	}{
+		{name: "no pool", min: minPort, max: maxPort},
+		{name: "pool without port range", pool: newTestPool("gold", 5, nil), min: minPort, max: maxPort},
+		{name: "pool with port range", pool: newTestPool("gold", 5, &kubeconv1alpha1.PortRange{Min: 30000, Max: 30099}), min: 30000, max: 30100},
+		{name: "inverted port range", pool: newTestPool("gold", 5, &kubeconv1alpha1.PortRange{Min: 30099, Max: 30000}), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			min, max, err := PortRangeOf(tt.pool)
+			if (err != nil) != tt.wantErr || min != tt.min || max != tt.max {
+				t.Errorf("PortRangeOf() = %d, %d, %v, want %d, %d, wantErr %v", min, max, err, tt.min, tt.max, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyPool(t *testing.T) {
+	pool := newTestPool("gold", 5, nil)
+	pool.Spec.Template = kubeconv1alpha1.LBServiceTemplate{
+		Labels:                   map[string]string{"team": "a", PoolLabel: "other"},
+		Annotations:              map[string]string{"service.beta.kubernetes.io/aws-load-balancer-internal": "0.0.0.0/0"},
+		LoadBalancerSourceRanges: []string{"10.0.0.0/8"},
+		ExternalTrafficPolicy:    corev1.ServiceExternalTrafficPolicyTypeLocal,
+	}
+	lbSvc := newLocalProvider().NewLBService()
+	ApplyPool(lbSvc, pool)
+
+	if lbSvc.Labels[PoolLabel] != "gold" || lbSvc.Labels["team"] != "a" {
+		t.Errorf("labels = %v, want pool label and template labels", lbSvc.Labels)
+	}
+	if _, ok := lbSvc.Labels["lb-template"]; !ok {
+		t.Errorf("labels = %v, want label lb-template to be kept", lbSvc.Labels)
+	}
+	if lbSvc.Annotations["service.beta.kubernetes.io/aws-load-balancer-internal"] != "0.0.0.0/0" {
+		t.Errorf("annotations = %v, want template annotations", lbSvc.Annotations)
+	}
+	if len(lbSvc.Spec.LoadBalancerSourceRanges) != 1 || lbSvc.Spec.ExternalTrafficPolicy != corev1.ServiceExternalTrafficPolicyTypeLocal {
+		t.Errorf("spec = %v, want template spec fields", lbSvc.Spec)
+	}
+}
+
+func TestAllocatorWithPool(t *testing.T) {
+	a := newTestAllocator(2, "lb-1")
+	goldLB := newTestLBService("lb-gold", true)
+	ApplyPool(goldLB, newTestPool("gold", 3, nil))
+	a.UpdateCache(GetNamespacedName(goldLB), goldLB)
+	gold, _ := NewPlacement(&kubeconv1alpha1.SharedLB{}, newTestPool("gold", 3, &kubeconv1alpha1.PortRange{Min: 30000, Max: 30001}))
+
+	// LBs of pool "gold" only hold SharedLBs of the pool, and vice versa
+	for i, name := range []string{"cr1", "cr2"} {
+		cr := types.NamespacedName{Name: name, Namespace: "default"}
+		svc := newTestClusterService(0)
+		lbSvc, _ := a.GetAvailabelLB(cr, svc, gold)
+		if lbSvc == nil || lbSvc.Name != "lb-gold" {
+			t.Fatalf("GetAvailabelLB() = %v, want lb-gold", lbSvc)
+		}
+		if port := svc.Spec.Ports[0].Port; port != 30000 && port != 30001 {
+			t.Errorf("#%d port %d is assigned, want one in range [30000, 30001]", i, port)
+		}
+	}
+	// ports of the pool run out before capacity does
+	if lbSvc, _ := a.GetAvailabelLB(types.NamespacedName{Name: "cr3", Namespace: "default"}, newTestClusterService(0), gold); lbSvc != nil {
+		t.Errorf("GetAvailabelLB() = %v, want nil as no port is left", lbSvc.Name)
+	}
+	if lbSvc, _ := a.GetAvailabelLB(types.NamespacedName{Name: "cr4", Namespace: "default"}, newTestClusterService(0), Placement{}); lbSvc == nil || lbSvc.Name != "lb-1" {
+		t.Errorf("GetAvailabelLB() = %v, want lb-1", lbSvc)
+	}
+}
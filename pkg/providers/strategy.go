@@ -0,0 +1,105 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Strategy decides which LB a SharedLB is placed on, among the ones
+// that have a free slot and no port conflict
+type Strategy string
+
+const (
+	// StrategyRandom picks a random LB
+	StrategyRandom Strategy = "random"
+	// StrategyPack picks the most-full LB, so that LBs are filled up one by one
+	StrategyPack Strategy = "pack"
+	// StrategySpread picks the least-full LB, so that tenants are spread evenly
+	StrategySpread Strategy = "spread"
+	// StrategyHash picks a LB by hashing the namespace of SharedLB, so that
+	// SharedLBs of one namespace land on the same LB as long as it has room
+	StrategyHash Strategy = "hash"
+)
+
+// Strategies returns all supported strategies
+func Strategies() []Strategy {
+	return []Strategy{StrategyRandom, StrategyPack, StrategySpread, StrategyHash}
+}
+
+// ParseStrategy converts s to a Strategy; empty string means the default one,
+// which is specified by env variable STRATEGY
+func ParseStrategy(s string) (Strategy, error) {
+	if s == "" {
+		s = defaultStrategy
+	}
+	for _, strategy := range Strategies() {
+		if Strategy(s) == strategy {
+			return strategy, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported strategy %q, supported strategies are %v", s, Strategies())
+}
+
+// pickLB picks a LB out of candidates for crName per strategy.
+// load returns the number of tenants a LB holds.
+func pickLB(strategy Strategy, crName types.NamespacedName, candidates []types.NamespacedName, load func(types.NamespacedName) int) types.NamespacedName {
+	// sort candidates so that ties are broken in a deterministic way
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].String() < candidates[j].String()
+	})
+	picked := candidates[0]
+	switch strategy {
+	case StrategyPack:
+		for _, lbName := range candidates[1:] {
+			if load(lbName) > load(picked) {
+				picked = lbName
+			}
+		}
+	case StrategySpread:
+		for _, lbName := range candidates[1:] {
+			if load(lbName) < load(picked) {
+				picked = lbName
+			}
+		}
+	case StrategyHash:
+		// rendezvous hashing: a namespace keeps its preferred LB no matter
+		// how other LBs come and go
+		maxScore := hashScore(crName.Namespace, picked)
+		for _, lbName := range candidates[1:] {
+			if score := hashScore(crName.Namespace, lbName); score > maxScore {
+				picked, maxScore = lbName, score
+			}
+		}
+	default:
+		picked = candidates[rand.Intn(len(candidates))]
+	}
+	return picked
+}
+
+func hashScore(namespace string, lbName types.NamespacedName) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(lbName.String()))
+	return h.Sum64()
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package providers
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestPlacementStrategies(t *testing.T) {
+	tests := []struct {
+		strategy Strategy
+		// tenants holds namespace of each incoming SharedLB, in order
+		tenants []string
+		// want is the number of tenants each LB holds after placement
+		want map[string]int
+	}{
+		{
+			strategy: StrategyPack,
+			tenants:  []string{"ns1", "ns2", "ns3", "ns4", "ns5", "ns6"},
+			want:     map[string]int{"lb-1": 4, "lb-2": 2},
+		},
+		{
+			strategy: StrategySpread,
+			tenants:  []string{"ns1", "ns2", "ns3", "ns4", "ns5", "ns6"},
+			want:     map[string]int{"lb-1": 2, "lb-2": 2, "lb-3": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.strategy), func(t *testing.T) {
+			a := newTestAllocator(4, "lb-1", "lb-2", "lb-3")
+			for i, ns := range tt.tenants {
+				cr := types.NamespacedName{Name: fmt.Sprintf("cr%d", i), Namespace: ns}
+				if lbSvc, _ := a.GetAvailabelLB(cr, newTestClusterService(0), Placement{Strategy: tt.strategy}); lbSvc == nil {
+					t.Fatalf("GetAvailabelLB() = nil for %v", cr)
+				}
+			}
+			if got := tenantsPerLB(a); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tenants per LB = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashStrategy(t *testing.T) {
+	a := newTestAllocator(3, "lb-1", "lb-2", "lb-3")
+	place := func(name, ns string) string {
+		cr := types.NamespacedName{Name: name, Namespace: ns}
+		lbSvc, _ := a.GetAvailabelLB(cr, newTestClusterService(0), Placement{Strategy: StrategyHash})
+		if lbSvc == nil {
+			t.Fatalf("GetAvailabelLB() = nil for %v", cr)
+		}
+		return lbSvc.Name
+	}
+
+	// SharedLBs of one namespace land on the same LB
+	want := place("foo", "ns1")
+	for _, name := range []string{"bar", "baz"} {
+		if got := place(name, "ns1"); got != want {
+			t.Errorf("%s/%s is placed on %s, want %s", "ns1", name, got, want)
+		}
+	}
+	// ... until it's full
+	if got := place("qux", "ns1"); got == want {
+		t.Errorf("%s/%s is placed on full LB %s", "ns1", "qux", got)
+	}
+
+	// and the choice doesn't depend on placement history
+	b := newTestAllocator(3, "lb-1", "lb-2", "lb-3")
+	lbSvc, _ := b.GetAvailabelLB(types.NamespacedName{Name: "other", Namespace: "ns1"}, newTestClusterService(0), Placement{Strategy: StrategyHash})
+	if lbSvc == nil || lbSvc.Name != want {
+		t.Errorf("GetAvailabelLB() = %v, want %s", lbSvc, want)
+	}
+}
+
+func TestParseStrategy(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Strategy
+		wantErr bool
+	}{
+		{in: "", want: Strategy(defaultStrategy)},
+		{in: "pack", want: StrategyPack},
+		{in: "hash", want: StrategyHash},
+		{in: "first-fit", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseStrategy(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseStrategy(%q) = %v, %v, want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func newTestAllocator(capacity int, lbNames ...string) *Allocator {
+	a := NewAllocator("test")
+	a.capacityPerLB = capacity
+	for _, lbName := range lbNames {
+		a.UpdateCache(types.NamespacedName{Name: lbName, Namespace: "default"}, newTestLBService(lbName, true))
+	}
+	return a
+}
+
+func tenantsPerLB(a *Allocator) map[string]int {
+	ret := make(map[string]int)
+	for lbName, crs := range a.lbToCRs {
+		if len(crs) > 0 {
+			ret[lbName.Name] = len(crs)
+		}
+	}
+	return ret
+}
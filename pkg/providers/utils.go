@@ -59,6 +59,32 @@ func GetEnvValInt(envKey string, defaultVal int) int {
 	return retVal
 }
 
+// GetEnvValDuration parses env variable envKey as a time.Duration, e.g. "10m"
+func GetEnvValDuration(envKey string, defaultVal time.Duration) time.Duration {
+	val := os.Getenv(envKey)
+	if val == "" {
+		return defaultVal
+	}
+	retVal, err := time.ParseDuration(val)
+	if err != nil {
+		return defaultVal
+	}
+	return retVal
+}
+
+// GetEnvValBool parses env variable envKey as a bool, e.g. "true" or "1"
+func GetEnvValBool(envKey string, defaultVal bool) bool {
+	val := os.Getenv(envKey)
+	if val == "" {
+		return defaultVal
+	}
+	retVal, err := strconv.ParseBool(val)
+	if err != nil {
+		return defaultVal
+	}
+	return retVal
+}
+
 func GetNamespacedName(svc *corev1.Service) types.NamespacedName {
 	if svc == nil {
 		return types.NamespacedName{}
@@ -66,12 +92,41 @@ func GetNamespacedName(svc *corev1.Service) types.NamespacedName {
 	return types.NamespacedName{Name: svc.Name, Namespace: svc.Namespace}
 }
 
-// GetRandomInt returns an integer in range [min, max)
+// GetRandomInt returns an integer in range [min, max), or min if the range is empty
 func GetRandomInt(min, max int) int {
+	if max <= min {
+		return min
+	}
 	return rand.Intn(max-min) + min
 }
 
+// default range [minPort, maxPort) ports are assigned from
+const (
+	minPort int32 = 1000
+	maxPort int32 = 10000
+)
+
 func GetRandomPort() int32 {
 	// TODO(Huang-Wei): change to [1000, 65535)?
-	return int32(GetRandomInt(1000, 10000))
+	return int32(GetRandomInt(int(minPort), int(maxPort)))
+}
+
+// GetAvailablePort returns a random port in range [1000, 10000) which is not in occupied.
+// An error is returned if the whole range has been occupied.
+func GetAvailablePort(occupied map[int32]struct{}) (int32, error) {
+	return GetAvailablePortInRange(occupied, minPort, maxPort)
+}
+
+// GetAvailablePortInRange returns a random port in range [min, max) which is not in occupied.
+// A *PortRangeExhaustedError is returned if the whole range has been occupied.
+func GetAvailablePortInRange(occupied map[int32]struct{}, min, max int32) (int32, error) {
+	// start from a random port, and then scan the range sequentially
+	start := int32(GetRandomInt(int(min), int(max)))
+	for i := int32(0); i < max-min; i++ {
+		port := min + (start-min+i)%(max-min)
+		if _, ok := occupied[port]; !ok {
+			return port, nil
+		}
+	}
+	return 0, &PortRangeExhaustedError{Min: min, Max: max}
 }
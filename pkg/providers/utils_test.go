@@ -19,6 +19,7 @@ package providers
 import (
 	"os"
 	"testing"
+	"time"
 )
 
 func TestGetEnvValInt(t *testing.T) {
@@ -64,3 +65,120 @@ func TestGetEnvValInt(t *testing.T) {
 		})
 	}
 }
+
+func TestGetEnvValDuration(t *testing.T) {
+	tests := []struct {
+		name string
+		val  string
+		want time.Duration
+	}{
+		{
+			name: "env variable not exist",
+			want: time.Minute,
+		},
+		{
+			name: "env variable exists but with a non-duration value",
+			val:  "10",
+			want: time.Minute,
+		},
+		{
+			name: "env variable exists and with a duration value",
+			val:  "1h30m",
+			want: 90 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("DURATIONTEST", tt.val)
+			defer os.Unsetenv("DURATIONTEST")
+			if got := GetEnvValDuration("DURATIONTEST", time.Minute); got != tt.want {
+				t.Errorf("GetEnvValDuration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetEnvValBool(t *testing.T) {
+	tests := []struct {
+		name string
+		val  string
+		want bool
+	}{
+		{
+			name: "env variable not exist",
+			want: true,
+		},
+		{
+			name: "env variable exists but with a non-bool value",
+			val:  "yes",
+			want: true,
+		},
+		{
+			name: "env variable exists and with a bool value",
+			val:  "false",
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("BOOLTEST", tt.val)
+			defer os.Unsetenv("BOOLTEST")
+			if got := GetEnvValBool("BOOLTEST", true); got != tt.want {
+				t.Errorf("GetEnvValBool() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetAvailablePort(t *testing.T) {
+	full := make(map[int32]struct{})
+	for p := int32(1000); p < 10000; p++ {
+		full[p] = struct{}{}
+	}
+	oneLeft := make(map[int32]struct{})
+	for p := range full {
+		oneLeft[p] = struct{}{}
+	}
+	delete(oneLeft, 4242)
+
+	tests := []struct {
+		name     string
+		occupied map[int32]struct{}
+		want     int32
+		wantErr  bool
+	}{
+		{
+			name:     "only one port left",
+			occupied: oneLeft,
+			want:     4242,
+		},
+		{
+			name:     "all ports occupied",
+			occupied: full,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetAvailablePort(tt.occupied)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetAvailablePort() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("GetAvailablePort() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetAvailablePortInRange(t *testing.T) {
+	// an empty (or inverted) range runs out of ports without panicking
+	for _, r := range [][2]int32{{1000, 1000}, {1001, 1000}} {
+		if _, err := GetAvailablePortInRange(nil, r[0], r[1]); err == nil {
+			t.Errorf("GetAvailablePortInRange(%d, %d) expected an error", r[0], r[1])
+		}
+	}
+	if got, err := GetAvailablePortInRange(nil, 1000, 1001); err != nil || got != 1000 {
+		t.Errorf("GetAvailablePortInRange() = %v, %v, want 1000", got, err)
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mutating
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/runtime/inject"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	admissiontypes "sigs.k8s.io/controller-runtime/pkg/webhook/admission/types"
+)
+
+func init() {
+	webhookName := "mutating-create-update-sharedlb"
+	if HandlerMap[webhookName] == nil {
+		HandlerMap[webhookName] = []admission.Handler{}
+	}
+	HandlerMap[webhookName] = append(HandlerMap[webhookName], &SharedLBCreateUpdateHandler{})
+}
+
+// SharedLBCreateUpdateHandler handles SharedLB
+type SharedLBCreateUpdateHandler struct {
+	// Client is used to look up ports which have been taken by other SharedLBs
+	Client client.Client
+
+	// Decoder decodes objects
+	Decoder admissiontypes.Decoder
+}
+
+func (h *SharedLBCreateUpdateHandler) mutatingSharedLBFn(ctx context.Context, obj *kubeconv1alpha1.SharedLB) (bool, string, error) {
+	// don't touch an object being deleted
+	if !obj.DeletionTimestamp.IsZero() {
+		return true, "object is being deleted", nil
+	}
+
+	if needPortAssignment(obj) {
+		sharedLBs := &kubeconv1alpha1.SharedLBList{}
+		if err := h.Client.List(ctx, &client.ListOptions{}, sharedLBs); err != nil {
+			return false, "", err
+		}
+		pool, err := h.getPool(ctx, obj)
+		if err != nil {
+			return false, "", err
+		}
+		min, max, err := providers.PortRangeOf(pool)
+		if err != nil {
+			// it's up to the pool admin to fix the range
+			return false, err.Error(), nil
+		}
+		if err := assignPorts(obj, occupiedPorts(obj, sharedLBs.Items), min, max); err != nil {
+			// no port is left in the range, it's up to users to free some (or widen the range)
+			return false, err.Error(), nil
+		}
+	}
+	setDefaults(obj)
+	return true, "", nil
+}
+
+// getPool returns the SharedLBPool obj refers to, or nil if it doesn't refer to any
+// or the pool doesn't exist (yet)
+func (h *SharedLBCreateUpdateHandler) getPool(ctx context.Context, obj *kubeconv1alpha1.SharedLB) (*kubeconv1alpha1.SharedLBPool, error) {
+	if obj.Spec.PoolName == "" {
+		return nil, nil
+	}
+	pool := &kubeconv1alpha1.SharedLBPool{}
+	err := h.Client.Get(ctx, types.NamespacedName{Name: obj.Spec.PoolName}, pool)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+func needPortAssignment(obj *kubeconv1alpha1.SharedLB) bool {
+	for _, p := range obj.Spec.Ports {
+		if p.Port == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// occupiedPorts returns ports exposed by SharedLBs obj may share a LoadBalancer with, except
+// obj itself: the tenants of the LoadBalancer obj is pinned to, or placed onto. If it's not
+// known yet at admission time, they're the SharedLBs in the same pool, as obj can be placed
+// onto any LoadBalancer of the pool.
+func occupiedPorts(obj *kubeconv1alpha1.SharedLB, sharedLBs []kubeconv1alpha1.SharedLB) map[providers.PortKey]struct{} {
+	ref := obj.Status.Ref
+	if target, ok := providers.PinnedLB(obj); ok {
+		if lbName, err := providers.ParseLBName(target); err == nil {
+			ref = lbName.String()
+		}
+	}
+	self := types.NamespacedName{Name: obj.Name, Namespace: obj.Namespace}
+	occupied := make(map[providers.PortKey]struct{})
+	for i := range sharedLBs {
+		slb := &sharedLBs[i]
+		if (types.NamespacedName{Name: slb.Name, Namespace: slb.Namespace}) == self {
+			continue
+		}
+		if ref != "" && slb.Status.Ref != ref {
+			continue
+		}
+		if ref == "" && slb.Spec.PoolName != obj.Spec.PoolName {
+			continue
+		}
+		for _, p := range providers.ExposedPorts(slb) {
+			occupied[providers.PortKeyOf(p)] = struct{}{}
+		}
+	}
+	return occupied
+}
+
+// assignPorts fills in ports which are left as 0, with ones in range [min, max)
+// which are not occupied for the same protocol
+func assignPorts(obj *kubeconv1alpha1.SharedLB, occupied map[providers.PortKey]struct{}, min, max int32) error {
+	// ports explicitly specified in obj are also occupied
+	for _, p := range obj.Spec.Ports {
+		occupied[providers.PortKeyOf(p)] = struct{}{}
+	}
+	for i, p := range obj.Spec.Ports {
+		if p.Port != 0 {
+			continue
+		}
+		key := providers.PortKeyOf(p)
+		numbers := make(map[int32]struct{})
+		for k := range occupied {
+			if k.Protocol == key.Protocol {
+				numbers[k.Port] = struct{}{}
+			}
+		}
+		port, err := providers.GetAvailablePortInRange(numbers, min, max)
+		if err != nil {
+			return err
+		}
+		obj.Spec.Ports[i].Port = port
+		key.Port = port
+		occupied[key] = struct{}{}
+	}
+	return nil
+}
+
+// setDefaults sets default protocol, targetPort and name of each port; generated
+// names get a numeric suffix when they're already given to other ports
+func setDefaults(obj *kubeconv1alpha1.SharedLB) {
+	names := make(map[string]struct{})
+	for _, p := range obj.Spec.Ports {
+		if p.Name != "" {
+			names[p.Name] = struct{}{}
+		}
+	}
+	for i := range obj.Spec.Ports {
+		p := &obj.Spec.Ports[i]
+		if p.Protocol == "" {
+			p.Protocol = corev1.ProtocolTCP
+		}
+		if p.TargetPort.Type == intstr.Int && p.TargetPort.IntVal == 0 {
+			p.TargetPort = intstr.FromInt(int(p.Port))
+		}
+		if p.Name == "" {
+			name := fmt.Sprintf("%s-%d", strings.ToLower(string(p.Protocol)), p.Port)
+			for n := 2; ; n++ {
+				if _, ok := names[name]; !ok {
+					break
+				}
+				name = fmt.Sprintf("%s-%d-%d", strings.ToLower(string(p.Protocol)), p.Port, n)
+			}
+			p.Name = name
+			names[name] = struct{}{}
+		}
+	}
+}
+
+var _ admission.Handler = &SharedLBCreateUpdateHandler{}
+
+// Handle handles admission requests.
+func (h *SharedLBCreateUpdateHandler) Handle(ctx context.Context, req admissiontypes.Request) admissiontypes.Response {
+	obj := &kubeconv1alpha1.SharedLB{}
+
+	err := h.Decoder.Decode(req, obj)
+	if err != nil {
+		return admission.ErrorResponse(http.StatusBadRequest, err)
+	}
+	copy := obj.DeepCopy()
+
+	allowed, reason, err := h.mutatingSharedLBFn(ctx, copy)
+	if err != nil {
+		return admission.ErrorResponse(http.StatusInternalServerError, err)
+	}
+	if !allowed {
+		return admission.ValidationResponse(false, reason)
+	}
+	return admission.PatchResponse(obj, copy)
+}
+
+var _ inject.Client = &SharedLBCreateUpdateHandler{}
+
+// InjectClient injects the client into the SharedLBCreateUpdateHandler
+func (h *SharedLBCreateUpdateHandler) InjectClient(c client.Client) error {
+	h.Client = c
+	return nil
+}
+
+var _ inject.Decoder = &SharedLBCreateUpdateHandler{}
+
+// InjectDecoder injects the decoder into the SharedLBCreateUpdateHandler
+func (h *SharedLBCreateUpdateHandler) InjectDecoder(d admissiontypes.Decoder) error {
+	h.Decoder = d
+	return nil
+}
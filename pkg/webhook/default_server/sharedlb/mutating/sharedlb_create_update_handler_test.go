@@ -0,0 +1,223 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mutating
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// fakeClient serves SharedLBs and a SharedLBPool from memory
+type fakeClient struct {
+	client.Client
+	sharedLBs []kubeconv1alpha1.SharedLB
+	pool      *kubeconv1alpha1.SharedLBPool
+}
+
+func (c *fakeClient) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	if pool, ok := obj.(*kubeconv1alpha1.SharedLBPool); ok && c.pool != nil && c.pool.Name == key.Name {
+		*pool = *c.pool.DeepCopy()
+		return nil
+	}
+	return apierrors.NewNotFound(schema.GroupResource{Group: "kubecon.k8s.io", Resource: "sharedlbpools"}, key.Name)
+}
+
+func (c *fakeClient) List(ctx context.Context, opts *client.ListOptions, list runtime.Object) error {
+	list.(*kubeconv1alpha1.SharedLBList).Items = c.sharedLBs
+	return nil
+}
+
+func newSharedLB(name, pool, ref string, ports ...int32) kubeconv1alpha1.SharedLB {
+	slb := kubeconv1alpha1.SharedLB{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       kubeconv1alpha1.SharedLBSpec{PoolName: pool},
+		Status:     kubeconv1alpha1.SharedLBStatus{Ref: ref},
+	}
+	for _, p := range ports {
+		slb.Spec.Ports = append(slb.Spec.Ports, corev1.ServicePort{Protocol: corev1.ProtocolTCP, Port: p})
+	}
+	return slb
+}
+
+func TestSetDefaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		ports []corev1.ServicePort
+		want  []corev1.ServicePort
+	}{
+		{
+			name:  "all fields are defaulted",
+			ports: []corev1.ServicePort{{Port: 8080}},
+			want:  []corev1.ServicePort{{Name: "tcp-8080", Protocol: corev1.ProtocolTCP, Port: 8080, TargetPort: intstr.FromInt(8080)}},
+		},
+		{
+			name:  "user specified fields are kept",
+			ports: []corev1.ServicePort{{Name: "dns", Protocol: corev1.ProtocolUDP, Port: 8053, TargetPort: intstr.FromString("dns")}},
+			want:  []corev1.ServicePort{{Name: "dns", Protocol: corev1.ProtocolUDP, Port: 8053, TargetPort: intstr.FromString("dns")}},
+		},
+		{
+			name: "names given by users are not reused",
+			ports: []corev1.ServicePort{
+				{Port: 80},
+				{Name: "tcp-80", Port: 8080},
+				{Name: "tcp-80-2", Port: 8081},
+			},
+			want: []corev1.ServicePort{
+				{Name: "tcp-80-3", Protocol: corev1.ProtocolTCP, Port: 80, TargetPort: intstr.FromInt(80)},
+				{Name: "tcp-80", Protocol: corev1.ProtocolTCP, Port: 8080, TargetPort: intstr.FromInt(8080)},
+				{Name: "tcp-80-2", Protocol: corev1.ProtocolTCP, Port: 8081, TargetPort: intstr.FromInt(8081)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := &kubeconv1alpha1.SharedLB{Spec: kubeconv1alpha1.SharedLBSpec{Ports: tt.ports}}
+			if setDefaults(obj); !reflect.DeepEqual(obj.Spec.Ports, tt.want) {
+				t.Errorf("setDefaults() = %v, want %v", obj.Spec.Ports, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssignPorts(t *testing.T) {
+	obj := &kubeconv1alpha1.SharedLB{
+		Spec: kubeconv1alpha1.SharedLBSpec{
+			Ports: []corev1.ServicePort{{Port: 0}, {Port: 1001}, {Port: 0}},
+		},
+	}
+	// leave only port 1000 and 1002 available in range [1000, 1003)
+	occupied := make(map[providers.PortKey]struct{})
+	if err := assignPorts(obj, occupied, 1000, 1003); err != nil {
+		t.Fatalf("assignPorts() error = %v", err)
+	}
+	got := map[int32]bool{obj.Spec.Ports[0].Port: true, obj.Spec.Ports[2].Port: true}
+	if !got[1000] || !got[1002] || obj.Spec.Ports[1].Port != 1001 {
+		t.Errorf("assignPorts() = %v, want ports 1000 and 1002 to be assigned", obj.Spec.Ports)
+	}
+
+	// no port left
+	obj.Spec.Ports = append(obj.Spec.Ports, corev1.ServicePort{Port: 0})
+	if err := assignPorts(obj, occupied, 1000, 1003); err == nil {
+		t.Errorf("assignPorts() expected an error when ports are exhausted")
+	}
+
+	// UDP ports are counted apart from TCP ones
+	obj.Spec.Ports = []corev1.ServicePort{{Port: 0, Protocol: corev1.ProtocolUDP}}
+	if err := assignPorts(obj, occupied, 1000, 1001); err != nil || obj.Spec.Ports[0].Port != 1000 {
+		t.Errorf("assignPorts() = %v, %v, want UDP port 1000 to be assigned", obj.Spec.Ports, err)
+	}
+}
+
+func TestOccupiedPorts(t *testing.T) {
+	reassigned := newSharedLB("bar", "", "default/lb-1", 81)
+	reassigned.Status.ReassignedPorts = []kubeconv1alpha1.SharedLBPortReassignment{{Protocol: corev1.ProtocolTCP, Port: 81, AssignedPort: 1081}}
+	sharedLBs := []kubeconv1alpha1.SharedLB{
+		newSharedLB("foo", "", "default/lb-1", 80),
+		reassigned,
+		newSharedLB("baz", "", "default/lb-2", 82),
+		newSharedLB("qux", "", "", 83),
+		newSharedLB("quux", "gold", "default/lb-3", 84),
+		newSharedLB("self", "", "default/lb-1", 85),
+	}
+	pinned := newSharedLB("self", "", "", 0)
+	pinned.Annotations = map[string]string{providers.TargetLBAnnotation: "lb-2"}
+	tests := []struct {
+		name string
+		obj  kubeconv1alpha1.SharedLB
+		want []int32
+	}{
+		{
+			name: "tenants of the LoadBalancer it's placed onto",
+			obj:  newSharedLB("self", "", "default/lb-1", 0),
+			want: []int32{80, 1081},
+		},
+		{
+			name: "tenants of the LoadBalancer it's pinned to",
+			obj:  pinned,
+			want: []int32{82},
+		},
+		{
+			name: "SharedLBs in the same pool",
+			obj:  newSharedLB("self", "", "", 0),
+			want: []int32{80, 82, 83, 1081},
+		},
+		{
+			name: "SharedLBs in another pool",
+			obj:  newSharedLB("self", "gold", "", 0),
+			want: []int32{84},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			occupied := occupiedPorts(&tt.obj, sharedLBs)
+			got := make(map[providers.PortKey]struct{})
+			want := make(map[providers.PortKey]struct{})
+			for key := range occupied {
+				got[key] = struct{}{}
+			}
+			for _, port := range tt.want {
+				want[providers.PortKey{Protocol: corev1.ProtocolTCP, Port: port}] = struct{}{}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("occupiedPorts() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMutatingSharedLBFn(t *testing.T) {
+	// only port 1000 is in range of the pool, and it's taken
+	h := &SharedLBCreateUpdateHandler{Client: &fakeClient{
+		sharedLBs: []kubeconv1alpha1.SharedLB{newSharedLB("foo", "tiny", "", 1000)},
+		pool: &kubeconv1alpha1.SharedLBPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "tiny"},
+			Spec: kubeconv1alpha1.SharedLBPoolSpec{
+				PortRange: &kubeconv1alpha1.PortRange{Min: 1000, Max: 1000},
+			},
+		},
+	}}
+	obj := newSharedLB("bar", "tiny", "", 0)
+	allowed, reason, err := h.mutatingSharedLBFn(context.TODO(), &obj)
+	if err != nil || allowed || reason == "" {
+		t.Errorf("mutatingSharedLBFn() = %v, %q, %v, want it to be denied for running out of ports", allowed, reason, err)
+	}
+
+	// the range of the pool is inverted
+	h.Client.(*fakeClient).pool.Spec.PortRange = &kubeconv1alpha1.PortRange{Min: 1001, Max: 1000}
+	obj = newSharedLB("bar", "tiny", "", 0)
+	allowed, reason, err = h.mutatingSharedLBFn(context.TODO(), &obj)
+	if err != nil || allowed || reason == "" {
+		t.Errorf("mutatingSharedLBFn() = %v, %q, %v, want it to be denied for the invalid port range", allowed, reason, err)
+	}
+
+	// it's fine in the default range
+	obj = newSharedLB("bar", "", "", 0)
+	if allowed, _, err := h.mutatingSharedLBFn(context.TODO(), &obj); err != nil || !allowed || obj.Spec.Ports[0].Port == 0 {
+		t.Errorf("mutatingSharedLBFn() = %v, %v with ports %v, want a port to be assigned", allowed, err, obj.Spec.Ports)
+	}
+}
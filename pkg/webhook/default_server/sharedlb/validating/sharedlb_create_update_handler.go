@@ -0,0 +1,237 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validating
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/runtime/inject"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	admissiontypes "sigs.k8s.io/controller-runtime/pkg/webhook/admission/types"
+)
+
+func init() {
+	webhookName := "validating-create-update-sharedlb"
+	if HandlerMap[webhookName] == nil {
+		HandlerMap[webhookName] = []admission.Handler{}
+	}
+	HandlerMap[webhookName] = append(HandlerMap[webhookName], &SharedLBCreateUpdateHandler{})
+}
+
+// SharedLBCreateUpdateHandler handles SharedLB
+type SharedLBCreateUpdateHandler struct {
+	// Client is used to look up other tenants of the same LoadBalancer
+	Client client.Client
+
+	// Decoder decodes objects
+	Decoder admissiontypes.Decoder
+}
+
+func (h *SharedLBCreateUpdateHandler) validatingSharedLBFn(ctx context.Context, obj *kubeconv1alpha1.SharedLB) (bool, string, error) {
+	// don't block finalizer removal of an object being deleted
+	if !obj.DeletionTimestamp.IsZero() {
+		return true, "object is being deleted", nil
+	}
+
+	if errs := append(validateSpec(&obj.Spec), validateAnnotations(obj)...); len(errs) > 0 {
+		return false, strings.Join(errs, "; "), nil
+	}
+
+	// a SharedLBPool can be created after SharedLBs referring to it,
+	// so it's only checked when it exists
+	if obj.Spec.PoolName != "" {
+		pool := &kubeconv1alpha1.SharedLBPool{}
+		err := h.Client.Get(ctx, types.NamespacedName{Name: obj.Spec.PoolName}, pool)
+		if err != nil && !errors.IsNotFound(err) {
+			return false, "", err
+		}
+		if err == nil {
+			if errs := validatePortRange(&obj.Spec, pool); len(errs) > 0 {
+				return false, strings.Join(errs, "; "), nil
+			}
+		}
+	}
+
+	// the object hasn't been placed onto a LoadBalancer yet
+	if obj.Status.Ref == "" {
+		return true, "allowed to be admitted", nil
+	}
+	sharedLBs := &kubeconv1alpha1.SharedLBList{}
+	if err := h.Client.List(ctx, &client.ListOptions{}, sharedLBs); err != nil {
+		return false, "", err
+	}
+	if errs := validatePortConflicts(obj, sharedLBs.Items); len(errs) > 0 {
+		return false, strings.Join(errs, "; "), nil
+	}
+	return true, "allowed to be admitted", nil
+}
+
+// validateSpec checks the SharedLB spec on its own, and returns a list of error messages
+func validateSpec(spec *kubeconv1alpha1.SharedLBSpec) []string {
+	var errs []string
+	if len(spec.Selector) == 0 {
+		errs = append(errs, "spec.selector must not be empty")
+	}
+	if len(spec.Ports) == 0 {
+		errs = append(errs, "spec.ports must contain at least one port")
+	}
+	if spec.Strategy != "" {
+		if _, err := providers.ParseStrategy(spec.Strategy); err != nil {
+			errs = append(errs, fmt.Sprintf("spec.strategy: %v", err))
+		}
+	}
+	switch spec.PortMode {
+	case "", kubeconv1alpha1.SharedLBPortModeStrict, kubeconv1alpha1.SharedLBPortModeFlexible:
+	default:
+		errs = append(errs, fmt.Sprintf("spec.portMode: unsupported mode %q, must be one of %q and %q",
+			spec.PortMode, kubeconv1alpha1.SharedLBPortModeStrict, kubeconv1alpha1.SharedLBPortModeFlexible))
+	}
+	// it's an IP, or a hostname for LBs exposed on hostnames, e.g. AWS ELB
+	if ip := spec.LoadBalancerIP; ip != "" && net.ParseIP(ip) == nil && len(validation.IsDNS1123Subdomain(ip)) > 0 {
+		errs = append(errs, fmt.Sprintf("spec.loadBalancerIP: %q is neither an IP nor a hostname", ip))
+	}
+
+	// the same port number can be used by TCP and UDP
+	ports := make(map[providers.PortKey]struct{})
+	names := make(map[string]struct{})
+	for i, p := range spec.Ports {
+		// port 0 means it will be assigned by the controller
+		if p.Port < 0 || p.Port > 65535 {
+			errs = append(errs, fmt.Sprintf("spec.ports[%d].port: %d is not in range 1-65535", i, p.Port))
+		} else if p.Port != 0 {
+			key := providers.PortKeyOf(p)
+			if _, ok := ports[key]; ok {
+				errs = append(errs, fmt.Sprintf("spec.ports[%d].port: duplicate port %s", i, key))
+			}
+			ports[key] = struct{}{}
+		}
+		if p.TargetPort.Type == intstr.Int && (p.TargetPort.IntVal < 0 || p.TargetPort.IntVal > 65535) {
+			errs = append(errs, fmt.Sprintf("spec.ports[%d].targetPort: %d is not in range 1-65535", i, p.TargetPort.IntVal))
+		}
+		if p.Protocol != "" && p.Protocol != corev1.ProtocolTCP && p.Protocol != corev1.ProtocolUDP {
+			errs = append(errs, fmt.Sprintf("spec.ports[%d].protocol: unsupported protocol %q, only TCP and UDP are supported", i, p.Protocol))
+		}
+		if p.Name != "" {
+			if _, ok := names[p.Name]; ok {
+				errs = append(errs, fmt.Sprintf("spec.ports[%d].name: duplicate name %q", i, p.Name))
+			}
+			names[p.Name] = struct{}{}
+		}
+	}
+	return errs
+}
+
+// validateAnnotations checks annotations of obj read by the controller,
+// and returns a list of error messages
+func validateAnnotations(obj *kubeconv1alpha1.SharedLB) []string {
+	var errs []string
+	if target, ok := obj.Annotations[providers.TargetLBAnnotation]; ok {
+		if _, err := providers.ParseLBName(target); err != nil {
+			errs = append(errs, fmt.Sprintf("metadata.annotations[%s]: %v", providers.TargetLBAnnotation, err))
+		}
+	}
+	return errs
+}
+
+// validatePortRange checks ports of spec against the port range of pool,
+// and returns a list of error messages
+func validatePortRange(spec *kubeconv1alpha1.SharedLBSpec, pool *kubeconv1alpha1.SharedLBPool) []string {
+	if pool.Spec.PortRange == nil {
+		return nil
+	}
+	if err := providers.ValidatePortRange(pool.Spec.PortRange); err != nil {
+		return []string{fmt.Sprintf("SharedLBPool %q has an invalid port range: %v", pool.Name, err)}
+	}
+	var errs []string
+	min, max := pool.Spec.PortRange.Min, pool.Spec.PortRange.Max
+	for i, p := range spec.Ports {
+		if p.Port != 0 && (p.Port < min || p.Port > max) {
+			errs = append(errs, fmt.Sprintf("spec.ports[%d].port: %d is not in range %d-%d of SharedLBPool %q", i, p.Port, min, max, pool.Name))
+		}
+	}
+	return errs
+}
+
+// validatePortConflicts checks ports of obj against the other tenants of the
+// LoadBalancer referred by obj.Status.Ref, and returns a list of error messages
+func validatePortConflicts(obj *kubeconv1alpha1.SharedLB, sharedLBs []kubeconv1alpha1.SharedLB) []string {
+	var errs []string
+	self := types.NamespacedName{Name: obj.Name, Namespace: obj.Namespace}
+	for _, tenant := range sharedLBs {
+		if tenant.Status.Ref != obj.Status.Ref || (types.NamespacedName{Name: tenant.Name, Namespace: tenant.Namespace}) == self {
+			continue
+		}
+		// ports replaced on the LoadBalancer are checked as they're exposed
+		for _, p := range providers.ExposedPorts(obj) {
+			if p.Port == 0 {
+				continue
+			}
+			for _, tp := range providers.ExposedPorts(&tenant) {
+				if providers.PortKeyOf(p) == providers.PortKeyOf(tp) {
+					errs = append(errs, fmt.Sprintf("port %s is already used by %s/%s on LoadBalancer %s", providers.PortKeyOf(p), tenant.Namespace, tenant.Name, obj.Status.Ref))
+				}
+			}
+		}
+	}
+	return errs
+}
+
+var _ admission.Handler = &SharedLBCreateUpdateHandler{}
+
+// Handle handles admission requests.
+func (h *SharedLBCreateUpdateHandler) Handle(ctx context.Context, req admissiontypes.Request) admissiontypes.Response {
+	obj := &kubeconv1alpha1.SharedLB{}
+
+	err := h.Decoder.Decode(req, obj)
+	if err != nil {
+		return admission.ErrorResponse(http.StatusBadRequest, err)
+	}
+
+	allowed, reason, err := h.validatingSharedLBFn(ctx, obj)
+	if err != nil {
+		return admission.ErrorResponse(http.StatusInternalServerError, err)
+	}
+	return admission.ValidationResponse(allowed, reason)
+}
+
+var _ inject.Client = &SharedLBCreateUpdateHandler{}
+
+// InjectClient injects the client into the SharedLBCreateUpdateHandler
+func (h *SharedLBCreateUpdateHandler) InjectClient(c client.Client) error {
+	h.Client = c
+	return nil
+}
+
+var _ inject.Decoder = &SharedLBCreateUpdateHandler{}
+
+// InjectDecoder injects the decoder into the SharedLBCreateUpdateHandler
+func (h *SharedLBCreateUpdateHandler) InjectDecoder(d admissiontypes.Decoder) error {
+	h.Decoder = d
+	return nil
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validating
+
+import (
+	"testing"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestValidateSpec(t *testing.T) {
+	selector := map[string]string{"app": "nginx"}
+	tests := []struct {
+		name    string
+		spec    kubeconv1alpha1.SharedLBSpec
+		wantErr int
+	}{
+		{
+			name: "valid spec",
+			spec: kubeconv1alpha1.SharedLBSpec{
+				Selector: selector,
+				Ports: []corev1.ServicePort{
+					{Name: "http", Port: 8080, TargetPort: intstr.FromInt(80)},
+					{Name: "dns", Port: 8053, Protocol: corev1.ProtocolUDP},
+				},
+				Strategy: "pack",
+			},
+		},
+		{
+			name: "port to be assigned",
+			spec: kubeconv1alpha1.SharedLBSpec{
+				Selector: selector,
+				Ports:    []corev1.ServicePort{{Port: 0}, {Name: "other", Port: 0}},
+			},
+		},
+		{
+			name:    "empty selector and ports",
+			spec:    kubeconv1alpha1.SharedLBSpec{},
+			wantErr: 2,
+		},
+		{
+			name: "duplicate ports",
+			spec: kubeconv1alpha1.SharedLBSpec{
+				Selector: selector,
+				Ports:    []corev1.ServicePort{{Name: "a", Port: 8080}, {Name: "b", Port: 8080}},
+			},
+			wantErr: 1,
+		},
+		{
+			name: "TCP and UDP on the same port",
+			spec: kubeconv1alpha1.SharedLBSpec{
+				Selector: selector,
+				Ports: []corev1.ServicePort{
+					{Name: "dns-tcp", Port: 53},
+					{Name: "dns-udp", Port: 53, Protocol: corev1.ProtocolUDP},
+				},
+			},
+		},
+		{
+			name: "port and targetPort out of range",
+			spec: kubeconv1alpha1.SharedLBSpec{
+				Selector: selector,
+				Ports:    []corev1.ServicePort{{Port: 70000, TargetPort: intstr.FromInt(-1)}},
+			},
+			wantErr: 2,
+		},
+		{
+			name: "unsupported protocol and duplicate name",
+			spec: kubeconv1alpha1.SharedLBSpec{
+				Selector: selector,
+				Ports: []corev1.ServicePort{
+					{Name: "a", Port: 8080, Protocol: corev1.Protocol("SCTP")},
+					{Name: "a", Port: 8081},
+				},
+			},
+			wantErr: 2,
+		},
+		{
+			name: "unsupported strategy",
+			spec: kubeconv1alpha1.SharedLBSpec{
+				Selector: selector,
+				Ports:    []corev1.ServicePort{{Port: 8080}},
+				Strategy: "first-fit",
+			},
+			wantErr: 1,
+		},
+		{
+			name: "flexible port mode",
+			spec: kubeconv1alpha1.SharedLBSpec{
+				Selector: selector,
+				Ports:    []corev1.ServicePort{{Port: 8080}},
+				PortMode: kubeconv1alpha1.SharedLBPortModeFlexible,
+			},
+		},
+		{
+			name: "unsupported port mode",
+			spec: kubeconv1alpha1.SharedLBSpec{
+				Selector: selector,
+				Ports:    []corev1.ServicePort{{Port: 8080}},
+				PortMode: "Random",
+			},
+			wantErr: 1,
+		},
+		{
+			name: "loadBalancerIP as an IP or a hostname",
+			spec: kubeconv1alpha1.SharedLBSpec{
+				Selector:       selector,
+				Ports:          []corev1.ServicePort{{Port: 8080}},
+				LoadBalancerIP: "a1b2c3-123456.us-west-2.elb.amazonaws.com",
+			},
+		},
+		{
+			name: "invalid loadBalancerIP",
+			spec: kubeconv1alpha1.SharedLBSpec{
+				Selector:       selector,
+				Ports:          []corev1.ServicePort{{Port: 8080}},
+				LoadBalancerIP: "1.2.3.4/32",
+			},
+			wantErr: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validateSpec(&tt.spec); len(got) != tt.wantErr {
+				t.Errorf("validateSpec() = %v, want %d error(s)", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateAnnotations(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		wantErr     int
+	}{
+		{annotations: nil},
+		{annotations: map[string]string{providers.TargetLBAnnotation: "lb-abcd1234"}},
+		{annotations: map[string]string{providers.TargetLBAnnotation: "default/lb-abcd1234"}},
+		{annotations: map[string]string{providers.TargetLBAnnotation: "default/"}, wantErr: 1},
+	}
+	for _, tt := range tests {
+		obj := &kubeconv1alpha1.SharedLB{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+		if got := validateAnnotations(obj); len(got) != tt.wantErr {
+			t.Errorf("validateAnnotations(%v) = %v, want %d error(s)", tt.annotations, got, tt.wantErr)
+		}
+	}
+}
+
+func TestValidatePortRange(t *testing.T) {
+	pool := &kubeconv1alpha1.SharedLBPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "gold"},
+		Spec: kubeconv1alpha1.SharedLBPoolSpec{
+			PortRange: &kubeconv1alpha1.PortRange{Min: 30000, Max: 30099},
+		},
+	}
+	tests := []struct {
+		name    string
+		ports   []int32
+		pool    *kubeconv1alpha1.SharedLBPool
+		wantErr int
+	}{
+		{
+			name:  "ports in range",
+			ports: []int32{30000, 30099, 0},
+			pool:  pool,
+		},
+		{
+			name:    "ports out of range",
+			ports:   []int32{29999, 30100},
+			pool:    pool,
+			wantErr: 2,
+		},
+		{
+			name:  "pool without port range",
+			ports: []int32{80},
+			pool:  &kubeconv1alpha1.SharedLBPool{ObjectMeta: metav1.ObjectMeta{Name: "silver"}},
+		},
+		{
+			name:  "pool with inverted port range",
+			ports: []int32{30050},
+			pool: &kubeconv1alpha1.SharedLBPool{
+				ObjectMeta: metav1.ObjectMeta{Name: "bronze"},
+				Spec: kubeconv1alpha1.SharedLBPoolSpec{
+					PortRange: &kubeconv1alpha1.PortRange{Min: 30099, Max: 30000},
+				},
+			},
+			wantErr: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &kubeconv1alpha1.SharedLBSpec{}
+			for _, p := range tt.ports {
+				spec.Ports = append(spec.Ports, corev1.ServicePort{Port: p})
+			}
+			if got := validatePortRange(spec, tt.pool); len(got) != tt.wantErr {
+				t.Errorf("validatePortRange() = %v, want %d error(s)", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidatePortConflicts(t *testing.T) {
+	newSharedLB := func(name, ref string, ports ...int32) kubeconv1alpha1.SharedLB {
+		slb := kubeconv1alpha1.SharedLB{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Status:     kubeconv1alpha1.SharedLBStatus{Ref: ref},
+		}
+		for _, p := range ports {
+			slb.Spec.Ports = append(slb.Spec.Ports, corev1.ServicePort{Port: p})
+		}
+		return slb
+	}
+	tenants := []kubeconv1alpha1.SharedLB{
+		newSharedLB("foo", "default/lb-1", 8080),
+		newSharedLB("bar", "default/lb-1", 8081, 8082),
+		newSharedLB("baz", "default/lb-2", 8083),
+	}
+	tests := []struct {
+		name    string
+		obj     kubeconv1alpha1.SharedLB
+		wantErr int
+	}{
+		{
+			name: "no conflict",
+			obj:  newSharedLB("foo", "default/lb-1", 8080, 8083),
+		},
+		{
+			name:    "conflict with another tenant",
+			obj:     newSharedLB("foo", "default/lb-1", 8081, 8082),
+			wantErr: 2,
+		},
+		{
+			name:    "port added on update is used by another tenant",
+			obj:     newSharedLB("foo", "default/lb-1", 8080, 8081),
+			wantErr: 1,
+		},
+		{
+			name: "same port of another protocol",
+			obj: func() kubeconv1alpha1.SharedLB {
+				slb := newSharedLB("qux", "default/lb-1", 8080)
+				slb.Spec.Ports[0].Protocol = corev1.ProtocolUDP
+				return slb
+			}(),
+		},
+		{
+			name: "same port on a different LoadBalancer",
+			obj:  newSharedLB("qux", "default/lb-2", 8080),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validatePortConflicts(&tt.obj, tenants); len(got) != tt.wantErr {
+				t.Errorf("validatePortConflicts() = %v, want %d error(s)", got, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validating
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+	"github.com/Huang-Wei/shared-loadbalancer/pkg/providers"
+	"sigs.k8s.io/controller-runtime/pkg/runtime/inject"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	admissiontypes "sigs.k8s.io/controller-runtime/pkg/webhook/admission/types"
+)
+
+func init() {
+	webhookName := "validating-create-update-sharedlbpool"
+	if HandlerMap[webhookName] == nil {
+		HandlerMap[webhookName] = []admission.Handler{}
+	}
+	HandlerMap[webhookName] = append(HandlerMap[webhookName], &SharedLBPoolCreateUpdateHandler{})
+}
+
+// SharedLBPoolCreateUpdateHandler handles SharedLBPool
+type SharedLBPoolCreateUpdateHandler struct {
+	// Decoder decodes objects
+	Decoder admissiontypes.Decoder
+}
+
+func (h *SharedLBPoolCreateUpdateHandler) validatingSharedLBPoolFn(ctx context.Context, obj *kubeconv1alpha1.SharedLBPool) (bool, string, error) {
+	if errs := validateSpec(&obj.Spec); len(errs) > 0 {
+		return false, strings.Join(errs, "; "), nil
+	}
+	return true, "allowed to be admitted", nil
+}
+
+// validateSpec checks what the CRD schema can't, i.e. constraints across fields,
+// and returns a list of error messages
+func validateSpec(spec *kubeconv1alpha1.SharedLBPoolSpec) []string {
+	var errs []string
+	if spec.PortRange != nil {
+		if err := providers.ValidatePortRange(spec.PortRange); err != nil {
+			errs = append(errs, fmt.Sprintf("spec.portRange: %v", err))
+		}
+	}
+	return errs
+}
+
+var _ admission.Handler = &SharedLBPoolCreateUpdateHandler{}
+
+// Handle handles admission requests.
+func (h *SharedLBPoolCreateUpdateHandler) Handle(ctx context.Context, req admissiontypes.Request) admissiontypes.Response {
+	obj := &kubeconv1alpha1.SharedLBPool{}
+
+	err := h.Decoder.Decode(req, obj)
+	if err != nil {
+		return admission.ErrorResponse(http.StatusBadRequest, err)
+	}
+
+	allowed, reason, err := h.validatingSharedLBPoolFn(ctx, obj)
+	if err != nil {
+		return admission.ErrorResponse(http.StatusInternalServerError, err)
+	}
+	return admission.ValidationResponse(allowed, reason)
+}
+
+var _ inject.Decoder = &SharedLBPoolCreateUpdateHandler{}
+
+// InjectDecoder injects the decoder into the SharedLBPoolCreateUpdateHandler
+func (h *SharedLBPoolCreateUpdateHandler) InjectDecoder(d admissiontypes.Decoder) error {
+	h.Decoder = d
+	return nil
+}
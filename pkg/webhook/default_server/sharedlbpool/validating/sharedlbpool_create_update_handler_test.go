@@ -0,0 +1,56 @@
+/*
+Copyright 2018 The Shared LoadBalancer Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validating
+
+import (
+	"testing"
+
+	kubeconv1alpha1 "github.com/Huang-Wei/shared-loadbalancer/pkg/apis/kubecon/v1alpha1"
+)
+
+func TestValidateSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    kubeconv1alpha1.SharedLBPoolSpec
+		wantErr int
+	}{
+		{
+			name: "no port range",
+			spec: kubeconv1alpha1.SharedLBPoolSpec{Capacity: 5},
+		},
+		{
+			name: "valid port range",
+			spec: kubeconv1alpha1.SharedLBPoolSpec{PortRange: &kubeconv1alpha1.PortRange{Min: 30000, Max: 30099}},
+		},
+		{
+			name: "port range of one port",
+			spec: kubeconv1alpha1.SharedLBPoolSpec{PortRange: &kubeconv1alpha1.PortRange{Min: 30000, Max: 30000}},
+		},
+		{
+			name:    "inverted port range",
+			spec:    kubeconv1alpha1.SharedLBPoolSpec{PortRange: &kubeconv1alpha1.PortRange{Min: 30099, Max: 30000}},
+			wantErr: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validateSpec(&tt.spec); len(got) != tt.wantErr {
+				t.Errorf("validateSpec() = %v, want %d error(s)", got, tt.wantErr)
+			}
+		})
+	}
+}